@@ -28,17 +28,735 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/origins": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Viewer requests rejected per browser origin",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Administrator token",
+                        "name": "X-Admin-Token",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/pages": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List claimed pages",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Administrator token",
+                        "name": "X-Admin-Token",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/pages/{page}": {
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Transfer the page to a new owner",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Administrator token",
+                        "name": "X-Admin-Token",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New page secret",
+                        "name": "secret",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.PageSecret"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "summary": "Reset page ownership",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Administrator token",
+                        "name": "X-Admin-Token",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/rejected": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Oversized messages rejected per remote IP",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Administrator token",
+                        "name": "X-Admin-Token",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "integer"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/api/stats": {
             "get": {
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Provide actual list of connected accounts",
+                "summary": "Provide actual list of connected accounts",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.StateData"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/pages/{page}/redaction": {
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Set the redaction profile of the page",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Page secret",
+                        "name": "X-Page-Secret",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Redaction profile",
+                        "name": "profile",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.RedactionProfile"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/pages/{page}/tokens": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Issue a viewer token for the private page",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Page secret",
+                        "name": "X-Page-Secret",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Token lifetime",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.TokenRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ViewerToken"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/pages/{page}/visibility": {
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Set who may view the page",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Page secret",
+                        "name": "X-Page-Secret",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Page settings",
+                        "name": "settings",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.PageSettings"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/push/{page}": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Push account data from terminals unable to reach MetaTrader listener",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Page secret key",
+                        "name": "X-Page-Secret",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Account data, the first push should declare updatefreq",
+                        "name": "message",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.Message"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ResponseMsg"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ResponseMsg"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ResponseMsg"
+                        }
+                    },
+                    "410": {
+                        "description": "Gone",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ResponseMsg"
+                        }
+                    },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.ResponseMsg"
+                        }
+                    }
+                }
+            }
+        },
+        "/rest/{page}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide actual data on connected account",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.AccountData"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/rest/{page}/events": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide order events of connected account: opened, modified, partial, closed",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "The last received event sequence number",
+                        "name": "since",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.EventsData"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/rest/{page}/history": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide closed orders of connected account, the oldest first",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/metatrader.ClosedOrder"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/rest/{page}/series": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide balance, equity, margin level and profit history of connected account",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Start time, RFC 3339 or Unix seconds",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End time, RFC 3339 or Unix seconds, now if empty",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "minute",
+                        "description": "Period of points: second, minute, hour",
+                        "name": "resolution",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/metatrader.SeriesPoint"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/rest/{page}/stats": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide trading statistics of connected account: drawdown, win rate, profit factor etc.",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/metatrader.StateData"
+                            "$ref": "#/definitions/metatrader.PerformanceStats"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
                         }
                     },
                     "500": {
@@ -50,12 +768,96 @@ var doc = `{
                 }
             }
         },
-        "/rest/{page}": {
+        "/sse/{page}": {
+            "get": {
+                "produces": [
+                    "text/event-stream"
+                ],
+                "summary": "Provide actual data on connected account via Server-Sent Events",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Account Page name",
+                        "name": "page",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "account",
+                        "description": "Comma separated channels: account, history, events, delta, status",
+                        "name": "channels",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ID of the last received event",
+                        "name": "Last-Event-ID",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.AccountData"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/wss": {
             "get": {
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Provide actual data on connected account",
+                "summary": "Provide actual data on several accounts via one WebSocket connection",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/metatrader.PageMessage"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/wss/{page}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Provide actual data on connected account via WebSocket connection",
                 "parameters": [
                     {
                         "type": "string",
@@ -63,13 +865,38 @@ var doc = `{
                         "name": "page",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead",
+                        "name": "token",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "account",
+                        "description": "Comma separated channels: account, history, events, delta, status",
+                        "name": "channels",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/metatrader.Account"
+                            "$ref": "#/definitions/metatrader.AccountData"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
                         }
                     },
                     "404": {
@@ -86,47 +913,207 @@ var doc = `{
                     }
                 }
             }
+        }
+    },
+    "definitions": {
+        "metatrader.AccountData": {
+            "type": "object",
+            "properties": {
+                "balance": {
+                    "type": "string",
+                    "example": "1000.00"
+                },
+                "clientversion": {
+                    "type": "string",
+                    "example": "1.0"
+                },
+                "closed": {
+                    "description": "Closed tickets, used instead of omitted orders if deltaorders feature is enabled",
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "example": "325145411"
+                    }
+                },
+                "company": {
+                    "type": "string",
+                    "example": "My own company"
+                },
+                "connectedSince": {
+                    "description": "The current connection start, absent if offline",
+                    "type": "string",
+                    "example": "2021-01-06T09:00:00.000000000+03:00"
+                },
+                "equity": {
+                    "type": "string",
+                    "example": "1000.0"
+                },
+                "features": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "heartbeat",
+                        "deltaorders"
+                    ]
+                },
+                "freemargin": {
+                    "type": "string",
+                    "example": "1000.0"
+                },
+                "heartbeat": {
+                    "description": "Heartbeat is sent instead of update when nothing has changed, other fields are ignored",
+                    "type": "boolean"
+                },
+                "lastSeen": {
+                    "description": "The last update or heartbeat",
+                    "type": "string",
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
+                },
+                "login": {
+                    "type": "string",
+                    "example": "010203"
+                },
+                "margin": {
+                    "type": "string",
+                    "example": "1000.0"
+                },
+                "marginlevel": {
+                    "type": "string",
+                    "example": "100.0"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "Alexandre Dumas"
+                },
+                "online": {
+                    "type": "boolean",
+                    "example": true
+                },
+                "orders": {
+                    "description": "Ticket is used as Order key",
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/metatrader.Order"
+                    }
+                },
+                "orderscount": {
+                    "type": "integer",
+                    "example": 3
+                },
+                "page": {
+                    "type": "string",
+                    "example": "my-test-page"
+                },
+                "profittotal": {
+                    "type": "string",
+                    "example": "0.0"
+                },
+                "redaction": {
+                    "$ref": "#/definitions/metatrader.RedactionProfile"
+                },
+                "secret": {
+                    "type": "string",
+                    "example": "my-secret-key"
+                },
+                "server": {
+                    "type": "string",
+                    "example": "Metatrader test server"
+                },
+                "started": {
+                    "type": "string",
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
+                },
+                "updated": {
+                    "type": "string",
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
+                },
+                "updatefreq": {
+                    "type": "string",
+                    "example": "minute"
+                }
+            }
+        },
+        "metatrader.ClosedOrder": {
+            "type": "object",
+            "properties": {
+                "closed": {
+                    "type": "string",
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
+                },
+                "curvolume": {
+                    "type": "string",
+                    "example": "0.1"
+                },
+                "initvolume": {
+                    "type": "string",
+                    "example": "0.1"
+                },
+                "priceopen": {
+                    "type": "string",
+                    "example": "1.13234"
+                },
+                "pricesl": {
+                    "type": "string",
+                    "example": "0.0"
+                },
+                "profit": {
+                    "type": "string",
+                    "example": "-10.23"
+                },
+                "sl": {
+                    "type": "string",
+                    "example": "0.0"
+                },
+                "swap": {
+                    "type": "string",
+                    "example": "0.1"
+                },
+                "symbol": {
+                    "type": "string",
+                    "example": "EURUSD"
+                },
+                "ticket": {
+                    "type": "string",
+                    "example": "325145411"
+                },
+                "timeopen": {
+                    "type": "string",
+                    "example": "2020-12-20 23:10:01"
+                },
+                "tp": {
+                    "type": "string",
+                    "example": "0.0"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "1"
+                }
+            }
         },
-        "/wss/{page}": {
-            "get": {
-                "produces": [
-                    "application/json"
-                ],
-                "summary": "Provide actual data on connected account via WebSocket connection",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "Account Page name",
-                        "name": "page",
-                        "in": "path",
-                        "required": true
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "OK",
-                        "schema": {
-                            "$ref": "#/definitions/metatrader.Account"
-                        }
-                    },
-                    "404": {
-                        "description": "Not Found",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "500": {
-                        "description": "Internal Server Error",
-                        "schema": {
-                            "type": "string"
-                        }
+        "metatrader.EventsData": {
+            "type": "object",
+            "properties": {
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/metatrader.OrderEvent"
                     }
+                },
+                "seq": {
+                    "description": "The last event sequence number, pass it as since with the next request",
+                    "type": "integer",
+                    "example": 42
+                },
+                "truncated": {
+                    "description": "Some events after since are lost, the account should be read again",
+                    "type": "boolean",
+                    "example": false
                 }
             }
-        }
-    },
-    "definitions": {
-        "metatrader.Account": {
+        },
+        "metatrader.Message": {
             "type": "object",
             "properties": {
                 "balance": {
@@ -137,6 +1124,14 @@ var doc = `{
                     "type": "string",
                     "example": "1.0"
                 },
+                "closed": {
+                    "description": "Closed tickets, used instead of omitted orders if deltaorders feature is enabled",
+                    "type": "array",
+                    "items": {
+                        "type": "string",
+                        "example": "325145411"
+                    }
+                },
                 "company": {
                     "type": "string",
                     "example": "My own company"
@@ -145,10 +1140,24 @@ var doc = `{
                     "type": "string",
                     "example": "1000.0"
                 },
+                "features": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "heartbeat",
+                        "deltaorders"
+                    ]
+                },
                 "freemargin": {
                     "type": "string",
                     "example": "1000.0"
                 },
+                "heartbeat": {
+                    "description": "Heartbeat is sent instead of update when nothing has changed, other fields are ignored",
+                    "type": "boolean"
+                },
                 "login": {
                     "type": "string",
                     "example": "010203"
@@ -184,17 +1193,21 @@ var doc = `{
                     "type": "string",
                     "example": "0.0"
                 },
+                "secret": {
+                    "type": "string",
+                    "example": "my-secret-key"
+                },
                 "server": {
                     "type": "string",
                     "example": "Metatrader test server"
                 },
                 "started": {
                     "type": "string",
-                    "example": "2020-12-20 23:10:01"
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
                 },
                 "updated": {
                     "type": "string",
-                    "example": "2020-12-20 23:10:01"
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
                 },
                 "updatefreq": {
                     "type": "string",
@@ -247,7 +1260,253 @@ var doc = `{
                 },
                 "type": {
                     "type": "string",
-                    "example": "OP_BUY"
+                    "example": "1"
+                }
+            }
+        },
+        "metatrader.OrderEvent": {
+            "type": "object",
+            "properties": {
+                "order": {
+                    "$ref": "#/definitions/metatrader.Order"
+                },
+                "previous": {
+                    "$ref": "#/definitions/metatrader.Order"
+                },
+                "seq": {
+                    "type": "integer",
+                    "example": 42
+                },
+                "ticket": {
+                    "type": "string",
+                    "example": "325145411"
+                },
+                "time": {
+                    "type": "string",
+                    "example": "2021-01-06T09:12:54.031357064+03:00"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "modified"
+                }
+            }
+        },
+        "metatrader.PageMessage": {
+            "type": "object",
+            "properties": {
+                "data": {
+                    "type": "object"
+                },
+                "page": {
+                    "type": "string",
+                    "example": "my-test-page"
+                }
+            }
+        },
+        "metatrader.PageSecret": {
+            "type": "object",
+            "properties": {
+                "secret": {
+                    "type": "string",
+                    "example": "my-secret-key"
+                }
+            }
+        },
+        "metatrader.PageSettings": {
+            "type": "object",
+            "properties": {
+                "visibility": {
+                    "type": "string",
+                    "enum": [
+                        "public",
+                        "unlisted",
+                        "private"
+                    ],
+                    "example": "private"
+                }
+            }
+        },
+        "metatrader.PerformanceStats": {
+            "type": "object",
+            "properties": {
+                "averageLoss": {
+                    "type": "number",
+                    "example": -15
+                },
+                "averageWin": {
+                    "type": "number",
+                    "example": 29.18
+                },
+                "grossLoss": {
+                    "type": "string",
+                    "example": "-120.00"
+                },
+                "grossProfit": {
+                    "type": "string",
+                    "example": "350.20"
+                },
+                "largestLoss": {
+                    "type": "string",
+                    "example": "-40.00"
+                },
+                "largestWin": {
+                    "type": "string",
+                    "example": "80.00"
+                },
+                "losses": {
+                    "type": "integer",
+                    "example": 8
+                },
+                "maxDrawdown": {
+                    "description": "Equity drop from its peak",
+                    "type": "string",
+                    "example": "55.30"
+                },
+                "maxDrawdownPercent": {
+                    "type": "number",
+                    "example": 5.1
+                },
+                "netProfit": {
+                    "type": "string",
+                    "example": "230.20"
+                },
+                "profitFactor": {
+                    "description": "null without losses",
+                    "type": "number",
+                    "example": 2.92
+                },
+                "symbols": {
+                    "description": "Closed trades per symbol",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "timeInMarket": {
+                    "description": "Seconds with at least one open position",
+                    "type": "integer",
+                    "example": 3600
+                },
+                "timeInMarketPercent": {
+                    "type": "number",
+                    "example": 25
+                },
+                "trades": {
+                    "type": "integer",
+                    "example": 20
+                },
+                "winRate": {
+                    "type": "number",
+                    "example": 60
+                },
+                "wins": {
+                    "type": "integer",
+                    "example": 12
+                }
+            }
+        },
+        "metatrader.PerformanceSummary": {
+            "type": "object",
+            "properties": {
+                "maxDrawdownPercent": {
+                    "type": "number",
+                    "example": 5.1
+                },
+                "profitFactor": {
+                    "type": "number",
+                    "example": 2.92
+                },
+                "trades": {
+                    "type": "integer",
+                    "example": 20
+                },
+                "winRate": {
+                    "type": "number",
+                    "example": 60
+                }
+            }
+        },
+        "metatrader.RedactionProfile": {
+            "type": "object",
+            "properties": {
+                "hideIdentity": {
+                    "description": "Name, login, server and company are not shown",
+                    "type": "boolean",
+                    "example": true
+                },
+                "hideLots": {
+                    "description": "Order volumes are not shown",
+                    "type": "boolean",
+                    "example": false
+                },
+                "relativeBalances": {
+                    "description": "Balance, equity, margin and profits are shown as percent of the starting balance",
+                    "type": "boolean",
+                    "example": true
+                }
+            }
+        },
+        "metatrader.ResponseMsg": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string",
+                    "example": "wrong_secret"
+                },
+                "error": {
+                    "type": "string",
+                    "example": "Exceeded maximum orders number"
+                },
+                "features": {
+                    "description": "Features enabled for the connection, sent in reply to requested ones",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "heartbeat"
+                    ]
+                },
+                "message": {
+                    "type": "string",
+                    "example": "New API version is available"
+                },
+                "validation": {
+                    "description": "Details of the invalid_message error",
+                    "$ref": "#/definitions/metatrader.ValidationError"
+                }
+            }
+        },
+        "metatrader.SeriesPoint": {
+            "type": "object",
+            "properties": {
+                "balance": {
+                    "type": "string",
+                    "example": "1000.00"
+                },
+                "equity": {
+                    "type": "string",
+                    "example": "1010.50"
+                },
+                "equitymax": {
+                    "type": "string",
+                    "example": "1020.00"
+                },
+                "equitymin": {
+                    "type": "string",
+                    "example": "990.10"
+                },
+                "marginlevel": {
+                    "type": "string",
+                    "example": "1500.0"
+                },
+                "profittotal": {
+                    "type": "string",
+                    "example": "10.50"
+                },
+                "time": {
+                    "type": "string",
+                    "example": "2021-01-06T09:12:00+03:00"
                 }
             }
         },
@@ -263,23 +1522,138 @@ var doc = `{
                 "online": {
                     "type": "integer",
                     "example": 1
+                },
+                "rejectedMessages": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "rejectedOrigins": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "throttleDisconnects": {
+                    "type": "integer",
+                    "example": 0
                 }
             }
         },
         "metatrader.StateEntry": {
             "type": "object",
             "properties": {
+                "connectedSince": {
+                    "description": "empty if offline",
+                    "type": "string",
+                    "example": "2020-12-20 23:10:01"
+                },
+                "lastSeen": {
+                    "type": "string",
+                    "example": "2020-12-20 23:15:01"
+                },
+                "online": {
+                    "type": "boolean",
+                    "example": true
+                },
                 "page": {
                     "type": "string",
                     "example": "my-test-page"
                 },
+                "performance": {
+                    "$ref": "#/definitions/metatrader.PerformanceSummary"
+                },
                 "started": {
                     "type": "string",
                     "example": "2020-12-20 23:10:01"
                 },
+                "throttle": {
+                    "$ref": "#/definitions/metatrader.ThrottleStats"
+                },
                 "updateFreq": {
                     "type": "string",
                     "example": "minute"
+                },
+                "viewers": {
+                    "$ref": "#/definitions/metatrader.ViewerStats"
+                }
+            }
+        },
+        "metatrader.ThrottleStats": {
+            "type": "object",
+            "properties": {
+                "coalesced": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "dropped": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "throttled": {
+                    "type": "integer",
+                    "example": 0
+                }
+            }
+        },
+        "metatrader.TokenRequest": {
+            "type": "object",
+            "properties": {
+                "owner": {
+                    "type": "boolean",
+                    "example": false
+                },
+                "ttl": {
+                    "type": "string",
+                    "example": "24h"
+                }
+            }
+        },
+        "metatrader.ValidationError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "type": "string",
+                    "example": "orders[325145411].symbol"
+                },
+                "rule": {
+                    "type": "string",
+                    "example": "charset"
+                },
+                "value": {
+                    "type": "string",
+                    "example": "\u003cscript\u003e"
+                }
+            }
+        },
+        "metatrader.ViewerStats": {
+            "type": "object",
+            "properties": {
+                "conflated": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "disconnected": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "dropped": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "viewers": {
+                    "type": "integer",
+                    "example": 1
+                }
+            }
+        },
+        "metatrader.ViewerToken": {
+            "type": "object",
+            "properties": {
+                "expires": {
+                    "type": "string",
+                    "example": "2021-01-02T15:04:05Z"
+                },
+                "token": {
+                    "type": "string",
+                    "example": "kjm1ds0.Mq3nYl0p..."
                 }
             }
         }
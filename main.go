@@ -2,6 +2,7 @@ package main
 
 import (
 	"engine/metatrader"
+	"flag"
 	"os"
 	"os/signal"
 
@@ -20,6 +21,9 @@ const primaryMetatraderPort string = ":8181"
 
 // @description Swagger API doc for Metatrader.live.
 func main() {
+	configFile := flag.String("config", "", "JSON configuration file, defaults are used if not set")
+	flag.Parse()
+
 	zaplog, err := zap.NewProduction()
 	if err != nil {
 		println("Failed to initialize zap logger: " + err.Error())
@@ -27,9 +31,29 @@ func main() {
 	}
 	log := zaplog.Sugar()
 
+	cfg := metatrader.DefaultConfig()
+	if *configFile != "" {
+		if cfg, err = metatrader.LoadConfig(*configFile); err != nil {
+			log.Fatal("Failed to load configuration: ", err)
+		}
+	}
+
 	// TCP server on 8181 to listen MT clients
-	go metatrader.NewFactory(primaryMetatraderPort, log).Run()
-	log.Info("MetaTrader listener is up and running on :8181")
+	mt, err := metatrader.NewFactoryWithConfig(primaryMetatraderPort, cfg, log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go mt.Run()
+	if cfg.TLS.Enabled() {
+		log.Info("MetaTrader TLS listener is up and running on :8181")
+	} else {
+		log.Info("MetaTrader listener is up and running on :8181")
+	}
+	if cfg.JSONAddr != "" && cfg.TLS.Enabled() {
+		log.Info("MetaTrader JSON TLS listener is up and running on " + cfg.JSONAddr)
+	} else if cfg.JSONAddr != "" {
+		log.Info("MetaTrader JSON listener is up and running on " + cfg.JSONAddr)
+	}
 
 	// Running GO app as a service
 	// https://fabianlee.org/2017/05/21/golang-running-a-go-binary-as-a-systemd-service-on-ubuntu-16-04/
@@ -0,0 +1,320 @@
+package metatrader
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PageVisibility tells who may view the page
+type PageVisibility string
+
+// Page visibility settings, pages are public unless the owner sets otherwise
+const (
+	VisibilityPublic   PageVisibility = "public"   // listed in /api/stats, viewed by anyone
+	VisibilityUnlisted PageVisibility = "unlisted" // viewed by anyone knowing the name
+	VisibilityPrivate  PageVisibility = "private"  // viewed with access token only
+)
+
+// Viewer token defaults
+const (
+	DefaultTokenTTL = 24 * time.Hour
+	MaxTokenTTL     = 30 * 24 * time.Hour
+)
+
+// PageSettings are set by the page owner
+type PageSettings struct {
+	Visibility PageVisibility `json:"visibility" example:"private" enums:"public,unlisted,private"`
+}
+
+// TokenRequest asks for a viewer token valid for TTL, one day if not set
+// Owner token gets data without redaction
+type TokenRequest struct {
+	TTL   Duration `json:"ttl" swaggertype:"string" example:"24h"`
+	Owner bool     `json:"owner" example:"false"`
+}
+
+// ViewerToken gives access to the private page until it expires
+type ViewerToken struct {
+	Token   string    `json:"token" example:"kjm1ds0.Mq3nYl0p..."`
+	Expires time.Time `json:"expires" example:"2021-01-02T15:04:05Z"`
+}
+
+// TokenClaims are signed in the viewer token
+type TokenClaims struct {
+	Expires time.Time
+	Owner   bool
+}
+
+// ownerScope marks owner tokens
+const ownerScope = "owner"
+
+var errTokenInvalid = errors.New("Access token is not valid")
+
+// tokenClaimsKey keeps the viewer token claims in echo context, zero if there is no token
+const tokenClaimsKey = "tokenClaims"
+
+// bearerPrefix of Authorization header with viewer token, the scheme is case-insensitive
+const bearerPrefix = "Bearer "
+
+// Owner checks the secret of the claimed page
+func (r *PageRegistry) Owner(page, secret string) error {
+	r.RLock()
+	rec, ok := r.pages[page]
+	r.RUnlock()
+	if !ok {
+		return &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+	if secret == "" || bcrypt.CompareHashAndPassword([]byte(rec.SecretHash), []byte(secret)) != nil {
+		return &PageError{Code: ErrCodeWrongSecret, Text: "Secret key for page " + page + " is not valid"}
+	}
+	return nil
+}
+
+// Visibility of the page, unclaimed pages are public
+func (r *PageRegistry) Visibility(page string) PageVisibility {
+	r.RLock()
+	defer r.RUnlock()
+	if rec, ok := r.pages[page]; ok && rec.Visibility != "" {
+		return rec.Visibility
+	}
+	return VisibilityPublic
+}
+
+// validVisibility checks the visibility setting
+func validVisibility(v PageVisibility) error {
+	switch v {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return nil
+	}
+	return errors.New("Unknown visibility " + string(v))
+}
+
+// SetVisibility of the claimed page and store the registry
+func (r *PageRegistry) SetVisibility(page string, v PageVisibility) error {
+	if err := validVisibility(v); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	rec, ok := r.pages[page]
+	if !ok {
+		return &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+	prev := rec.Visibility
+	rec.Visibility = v
+	if err := r.save(); err != nil {
+		rec.Visibility = prev
+		return err
+	}
+	return nil
+}
+
+// IssueToken signs viewer token of the claimed page, owner token gets data without redaction
+// Tokens are bound to the claim, so transfer or reset of the page revokes them
+func (r *PageRegistry) IssueToken(page string, ttl time.Duration, owner bool) (*ViewerToken, error) {
+	r.RLock()
+	rec, ok := r.pages[page]
+	r.RUnlock()
+	if !ok {
+		return nil, &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+
+	// Token is the payload of expiration and scope, then its signature
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	payload := strconv.FormatInt(expires.Unix(), 36)
+	if owner {
+		payload += "." + ownerScope
+	}
+	return &ViewerToken{
+		Token:   payload + "." + r.sign(page, payload, rec.Claimed),
+		Expires: expires.UTC(),
+	}, nil
+}
+
+// VerifyToken checks the viewer token of the page and returns its claims
+func (r *PageRegistry) VerifyToken(page, token string) (TokenClaims, error) {
+	r.RLock()
+	rec, ok := r.pages[page]
+	r.RUnlock()
+	if !ok {
+		return TokenClaims{}, errTokenInvalid
+	}
+
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(r.sign(page, token[:i], rec.Claimed))) {
+		return TokenClaims{}, errTokenInvalid
+	}
+	fields := strings.Split(token[:i], ".")
+	exp, err := strconv.ParseInt(fields[0], 36, 64)
+	if err != nil || len(fields) > 2 || len(fields) == 2 && fields[1] != ownerScope {
+		return TokenClaims{}, errTokenInvalid
+	}
+	claims := TokenClaims{Expires: time.Unix(exp, 0), Owner: len(fields) == 2}
+	if !time.Now().Before(claims.Expires) {
+		return TokenClaims{}, errors.New("Access token is expired")
+	}
+	return claims, nil
+}
+
+func (r *PageRegistry) sign(page, payload string, claimed time.Time) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(page + "\n" + payload + "\n" + strconv.FormatInt(claimed.UnixNano(), 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenKey returns the configured key, or random one making tokens valid until restart
+func tokenKey(key string) ([]byte, error) {
+	if key != "" {
+		return []byte(key), nil
+	}
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	return buf, err
+}
+
+// viewerToken is taken from token query parameter, as browsers can not set WebSocket headers, or Bearer authorization
+func viewerToken(c echo.Context) string {
+	if token := c.QueryParam("token"); token != "" {
+		return token
+	}
+	// Other schemes, like Basic of a proxy, carry no token
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth) > len(bearerPrefix) && strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return auth[len(bearerPrefix):]
+	}
+	return ""
+}
+
+// authorizeViewer checks access to the page, token is required for private pages only
+// Claims of the token are returned, zero if there is none
+func (f *Factory) authorizeViewer(page, token string) (TokenClaims, error) {
+	if token != "" {
+		return f.pages.VerifyToken(page, token)
+	}
+	if f.pages.Visibility(page) == VisibilityPrivate {
+		return TokenClaims{}, errors.New("Access token is required to view page " + page)
+	}
+	return TokenClaims{}, nil
+}
+
+// viewerAuth middleware lets only token holders view private pages
+func (f *Factory) viewerAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims, err := f.authorizeViewer(c.Param("page"), viewerToken(c))
+		if err != nil {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		c.Set(tokenClaimsKey, claims)
+		return next(c)
+	}
+}
+
+// viewerClaims returns the token claims checked by viewerAuth, zero if there is no token
+func viewerClaims(c echo.Context) TokenClaims {
+	claims, _ := c.Get(tokenClaimsKey).(TokenClaims)
+	return claims
+}
+
+// addViewer adds the viewer with the token claims, the owner gets data without redaction
+func (a *Account) addViewer(viewer Viewer, claims TokenClaims, channels ...string) error {
+	if claims.Owner {
+		return a.AddRawViewer(viewer, channels...)
+	}
+	return a.AddViewer(viewer, channels...)
+}
+
+// expireViewer removes the viewer when its token expires, nothing is done if there is no expiration
+// The returned timer should be stopped when the viewer is gone
+func (a *Account) expireViewer(viewer Viewer, expires time.Time) *time.Timer {
+	if expires.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(expires), func() {
+		a.RemoveViewer(viewer)
+	})
+}
+
+// ownerAuth middleware checks X-Page-Secret header of the page owner
+func (f *Factory) ownerAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := f.pages.Owner(c.Param("page"), c.Request().Header.Get("X-Page-Secret")); err != nil {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		return next(c)
+	}
+}
+
+// VisibilityHandler sets the page visibility, the setting survives page transfer
+// @Summary Set who may view the page
+// @Accept json
+// @Param X-Page-Secret header string true "Page secret"
+// @Param page path string true "Account Page name"
+// @Param settings body PageSettings true "Page settings"
+// @Success 204
+// @failure 400 {string} Unknown visibility
+// @failure 403 {string} Access denied
+// @failure 500 {string} Server internal error
+// @Router /pages/{page}/visibility [put]
+func (f *Factory) VisibilityHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	var req PageSettings
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err := validVisibility(req.Visibility); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err := f.pages.SetVisibility(page, req.Visibility); err != nil {
+		if _, ok := err.(*PageError); ok {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		return err
+	}
+	f.log.Info("Page visibility set: ", page, " ", req.Visibility)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// TokenHandler issues a viewer token of the page
+// @Summary Issue a viewer token for the private page
+// @Accept json
+// @Produce json
+// @Param X-Page-Secret header string true "Page secret"
+// @Param page path string true "Account Page name"
+// @Param request body TokenRequest false "Token lifetime"
+// @Success 200 {object} ViewerToken
+// @failure 400 {string} Invalid lifetime
+// @failure 403 {string} Access denied
+// @Router /pages/{page}/tokens [post]
+func (f *Factory) TokenHandler(c echo.Context) error {
+	var req TokenRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+	ttl := time.Duration(req.TTL)
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	if ttl < 0 || ttl > time.Duration(f.cfg.Registry.MaxTokenTTL) {
+		return c.String(http.StatusBadRequest, "Token lifetime should be positive and at most "+time.Duration(f.cfg.Registry.MaxTokenTTL).String())
+	}
+
+	token, err := f.pages.IssueToken(c.Param("page"), ttl, req.Owner)
+	if err != nil {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, token)
+}
@@ -0,0 +1,210 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// apiCall sends the request with headers given as name, value pairs
+func apiCall(t *testing.T, method, url, body string, headers ...string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestRegistryToken(t *testing.T) {
+	println("TestRegistryToken started")
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+
+	_, err = r.IssueToken("test", time.Hour, false)
+	assertPageError(t, ErrCodeUnknownPage, err)
+
+	require.NoError(t, r.Authenticate("test", "secret"))
+	require.NoError(t, r.Authenticate("test2", "secret"))
+	token, err := r.IssueToken("test", time.Hour, false)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expires, time.Second)
+
+	claims, err := r.VerifyToken("test", token.Token)
+	assert.NoError(t, err)
+	assert.True(t, claims.Expires.Equal(token.Expires))
+	assert.False(t, claims.Owner)
+
+	owner, err := r.IssueToken("test", time.Hour, true)
+	require.NoError(t, err)
+	claims, err = r.VerifyToken("test", owner.Token)
+	assert.NoError(t, err)
+	assert.True(t, claims.Owner)
+	// Scope is signed
+	_, err = r.VerifyToken("test", strings.Replace(token.Token, ".", "."+ownerScope+".", 1))
+	assert.Error(t, err)
+
+	// Token is bound to the page and its signature
+	_, err = r.VerifyToken("test2", token.Token)
+	assert.Error(t, err)
+	_, err = r.VerifyToken("test", token.Token+"x")
+	assert.Error(t, err)
+	_, err = r.VerifyToken("test", "zzzzzz"+token.Token[strings.Index(token.Token, "."):])
+	assert.Error(t, err)
+
+	expired, err := r.IssueToken("test", -time.Second, false)
+	require.NoError(t, err)
+	_, err = r.VerifyToken("test", expired.Token)
+	assert.EqualError(t, err, "Access token is expired")
+
+	// Another key does not accept it
+	r2, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+	r2.pages = r.pages
+	_, err = r2.VerifyToken("test", token.Token)
+	assert.Error(t, err)
+
+	// Transfer revokes tokens, visibility is kept
+	require.NoError(t, r.SetVisibility("test", VisibilityPrivate))
+	require.NoError(t, r.Transfer("test", "new-secret"))
+	_, err = r.VerifyToken("test", token.Token)
+	assert.Error(t, err)
+	assert.Equal(t, VisibilityPrivate, r.Visibility("test"))
+}
+
+func TestRegistryVisibility(t *testing.T) {
+	println("TestRegistryVisibility started")
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, VisibilityPublic, r.Visibility("test"))
+	assertPageError(t, ErrCodeUnknownPage, r.SetVisibility("test", VisibilityPrivate))
+
+	require.NoError(t, r.Authenticate("test", "secret"))
+	assert.Equal(t, VisibilityPublic, r.Visibility("test"))
+	assert.NoError(t, r.SetVisibility("test", VisibilityUnlisted))
+	assert.Equal(t, VisibilityUnlisted, r.Visibility("test"))
+	assert.Error(t, r.SetVisibility("test", "hidden"))
+	assert.Equal(t, VisibilityUnlisted, r.Visibility("test"))
+
+	assert.NoError(t, r.Owner("test", "secret"))
+	assertPageError(t, ErrCodeWrongSecret, r.Owner("test", "another"))
+	assertPageError(t, ErrCodeWrongSecret, r.Owner("test", ""))
+	assertPageError(t, ErrCodeUnknownPage, r.Owner("test2", "secret"))
+}
+
+func TestPrivatePage(t *testing.T) {
+	println("TestPrivatePage started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	s := httptest.NewServer(mt.newAPIServer())
+	defer s.Close()
+	require.NoError(t, mt.pages.Authenticate("test", "secret"))
+	mt.createAccount(&Message{Page: "test", UpdateFreq: "second", Balance: "100"})
+	mt.createAccount(&Message{Page: "open", UpdateFreq: "second"})
+
+	code, _ := apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Only the owner sets visibility
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/test/visibility", `{"visibility":"private"}`, "X-Page-Secret", "wrong")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/open/visibility", `{"visibility":"private"}`, "X-Page-Secret", "secret")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/test/visibility", `{"visibility":"hidden"}`, "X-Page-Secret", "secret")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/test/visibility", `{"visibility":"private"}`, "X-Page-Secret", "secret")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// Private page is not listed and not viewed without token
+	code, body := apiCall(t, http.MethodGet, s.URL+"/api/stats", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"page":"open"`)
+	assert.NotContains(t, body, `"page":"test"`)
+	for _, path := range []string{"", "/history", "/events", "/series", "/stats"} {
+		code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test"+path, "")
+		assert.Equal(t, http.StatusForbidden, code, path)
+	}
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test?token=bad", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/sse/test", "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = apiCall(t, http.MethodPost, s.URL+"/api/pages/test/tokens", `{"ttl":"1000h"}`, "X-Page-Secret", "secret")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = apiCall(t, http.MethodPost, s.URL+"/api/pages/test/tokens", `{"ttl":"1h"}`, "X-Page-Secret", "secret")
+	require.Equal(t, http.StatusOK, code)
+	var token ViewerToken
+	require.NoError(t, json.Unmarshal([]byte(body), &token))
+
+	code, body = apiCall(t, http.MethodGet, s.URL+"/api/rest/test?token="+token.Token, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"balance":"100"`)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test/stats", "", "Authorization", "Bearer "+token.Token)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/open", "", "Authorization", "Basic dXNlcjpwYXNz")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "", "Authorization", "Basic "+token.Token)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// WebSocket viewers
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss/test", nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss/test?token="+token.Token, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"balance":"100"`)
+
+	multi, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss", nil)
+	require.NoError(t, err)
+	defer multi.Close()
+	multi.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	require.NoError(t, multi.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "test"}))
+	assert.Equal(t, "Access token is required to view page test", readMulti(t, multi).Error)
+	require.NoError(t, multi.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "test", Token: token.Token}))
+	assert.Empty(t, readMulti(t, multi).Error)
+	assert.Contains(t, string(readMulti(t, multi).Data), `"balance":"100"`)
+
+	// Unlisted page is viewed without token but not listed
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/test/visibility", `{"visibility":"unlisted"}`, "X-Page-Secret", "secret")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "")
+	assert.Equal(t, http.StatusOK, code)
+	_, body = apiCall(t, http.MethodGet, s.URL+"/api/stats", "")
+	assert.NotContains(t, body, `"page":"test"`)
+}
+
+func TestViewerTokenExpiry(t *testing.T) {
+	println("TestViewerTokenExpiry started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+
+	viewer := NewChannelViewer("viewer", 1)
+	require.NoError(t, acc.AddViewer(viewer))
+	assert.Nil(t, acc.expireViewer(viewer, time.Time{}))
+	acc.expireViewer(viewer, time.Now().Add(20*time.Millisecond))
+	assert.Eventually(t, func() bool { return isClosed(viewer) }, TestTimeoutSeconds, time.Millisecond)
+	assert.Equal(t, 0, acc.broker.Stats().Viewers)
+}
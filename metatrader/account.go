@@ -2,64 +2,204 @@ package metatrader
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
 // Account represent connected MetaTrader Client
 // broker keep WebSocket clients array
 type Account struct {
-	Message
-	broker *BrokerFactory
+	Page          string
+	ClientVersion string
+	Started       time.Time
+	Updated       time.Time
+	UpdateFreq    string
+	Name          string
+	Login         string
+	Server        string
+	Company       string
+	Balance       Decimal
+	Equity        Decimal
+	Margin        Decimal
+	FreeMargin    Decimal
+	MarginLevel   Decimal
+	ProfitTotal   Decimal
+	OrdersCount   int
+	// Ticket is used as Order key
+	Orders map[OrderTicket]OrderState
+
+	broker  *BrokerFactory
+	limiter *updateLimiter
+	// Orders missing in update are kept, only listed in Message.Closed are removed
+	deltaOrders bool
+	// MetaTrader is connected, restored accounts are offline until it reconnects
+	online         bool
+	connectedSince time.Time
+	lastSeen       time.Time
+	// Removes the account if MetaTrader does not reconnect in time
+	graceTimer *time.Timer
+	// Closed orders, capped with historySize
+	history       []ClosedOrder
+	historySize   int
+	unsentHistory []ClosedOrder
+	// Order events, capped with eventsSize
+	events       []OrderEvent
+	eventsSize   int
+	eventSeq     uint64
+	unsentEvents []OrderEvent
+	// Balance and equity history
+	series *accountSeries
+	// Trading statistics
+	perf performance
+	// The last version sent to delta viewers
+	delta deltaState
+	// Viewers get data hidden by the profile, the owner gets it as is
+	redaction RedactionProfile
+	rawDelta  deltaState
+	// The first balance, redacted money values are relative to it
+	startBalance Decimal
+	// Protects account data from concurrent API reads
+	mu sync.RWMutex
+	// Broadcasts come from the connection and timers, viewers get them in order of encoding
+	broadcastMu sync.Mutex
 }
 
 // NewAccount ...
 func NewAccount(msg *Message, log *zap.SugaredLogger) *Account {
-	acc := new(Account) // Promoted fields may not initialized in list
+	return newAccountAt(msg, log, time.Now())
+}
+
+// newAccountAt creates the account registered at the time, write-ahead log replays it so
+func newAccountAt(msg *Message, log *zap.SugaredLogger, now time.Time) *Account {
+	acc := new(Account)
 	acc.broker = NewBroker(log)
 	acc.Page = msg.Page
-	acc.Started = time.Now()
+	acc.Started = now
 	acc.UpdateFreq = msg.UpdateFreq
 	acc.ClientVersion = msg.ClientVersion
-	acc.Orders = make(map[OrderTicket]Order)
-	acc.update(msg)
+	acc.Orders = make(map[OrderTicket]OrderState)
+	acc.historySize = MaxHistoryOrders
+	acc.eventsSize = MaxOrderEvents
+	acc.series = newAccountSeries()
+	acc.online = true
+	acc.connectedSince = now
+	acc.updateAt(msg, now)
 	return acc
 }
 
+// resume offline account with the first message of reconnected MetaTrader
+// Orders, history and statistics are kept, viewers stay connected
+func (a *Account) resume(msg *Message, deltaOrders bool, now time.Time) {
+	a.mu.Lock()
+	a.ClientVersion = msg.ClientVersion
+	a.UpdateFreq = msg.UpdateFreq
+	a.deltaOrders = deltaOrders
+	a.online = true
+	a.connectedSince = now
+	a.mu.Unlock()
+
+	a.updateAt(msg, now)
+}
+
+// Online reports whether MetaTrader is connected
+func (a *Account) Online() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.online
+}
+
 // close all viewers and destroy account
 func (a *Account) close() {
+	a.stopGrace()
+	if a.limiter != nil {
+		a.limiter.stop()
+	}
+	a.mu.Lock()
 	a.Orders = nil
+	a.mu.Unlock()
 	a.broker.Stop()
 }
 
 // Update update existing MT Client account with new data
 func (a *Account) update(upd *Message) {
+	a.updateAt(upd, time.Now())
+}
+
+// updateAt applies the update received at the time
+func (a *Account) updateAt(upd *Message, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	// Update Account data
+	// Orders of the first message are not reported as opened, they are there already
+	emit := !a.Updated.IsZero()
 	a.updateInfo(upd)
-	a.Updated = time.Now()
+	a.Updated = now
+	a.lastSeen = now
+	a.recordSeries(now)
 
-	// Remove closed orders
+	// Move closed orders to history
 	// Metatrader sends entire ticket array in every message
 	// If ticket array in new message doesn't contains one of Storage tickets, this means order was closed and should be removed from Storage
-	for tick := range a.Orders {
-		if _, ok := upd.Orders[tick]; !ok {
+	// Clients with deltaorders feature list closed tickets explicitly
+	// Tickets are processed in order, so events sequence does not depend on map iteration
+	var closed []OrderTicket
+	if a.deltaOrders {
+		closed = append(closed, upd.Closed...)
+	} else {
+		for tick := range a.Orders {
+			if _, ok := upd.Orders[tick]; !ok {
+				closed = append(closed, tick)
+			}
+		}
+	}
+	for _, tick := range sortTickets(closed) {
+		if ord, ok := a.Orders[tick]; ok {
+			a.closeOrder(tick, ord, now)
+			a.emitEvent(EventOrderClosed, tick, ord, nil, now)
+			a.perf.addTrade(ord)
 			delete(a.Orders, tick)
 		}
 	}
 
 	// Add new && Update existing orders
-	for tick, order := range upd.Orders {
-		if ord, ok := a.Orders[tick]; !ok {
-			a.Orders[tick] = order
-		} else {
-			ord.UpdateWith(order)
-			a.Orders[tick] = ord
+	updated := make([]OrderTicket, 0, len(upd.Orders))
+	for tick := range upd.Orders {
+		updated = append(updated, tick)
+	}
+	for _, tick := range sortTickets(updated) {
+		order := upd.Orders[tick]
+		prev, exists := a.Orders[tick]
+		ord := prev
+		ord.apply(order)
+		a.Orders[tick] = ord
+		if emit {
+			a.orderEvents(tick, prev, ord, exists, now)
 		}
 	}
 
 	a.OrdersCount = len(a.Orders)
+	a.trackPerformance(now)
+}
+
+// ordersAfter returns the number of orders the account would have after delta update
+func (a *Account) ordersAfter(upd *Message) int {
+	cnt := len(a.Orders)
+	for tick := range upd.Orders {
+		if _, ok := a.Orders[tick]; !ok {
+			cnt++
+		}
+	}
+	for _, tick := range upd.Closed {
+		if _, ok := a.Orders[tick]; ok {
+			if _, ok := upd.Orders[tick]; !ok {
+				cnt--
+			}
+		}
+	}
+	return cnt
 }
 
 func (a *Account) updateInfo(upd *Message) {
@@ -79,32 +219,54 @@ func (a *Account) updateInfo(upd *Message) {
 		a.Company = upd.Company
 	}
 
-	if upd.Balance != "" {
-		a.Balance = upd.Balance
-	}
-
-	if upd.Equity != "" {
-		a.Equity = upd.Equity
+	applyDecimal(&a.Balance, upd.Balance)
+	applyDecimal(&a.Equity, upd.Equity)
+	applyDecimal(&a.Margin, upd.Margin)
+	applyDecimal(&a.FreeMargin, upd.FreeMargin)
+	applyDecimal(&a.MarginLevel, upd.MarginLevel)
+	applyDecimal(&a.ProfitTotal, upd.ProfitTotal)
+	if !a.startBalance.IsSet() && a.Balance.Sign() > 0 {
+		a.startBalance = a.Balance
 	}
+}
 
-	if upd.Margin != "" {
-		a.Margin = upd.Margin
-	}
+// Snapshot returns the account in wire form
+// Viewers get the same JSON as MetaTrader sends, numbers keep their original precision
+func (a *Account) Snapshot() *Message {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 
-	if upd.FreeMargin != "" {
-		a.FreeMargin = upd.FreeMargin
+	msg := &Message{
+		Page:          a.Page,
+		ClientVersion: a.ClientVersion,
+		Started:       a.Started,
+		Updated:       a.Updated,
+		UpdateFreq:    a.UpdateFreq,
+		Name:          a.Name,
+		Login:         a.Login,
+		Server:        a.Server,
+		Company:       a.Company,
+		Balance:       a.Balance.String(),
+		Equity:        a.Equity.String(),
+		Margin:        a.Margin.String(),
+		FreeMargin:    a.FreeMargin.String(),
+		MarginLevel:   a.MarginLevel.String(),
+		ProfitTotal:   a.ProfitTotal.String(),
+		OrdersCount:   a.OrdersCount,
+		Orders:        make(map[OrderTicket]Order, len(a.Orders)),
 	}
-
-	if upd.MarginLevel != "" {
-		a.MarginLevel = upd.MarginLevel
+	for tick, ord := range a.Orders {
+		msg.Orders[tick] = ord.Order()
 	}
+	return msg
+}
 
-	if upd.ProfitTotal != "" {
-		a.ProfitTotal = upd.ProfitTotal
-	}
+// MarshalJSON writes the account snapshot with its status, redacted for viewers
+func (a *Account) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.accountData(a.redactor()))
 }
 
-// ToJSON create json message for WebSockets
+// ToJSON create json message for WebSockets, redacted for viewers
 func (a *Account) ToJSON() ([]byte, error) {
 	return json.Marshal(a)
 }
@@ -120,25 +282,93 @@ func (a *Account) ToJSON() ([]byte, error) {
 // 	e.UnmarshalEasyJSON(&l)
 // 	return l.Error()
 
-// AddViewer add new Websocket.Conn to the page viewers pool
-// Also send him Update message
-func (a *Account) AddViewer(viewer *websocket.Conn) {
-	a.broker.AddViewer(viewer)
+// AddViewer add new viewer to the page viewers pool
+// Viewer gets only messages of the channels, account updates if none given
+func (a *Account) AddViewer(viewer Viewer, channels ...string) error {
+	return a.broker.AddViewer(viewer, channels...)
 }
 
-// RemoveViewer removes a connection from page vewers pool
-func (a *Account) RemoveViewer(viewer *websocket.Conn) {
+// AddRawViewer adds the page owner, who gets data without redaction
+func (a *Account) AddRawViewer(viewer Viewer, channels ...string) error {
+	return a.broker.AddRawViewer(viewer, channels...)
+}
+
+// RemoveViewer removes a viewer from page vewers pool
+func (a *Account) RemoveViewer(viewer Viewer) {
 	a.broker.RemoveViewer(viewer)
 }
 
+// sendChannels sends the current state of the channels to the new viewer
+func (a *Account) sendChannels(viewer Viewer, channels []string) {
+	for _, ch := range channels {
+		switch ch {
+		case ChannelAccount:
+			a.SendUpdateToViewer(viewer)
+		case ChannelHistory:
+			a.SendHistoryToViewer(viewer)
+		case ChannelEvents:
+			a.SendEventsToViewer(viewer)
+		case ChannelDelta:
+			a.SendDeltaSnapshotToViewer(viewer)
+		case ChannelStatus:
+			a.SendStatusToViewer(viewer)
+		}
+	}
+}
+
 // SendUpdateToViewer ...
-func (a *Account) SendUpdateToViewer(viewer *websocket.Conn) {
-	msg, _ := a.ToJSON()
-	a.broker.SendMessageToViewer(viewer, msg)
+func (a *Account) SendUpdateToViewer(viewer Viewer) {
+	data, raw := a.encode(a.accountData)
+	a.broker.sendToViewer(viewer, ChannelAccount, data, raw)
+}
+
+// SendHistoryToViewer sends all closed orders as history event
+func (a *Account) SendHistoryToViewer(viewer Viewer) {
+	history := a.History()
+	data, raw := a.encode(func(r redactor) interface{} {
+		return Event{Channel: ChannelHistory, Data: r.closedOrders(history)}
+	})
+	a.broker.sendToViewer(viewer, ChannelHistory, data, raw)
+}
+
+// SendEventsToViewer sends all kept order events as events channel message
+func (a *Account) SendEventsToViewer(viewer Viewer) {
+	events := a.EventsSince(0).Events
+	data, raw := a.encode(func(r redactor) interface{} {
+		return Event{Channel: ChannelEvents, Data: r.events(events)}
+	})
+	a.broker.sendToViewer(viewer, ChannelEvents, data, raw)
 }
 
 // SendUpdateToAllViewers ...
+// Orders closed and events emitted since the previous call are sent to their channels
 func (a *Account) SendUpdateToAllViewers() {
-	msg, _ := a.ToJSON()
-	a.broker.SendMessage(msg)
+	a.broadcastMu.Lock()
+	defer a.broadcastMu.Unlock()
+
+	if closed := a.takeUnsentHistory(); len(closed) > 0 {
+		data, raw := a.encode(func(r redactor) interface{} {
+			return Event{Channel: ChannelHistory, Data: r.closedOrders(closed)}
+		})
+		a.broker.publish(ChannelHistory, data, raw)
+	}
+	if events := a.takeUnsentEvents(); len(events) > 0 {
+		data, raw := a.encode(func(r redactor) interface{} {
+			return Event{Channel: ChannelEvents, Data: r.events(events)}
+		})
+		a.broker.publish(ChannelEvents, data, raw)
+	}
+	data, raw := a.encode(a.accountData)
+	a.broker.publish(ChannelAccount, data, raw)
+	patch := a.delta.next(data)
+	if raw == nil {
+		if patch != nil {
+			a.broker.Publish(ChannelDelta, patch)
+		}
+		return
+	}
+	// Owner patch may change hidden fields only, then viewers get nothing
+	if rawPatch := a.rawDelta.next(raw); rawPatch != nil {
+		a.broker.publish(ChannelDelta, patch, rawPatch)
+	}
 }
@@ -4,7 +4,12 @@ package metatrader
 // easyjson -all <file>.go
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "engine/docs" // docs generated by swag-cli
 
@@ -19,6 +24,7 @@ var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		// Origins are checked by originAuth before the upgrade
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -27,32 +33,72 @@ var (
 
 // StateEntry used to
 type StateEntry struct {
-	Page       string `json:"page" example:"my-test-page"`
-	Started    string `json:"started" example:"2020-12-20 23:10:01"`
-	UpdateFreq string `json:"updateFreq" example:"minute"`
+	Page           string             `json:"page" example:"my-test-page"`
+	Started        string             `json:"started" example:"2020-12-20 23:10:01"`
+	Online         bool               `json:"online" example:"true"`
+	LastSeen       string             `json:"lastSeen" example:"2020-12-20 23:15:01"`
+	ConnectedSince string             `json:"connectedSince" example:"2020-12-20 23:10:01"` // empty if offline
+	UpdateFreq     string             `json:"updateFreq" example:"minute"`
+	Throttle       ThrottleStats      `json:"throttle"`
+	Viewers        ViewerStats        `json:"viewers"`
+	Performance    PerformanceSummary `json:"performance"`
 }
 
 // StateData used to export state information through /api/state
 type StateData struct {
-	Online   int          `json:"online" example:"1"`
-	Accounts []StateEntry `json:"accounts"`
+	Online              int          `json:"online" example:"1"`
+	ThrottleDisconnects int          `json:"throttleDisconnects" example:"0"`
+	RejectedMessages    int          `json:"rejectedMessages" example:"0"`
+	RejectedOrigins     int          `json:"rejectedOrigins" example:"0"`
+	Accounts            []StateEntry `json:"accounts"`
+}
+
+// PageSecret is used to transfer a page to a new owner
+type PageSecret struct {
+	Secret string `json:"secret" example:"my-secret-key"`
 }
 
 // Run API server
 func (f *Factory) startAPIServer(addr string) {
-	// HTTP server to serve JSON data
+	e := f.newAPIServer()
+	f.log.Fatal(e.Start(addr).Error())
+}
+
+// newAPIServer makes HTTP server to serve JSON data
+func (f *Factory) newAPIServer() *echo.Echo {
 	e := echo.New()
-	e.GET("/api/stats", f.StatsAPIHandler)
-	e.HEAD("/api/stats", f.StatsAPIHandler)
-	e.GET("/api/rest/:page", f.RestAPIHandler)
-	e.GET("/api/wss/:page", f.WssAPIHandler)
+	// Viewer routes are used from browsers, so origin is checked first and CORS preflight is answered
+	view := []string{http.MethodGet, http.MethodOptions}
+	e.Match(append(view, http.MethodHead), "/api/stats", f.StatsAPIHandler, f.originAuth)
+	e.Match(view, "/api/rest/:page", f.RestAPIHandler, f.originAuth, f.viewerAuth)
+	e.Match(view, "/api/rest/:page/history", f.HistoryAPIHandler, f.originAuth, f.viewerAuth)
+	e.Match(view, "/api/rest/:page/events", f.EventsAPIHandler, f.originAuth, f.viewerAuth)
+	e.Match(view, "/api/rest/:page/series", f.SeriesAPIHandler, f.originAuth, f.viewerAuth)
+	e.Match(view, "/api/rest/:page/stats", f.PerformanceAPIHandler, f.originAuth, f.viewerAuth)
+	e.GET("/api/wss", f.MultiWssAPIHandler, f.originAuth)
+	e.GET("/api/wss/:page", f.WssAPIHandler, f.originAuth, f.viewerAuth)
+	e.Match(view, "/api/sse/:page", f.SseAPIHandler, f.originAuth, f.viewerAuth)
+	e.POST("/api/push/:page", f.PushAPIHandler)
 	e.GET("/swagger/*", echoSwagger.WrapHandler) // including images etc
+
+	owner := e.Group("/api/pages/:page", f.ownerAuth)
+	owner.PUT("/visibility", f.VisibilityHandler)
+	owner.POST("/tokens", f.TokenHandler)
+	owner.PUT("/redaction", f.RedactionHandler)
+
+	admin := e.Group("/api/admin", f.adminAuth)
+	admin.GET("/pages", f.AdminPagesHandler)
+	admin.PUT("/pages/:page", f.AdminTransferHandler)
+	admin.DELETE("/pages/:page", f.AdminResetHandler)
+	admin.GET("/rejected", f.AdminRejectedHandler)
+	admin.GET("/origins", f.AdminOriginsHandler)
 	// e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	f.log.Fatal(e.Start(addr).Error())
+	return e
 }
 
 // StatsAPIHandler is a handler for server state api
+// Unlisted and private pages are not listed
 // @Summary Provide actual list of connected accounts
 // @Produce json
 // @Success 200 {object} StateData
@@ -67,7 +113,9 @@ func (f *Factory) StatsAPIHandler(c echo.Context) error {
 // @Summary Provide actual data on connected account
 // @Produce json
 // @Param page path string true "Account Page name"
-// @Success 200 {object} Account
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Success 200 {object} AccountData
+// @failure 403 {string} Access token is required or not valid
 // @failure 404 {string} Page not found
 // @failure 500 {string} Server internal error
 // @Router /rest/{page} [get]
@@ -75,27 +123,161 @@ func (f *Factory) RestAPIHandler(c echo.Context) error {
 	page := c.Param("page")
 
 	// Check if page exists
-	acc := f.PageExist(page)
+	acc := f.Account(page)
+	if acc == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	// Owner gets the account without redaction
+	return c.JSON(http.StatusOK, acc.accountData(acc.viewRedactor(viewerClaims(c).Owner)))
+}
+
+// HistoryAPIHandler is serving closed orders of the account
+// @Summary Provide closed orders of connected account, the oldest first
+// @Produce json
+// @Param page path string true "Account Page name"
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Success 200 {array} ClosedOrder
+// @failure 403 {string} Access token is required or not valid
+// @failure 404 {string} Page not found
+// @failure 500 {string} Server internal error
+// @Router /rest/{page}/history [get]
+func (f *Factory) HistoryAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	// Check if page exists
+	acc := f.Account(page)
+	if acc == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	return c.JSON(http.StatusOK, acc.viewRedactor(viewerClaims(c).Owner).closedOrders(acc.History()))
+}
+
+// EventsAPIHandler is serving order events polling
+// @Summary Provide order events of connected account: opened, modified, partial, closed
+// @Produce json
+// @Param page path string true "Account Page name"
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Param since query integer false "The last received event sequence number" default(0)
+// @Success 200 {object} EventsData
+// @failure 400 {string} Invalid sequence number
+// @failure 403 {string} Access token is required or not valid
+// @failure 404 {string} Page not found
+// @failure 500 {string} Server internal error
+// @Router /rest/{page}/events [get]
+func (f *Factory) EventsAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	var since uint64
+	if s := c.QueryParam("since"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Sequence number "+s+" is not valid")
+		}
+		since = v
+	}
+
+	// Check if page exists
+	acc := f.Account(page)
 	if acc == nil {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	return c.JSON(http.StatusOK, acc)
+	data := acc.EventsSince(since)
+	data.Events = acc.viewRedactor(viewerClaims(c).Owner).events(data.Events)
+	return c.JSON(http.StatusOK, data)
+}
+
+// SeriesAPIHandler is serving balance and equity history
+// @Summary Provide balance, equity, margin level and profit history of connected account
+// @Produce json
+// @Param page path string true "Account Page name"
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Param from query string false "Start time, RFC 3339 or Unix seconds"
+// @Param to query string false "End time, RFC 3339 or Unix seconds, now if empty"
+// @Param resolution query string false "Period of points: second, minute, hour" default(minute)
+// @Success 200 {array} SeriesPoint
+// @failure 400 {string} Invalid time or resolution
+// @failure 403 {string} Access token is required or not valid
+// @failure 404 {string} Page not found
+// @failure 500 {string} Server internal error
+// @Router /rest/{page}/series [get]
+func (f *Factory) SeriesAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	from, err := parseSeriesTime(c.QueryParam("from"), time.Time{})
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	to, err := parseSeriesTime(c.QueryParam("to"), time.Now())
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	resolution := c.QueryParam("resolution")
+	if resolution == "" {
+		resolution = ResolutionMinute
+	}
+
+	// Check if page exists
+	acc := f.Account(page)
+	if acc == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	points, err := acc.Series(resolution, from, to)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, acc.viewRedactor(viewerClaims(c).Owner).series(points))
+}
+
+// PerformanceAPIHandler is serving trading statistics of the account
+// @Summary Provide trading statistics of connected account: drawdown, win rate, profit factor etc.
+// @Produce json
+// @Param page path string true "Account Page name"
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Success 200 {object} PerformanceStats
+// @failure 403 {string} Access token is required or not valid
+// @failure 404 {string} Page not found
+// @failure 500 {string} Server internal error
+// @Router /rest/{page}/stats [get]
+func (f *Factory) PerformanceAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	// Check if page exists
+	acc := f.Account(page)
+	if acc == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	return c.JSON(http.StatusOK, acc.viewRedactor(viewerClaims(c).Owner).performance(acc.Performance()))
 }
 
 // WssAPIHandler is serving WebSocket connections
+// Channels other than account are sent wrapped in Event
+// Delta viewers may send resync command to get the snapshot again
 // @Summary Provide actual data on connected account via WebSocket connection
 // @Produce json
 // @Param page path string true "Account Page name"
-// @Success 200 {object} Account
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Param channels query string false "Comma separated channels: account, history, events, delta, status" default(account)
+// @Success 200 {object} AccountData
+// @failure 400 {string} Unknown channel
+// @failure 403 {string} Access token is required or not valid
 // @failure 404 {string} Page not found
 // @failure 500 {string} Server internal error
 // @Router /wss/{page} [get]
 func (f *Factory) WssAPIHandler(c echo.Context) error {
 	page := c.Param("page")
 
+	channels, err := parseChannels(c.QueryParam("channels"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
 	// Check if page exists
-	acc := f.PageExist(page)
+	acc := f.Account(page)
 	if acc == nil {
 		return c.NoContent(http.StatusNotFound)
 	}
@@ -105,8 +287,164 @@ func (f *Factory) WssAPIHandler(c echo.Context) error {
 		return err
 	}
 
-	// Add new connection to page viewers pool, and send him update
-	acc.AddViewer(ws)
-	acc.SendUpdateToViewer(ws)
+	// Add new connection to page viewers pool, and send him current state of the channels
+	claims := viewerClaims(c)
+	viewer := NewWebSocketViewer(ws)
+	if err := acc.addViewer(viewer, claims, channels...); err != nil {
+		ws.Close()
+		return nil
+	}
+	acc.sendChannels(viewer, channels)
+	go f.serveViewer(acc, viewer, claims.Expires)
 	return nil
 }
+
+// MultiWssAPIHandler is serving WebSocket connections subscribed to several pages
+// Viewer sends PageCommand to subscribe, unsubscribe or list pages and gets PageCommandResult
+// Page messages are sent wrapped in PageMessage
+// @Summary Provide actual data on several accounts via one WebSocket connection
+// @Produce json
+// @Success 200 {object} PageMessage
+// @failure 500 {string} Server internal error
+// @Router /wss [get]
+func (f *Factory) MultiWssAPIHandler(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	go f.serveMultiViewer(ws, browserOrigin(c.Request()))
+	return nil
+}
+
+// parseChannels splits comma separated channel list, account channel is used if empty
+func parseChannels(s string) ([]string, error) {
+	if s == "" {
+		return []string{ChannelAccount}, nil
+	}
+	var ret []string
+	for _, ch := range strings.Split(s, ",") {
+		ch = strings.TrimSpace(ch)
+		if !containsString(Channels, ch) {
+			return nil, errors.New("Channel " + ch + " is unknown")
+		}
+		if !containsString(ret, ch) {
+			ret = append(ret, ch)
+		}
+	}
+	return ret, nil
+}
+
+// adminAuth middleware checks X-Admin-Token header
+func (f *Factory) adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := f.cfg.Registry.AdminToken
+		header := c.Request().Header.Get("X-Admin-Token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(header)) != 1 {
+			return c.NoContent(http.StatusForbidden)
+		}
+		return next(c)
+	}
+}
+
+// AdminPagesHandler lists claimed pages
+// @Summary List claimed pages
+// @Produce json
+// @Param X-Admin-Token header string true "Administrator token"
+// @Success 200 {array} string
+// @failure 403 {string} Access denied
+// @Router /admin/pages [get]
+func (f *Factory) AdminPagesHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, f.pages.Pages())
+}
+
+// AdminTransferHandler sets new page secret, the page is created if not registered
+// Connected client keeps the page until reconnection
+// @Summary Transfer the page to a new owner
+// @Accept json
+// @Param X-Admin-Token header string true "Administrator token"
+// @Param page path string true "Account Page name"
+// @Param secret body PageSecret true "New page secret"
+// @Success 204
+// @failure 400 {string} Invalid page or secret
+// @failure 403 {string} Access denied
+// @failure 500 {string} Server internal error
+// @Router /admin/pages/{page} [put]
+func (f *Factory) AdminTransferHandler(c echo.Context) error {
+	page := c.Param("page")
+	if err := validPage(page); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	var req PageSecret
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if req.Secret == "" {
+		return c.String(http.StatusBadRequest, "Secret is not provided")
+	}
+	if err := validSecret(req.Secret); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := f.pages.Transfer(page, req.Secret); err != nil {
+		return err
+	}
+	f.log.Info("Page transferred by administrator: ", page)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminResetHandler releases the page, so it may be claimed again
+// @Summary Reset page ownership
+// @Param X-Admin-Token header string true "Administrator token"
+// @Param page path string true "Account Page name"
+// @Success 204
+// @failure 403 {string} Access denied
+// @failure 404 {string} Page is not registered
+// @Router /admin/pages/{page} [delete]
+func (f *Factory) AdminResetHandler(c echo.Context) error {
+	page := c.Param("page")
+	if err := f.pages.Reset(page); err != nil {
+		if _, ok := err.(*PageError); ok {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return err
+	}
+	// Released page hides nothing
+	acc := f.Account(page)
+	if acc != nil {
+		acc.setRedaction(RedactionProfile{})
+	}
+	f.log.Info("Page reset by administrator: ", page)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminRejectedHandler lists oversized messages per remote IP
+// @Summary Oversized messages rejected per remote IP
+// @Produce json
+// @Param X-Admin-Token header string true "Administrator token"
+// @Success 200 {object} map[string]int
+// @failure 403 {string} Access denied
+// @Router /admin/rejected [get]
+func (f *Factory) AdminRejectedHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, f.rejectedStats())
+}
+
+// AdminOriginsHandler lists viewer requests rejected per origin
+// @Summary Viewer requests rejected per browser origin
+// @Produce json
+// @Param X-Admin-Token header string true "Administrator token"
+// @Success 200 {object} map[string]int
+// @failure 403 {string} Access denied
+// @Router /admin/origins [get]
+func (f *Factory) AdminOriginsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, f.rejectedOriginStats())
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package metatrader
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// flateConn is MetaTrader connection switching to DEFLATE compressed stream once compression is negotiated
+// Both directions are compressed after the server response to the first message, each written message is flushed
+// Gob stream continues as is, only its bytes are compressed
+type flateConn struct {
+	net.Conn
+	r io.Reader
+	w *flate.Writer
+}
+
+func newFlateConn(conn net.Conn) *flateConn {
+	return &flateConn{Conn: conn, r: conn}
+}
+
+func (c *flateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *flateConn) Write(p []byte) (int, error) {
+	if c.w == nil {
+		return c.Conn.Write(p)
+	}
+	n, err := c.w.Write(p)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return n, err
+}
+
+// compress the rest of the stream
+// The decoder should not have read ahead of the first message, gobFrameReader never does
+func (c *flateConn) compress() {
+	c.r = flate.NewReader(c.Conn)
+	c.w, _ = flate.NewWriter(c.Conn, flate.DefaultCompression) // fails on wrong level only
+}
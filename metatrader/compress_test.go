@@ -0,0 +1,82 @@
+package metatrader
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordingConn keeps the bytes written to the connection
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.Lock()
+	c.buf.Write(p)
+	c.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) written() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.buf.String()
+}
+
+func TestCompression(t *testing.T) {
+	println("TestCompression started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	server, client := net.Pipe()
+	defer client.Close()
+	stream := newFlateConn(server)
+	go mt.ProcessMessages(stream, gob.NewEncoder(stream), newGobDecoder(stream, mt.cfg.MaxMsgSize))
+
+	raw := &recordingConn{Conn: client}
+	cl := newFlateConn(raw)
+	enc := gob.NewEncoder(cl)
+	dec := newGobDecoder(cl, mt.cfg.MaxMsgSize)
+
+	// Response to the first message is not compressed
+	require.NoError(t, enc.Encode(&Message{Page: "test", UpdateFreq: "second", ClientVersion: "1.2", Features: []string{"compression"}}))
+	var resp ResponseMsg
+	require.NoError(t, dec.Decode(&resp))
+	require.Empty(t, resp.Error)
+	assert.Equal(t, []string{"compression"}, resp.Features)
+	cl.compress()
+
+	orders := make(map[OrderTicket]Order)
+	for i := 0; i < 20; i++ {
+		orders[OrderTicket(strings.Repeat("1", i+1))] = Order{Symbol: "EURUSD", Type: "0", Profit: "10"}
+	}
+	var plain bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&plain).Encode(&Message{Balance: "100", Orders: orders}))
+	sent := len(raw.written())
+	require.NoError(t, enc.Encode(&Message{Balance: "100", Orders: orders}))
+	resp = ResponseMsg{}
+	require.NoError(t, dec.Decode(&resp))
+	require.Empty(t, resp.Error)
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "100", acc.Snapshot().Balance)
+		assert.Equal(t, 20, acc.OrdersCount)
+	}
+	compressed := raw.written()[sent:]
+	assert.NotContains(t, compressed, "EURUSD")
+	assert.Less(t, len(compressed), plain.Len()/2)
+
+	// Errors go over the compressed stream too
+	require.NoError(t, enc.Encode(&Message{Balance: "ten"}))
+	resp = ResponseMsg{}
+	require.NoError(t, dec.Decode(&resp))
+	assert.Equal(t, ErrCodeInvalidMessage, resp.Code)
+}
@@ -0,0 +1,215 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Config keeps tunable Factory settings
+type Config struct {
+	// Awaiting the first message after a connection is accepted
+	HandshakeTimeout Duration `json:"handshakeTimeout"`
+	// Awaiting an update or heartbeat from the account with "second" update frequency
+	SecondTimeout Duration `json:"secondTimeout"`
+	// Awaiting an update or heartbeat from the account with "minute" update frequency
+	MinuteTimeout Duration `json:"minuteTimeout"`
+	// Updates allowed per declared update interval, bursts included
+	UpdateRate int `json:"updateRate"`
+	// What to do with updates exceeding UpdateRate
+	ThrottlePolicy ThrottlePolicy `json:"throttlePolicy"`
+	// Messages queued per viewer, slow viewers exceeding it are handled by ViewerPolicy
+	ViewerQueueSize int `json:"viewerQueueSize"`
+	// What to do with messages when the viewer queue is full
+	ViewerPolicy ViewerPolicy `json:"viewerPolicy"`
+	// Viewers are pinged this often
+	ViewerPingInterval Duration `json:"viewerPingInterval"`
+	// Viewer is disconnected if nothing is received for this long, pongs included
+	ViewerPongTimeout Duration `json:"viewerPongTimeout"`
+	// Viewer messages above this size close the connection
+	ViewerMaxMsgSize int `json:"viewerMaxMsgSize"`
+	// Pages one multi-page viewer connection may subscribe to
+	MaxSubscriptions int `json:"maxSubscriptions"`
+	// Server-Sent Events streams get heartbeat comments this often
+	SSEHeartbeat Duration `json:"sseHeartbeat"`
+	// Gob messages above this size are rejected before decoding
+	MaxMsgSize int `json:"maxMsgSize"`
+	// Closed orders kept per account
+	HistorySize int `json:"historySize"`
+	// Order events kept per account for polling
+	EventsSize int `json:"eventsSize"`
+	// Newline-delimited JSON listener, like ":8183", disabled if empty. Uses the same TLS settings as MetaTrader listener
+	JSONAddr string `json:"jsonAddr"`
+	// Disconnected account stays offline this long, so MetaTrader may resume it. Removed at once if zero
+	OfflineGrace Duration `json:"offlineGrace"`
+	// Accounts are kept on disk across restarts if directory is set
+	Store StoreConfig `json:"store"`
+	// MetaTrader listeners are plain TCP unless certificate is set
+	TLS TLSConfig `json:"tls"`
+	// Page ownership
+	Registry RegistryConfig `json:"registry"`
+	// Web sites allowed to use viewer API from browsers
+	Origins OriginConfig `json:"origins"`
+	// Clients below this version are rejected, any version is accepted if empty
+	MinClientVersion string `json:"minClientVersion"`
+	// Clients below this version are notified about upgrade
+	LatestClientVersion string `json:"latestClientVersion"`
+}
+
+// DefaultConfig returns settings used by NewFactory
+func DefaultConfig() Config {
+	return Config{
+		HandshakeTimeout:   Duration(time.Duration(MaxAwaitingUpdates) * time.Second),
+		SecondTimeout:      Duration(time.Duration(MaxAwaitingUpdates) * time.Second),
+		MinuteTimeout:      Duration(time.Duration(MaxAwaitingUpdates) * time.Minute),
+		UpdateRate:         MaxUpdateRate,
+		ThrottlePolicy:     ThrottleCoalesce,
+		ViewerQueueSize:    MaxViewerQueue,
+		ViewerPolicy:       ViewerConflate,
+		ViewerPingInterval: Duration(ViewerPingInterval),
+		ViewerPongTimeout:  Duration(ViewerPongTimeout),
+		ViewerMaxMsgSize:   ViewerMaxMsgSize,
+		MaxSubscriptions:   MaxSubscriptions,
+		SSEHeartbeat:       Duration(SSEHeartbeat),
+		MaxMsgSize:         MaxMsgSize,
+		HistorySize:        MaxHistoryOrders,
+		EventsSize:         MaxOrderEvents,
+		OfflineGrace:       Duration(5 * time.Minute),
+		Store: StoreConfig{
+			SnapshotInterval: Duration(time.Minute),
+		},
+		Registry: RegistryConfig{
+			OpenRegistration: true,
+			MaxTokenTTL:      Duration(MaxTokenTTL),
+		},
+		LatestClientVersion: ProtocolVersion,
+	}
+}
+
+// LoadConfig reads JSON configuration file
+// Settings missing in the file keep their default values
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// validate settings that can not be checked by JSON decoder
+func (c *Config) validate() error {
+	if c.HandshakeTimeout <= 0 || c.SecondTimeout <= 0 || c.MinuteTimeout <= 0 {
+		return errors.New("Handshake and update timeouts should be positive")
+	}
+	if c.UpdateRate <= 0 {
+		return errors.New("Update rate should be positive")
+	}
+	switch c.ThrottlePolicy {
+	case ThrottleDrop, ThrottleCoalesce, ThrottleDisconnect:
+	default:
+		return errors.New("Unknown throttle policy " + string(c.ThrottlePolicy))
+	}
+	if c.ViewerQueueSize <= 0 {
+		return errors.New("Viewer queue size should be positive")
+	}
+	switch c.ViewerPolicy {
+	case ViewerDropOldest, ViewerConflate, ViewerDisconnect:
+	default:
+		return errors.New("Unknown viewer policy " + string(c.ViewerPolicy))
+	}
+	if c.ViewerPingInterval <= 0 || c.ViewerPongTimeout <= c.ViewerPingInterval {
+		return errors.New("Viewer pong timeout should exceed positive ping interval")
+	}
+	if c.ViewerMaxMsgSize <= 0 {
+		return errors.New("Viewer message size should be positive")
+	}
+	if c.MaxSubscriptions <= 0 {
+		return errors.New("Max subscriptions should be positive")
+	}
+	if c.SSEHeartbeat <= 0 {
+		return errors.New("SSE heartbeat interval should be positive")
+	}
+	if c.MaxMsgSize <= 0 {
+		return errors.New("Maximum message size should be positive")
+	}
+	if c.HistorySize <= 0 {
+		return errors.New("History size should be positive")
+	}
+	if c.EventsSize <= 0 {
+		return errors.New("Events size should be positive")
+	}
+	if c.OfflineGrace < 0 {
+		return errors.New("Offline grace period should not be negative")
+	}
+	if c.Registry.MaxTokenTTL <= 0 {
+		return errors.New("Max token lifetime should be positive")
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.Origins.validate(); err != nil {
+		return err
+	}
+	if c.Store.Enabled() && c.Store.SnapshotInterval <= 0 {
+		return errors.New("Snapshot interval should be positive")
+	}
+	if c.MinClientVersion != "" {
+		if err := validVersion(c.MinClientVersion); err != nil {
+			return err
+		}
+	}
+	if c.LatestClientVersion != "" {
+		if err := validVersion(c.LatestClientVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTimeout returns maximum awaiting time for the next message
+// Unregistered connections (empty freq) are limited with HandshakeTimeout
+func (c *Config) readTimeout(freq string) time.Duration {
+	switch strings.ToLower(freq) {
+	case "second":
+		return time.Duration(c.SecondTimeout)
+	case "minute":
+		return time.Duration(c.MinuteTimeout)
+	}
+	return time.Duration(c.HandshakeTimeout)
+}
+
+// updateInterval returns the period of declared update frequency
+func updateInterval(freq string) time.Duration {
+	if strings.ToLower(freq) == "minute" {
+		return time.Minute
+	}
+	return time.Second
+}
+
+// Duration is written in configuration file as a string, like "1m30s"
+type Duration time.Duration
+
+// MarshalJSON ...
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON ...
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,26 @@
+package metatrader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	println("TestConfigValidate started")
+	cfg := DefaultConfig()
+	assert.NoError(t, cfg.validate())
+
+	for _, change := range []func(c *Config){
+		func(c *Config) { c.UpdateRate = 0 },
+		func(c *Config) { c.UpdateRate = -1 },
+		func(c *Config) { c.HandshakeTimeout = 0 },
+		func(c *Config) { c.SecondTimeout = 0 },
+		func(c *Config) { c.MinuteTimeout = Duration(-time.Minute) },
+	} {
+		cfg := DefaultConfig()
+		change(&cfg)
+		assert.Error(t, cfg.validate())
+	}
+}
@@ -0,0 +1,256 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MaxDecimalDigits is the number of significant digits Decimal keeps without overflow
+const MaxDecimalDigits = 18
+
+var pow10 = [MaxDecimalDigits + 1]int64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18}
+
+// Decimal is a fixed-point number keeping the precision it was received with,
+// so "1000.00" is displayed as "1000.00" and never as "1000" or "999.9999999"
+// Zero value is an absent number, it differs from parsed "0"
+type Decimal struct {
+	units int64 // value multiplied by 10^scale
+	scale uint8 // digits after decimal point
+	set   bool
+}
+
+// ParseDecimal parses numbers like "-1000.25", MetaTrader locales may use comma as a decimal point
+// Empty string is parsed as absent number
+func ParseDecimal(s string) (Decimal, error) {
+	if s == "" {
+		return Decimal{}, nil
+	}
+
+	digits := s
+	neg := strings.HasPrefix(digits, "-")
+	if neg {
+		digits = digits[1:]
+	}
+	intPart, frac := digits, ""
+	if i := strings.IndexAny(digits, ".,"); i >= 0 {
+		intPart, frac = digits[:i], digits[i+1:]
+		if frac == "" {
+			return Decimal{}, errors.New("Number " + s + " has no digits after decimal point")
+		}
+	}
+	if intPart == "" {
+		return Decimal{}, errors.New("Number " + s + " has no integer part")
+	}
+	if len(intPart)+len(frac) > MaxDecimalDigits {
+		return Decimal{}, errors.New("Number " + s + " exceeds " + strconv.Itoa(MaxDecimalDigits) + " digits")
+	}
+
+	var units int64
+	for _, b := range intPart + frac {
+		if b < '0' || b > '9' {
+			return Decimal{}, errors.New("Number " + s + " is malformed")
+		}
+		units = units*10 + int64(b-'0')
+	}
+	if neg {
+		units = -units
+	}
+	return Decimal{units: units, scale: uint8(len(frac)), set: true}, nil
+}
+
+// NewDecimal returns units / 10^scale, i.e. NewDecimal(12345, 2) is 123.45
+func NewDecimal(units int64, scale int) Decimal {
+	if scale < 0 {
+		scale = 0
+	}
+	if scale > MaxDecimalDigits {
+		scale = MaxDecimalDigits
+	}
+	return Decimal{units: units, scale: uint8(scale), set: true}
+}
+
+// IsSet reports whether the number was received
+func (d Decimal) IsSet() bool {
+	return d.set
+}
+
+// Scale returns the number of digits after decimal point
+func (d Decimal) Scale() int {
+	return int(d.scale)
+}
+
+// Sign returns -1, 0 or +1
+func (d Decimal) Sign() int {
+	switch {
+	case d.units < 0:
+		return -1
+	case d.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Float64 returns nearest float value, for analytics only
+func (d Decimal) Float64() float64 {
+	return float64(d.units) / float64(pow10[d.scale])
+}
+
+// rescale units to the larger scale, ok is false if they overflow int64
+func (d Decimal) rescale(scale uint8) (units int64, ok bool) {
+	m := pow10[scale-d.scale]
+	units = d.units * m
+	return units, units/m == d.units
+}
+
+// bigUnits returns units at the larger scale without overflow
+func (d Decimal) bigUnits(scale uint8) *big.Int {
+	return new(big.Int).Mul(big.NewInt(d.units), big.NewInt(pow10[scale-d.scale]))
+}
+
+// Add returns d + o with the larger precision of both
+func (d Decimal) Add(o Decimal) Decimal {
+	return d.combine(o, false)
+}
+
+// Sub returns d - o with the larger precision of both
+func (d Decimal) Sub(o Decimal) Decimal {
+	return d.combine(o, true)
+}
+
+// combine adds or subtracts o, math/big is used if the units overflow int64 at the common scale
+func (d Decimal) combine(o Decimal, sub bool) Decimal {
+	scale := maxScale(d, o)
+	set := d.set || o.set
+	a, okA := d.rescale(scale)
+	b, okB := o.rescale(scale)
+	if okA && okB {
+		if units, ok := addUnits(a, b, sub); ok {
+			return Decimal{units: units, scale: scale, set: set}
+		}
+	}
+
+	x, y := d.bigUnits(scale), o.bigUnits(scale)
+	if sub {
+		x.Sub(x, y)
+	} else {
+		x.Add(x, y)
+	}
+	return decimalFromBig(x, scale, set)
+}
+
+// addUnits returns a + b, or a - b, ok is false on overflow
+func addUnits(a, b int64, sub bool) (int64, bool) {
+	if sub {
+		if b == math.MinInt64 {
+			return 0, false
+		}
+		b = -b
+	}
+	s := a + b
+	if (a > 0 && b > 0 && s < 0) || (a < 0 && b < 0 && s >= 0) {
+		return 0, false
+	}
+	return s, true
+}
+
+// decimalFromBig drops the least significant digits, rounding half away from zero, until units fit int64
+// Numbers exceeding int64 without fraction are saturated, they are far beyond any account value
+func decimalFromBig(units *big.Int, scale uint8, set bool) Decimal {
+	ten := big.NewInt(10)
+	for !units.IsInt64() && scale > 0 {
+		var rem big.Int
+		units.QuoRem(units, ten, &rem)
+		if rem.CmpAbs(big.NewInt(5)) >= 0 {
+			units.Add(units, big.NewInt(int64(rem.Sign())))
+		}
+		scale--
+	}
+	if !units.IsInt64() {
+		if units.Sign() > 0 {
+			return Decimal{units: math.MaxInt64, set: set}
+		}
+		// Symmetric to the positive bound, so negation does not overflow
+		return Decimal{units: -math.MaxInt64, set: set}
+	}
+	return Decimal{units: units.Int64(), scale: scale, set: set}
+}
+
+// Cmp returns -1 if d < o, 0 if equal, +1 if d > o. Precision does not matter, "1.0" equals "1"
+func (d Decimal) Cmp(o Decimal) int {
+	scale := maxScale(d, o)
+	a, okA := d.rescale(scale)
+	b, okB := o.rescale(scale)
+	if !okA || !okB {
+		return d.bigUnits(scale).Cmp(o.bigUnits(scale))
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func maxScale(a, b Decimal) uint8 {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// String returns the number with original precision, empty string if absent
+func (d Decimal) String() string {
+	if !d.set {
+		return ""
+	}
+
+	// Absolute value of MinInt64 fits uint64 only
+	units := uint64(d.units)
+	sign := ""
+	if d.units < 0 {
+		sign = "-"
+		units = -units
+	}
+	s := strconv.FormatUint(units, 10)
+	if d.scale == 0 {
+		return sign + s
+	}
+	if pad := int(d.scale) + 1 - len(s); pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	return sign + s[:len(s)-int(d.scale)] + "." + s[len(s)-int(d.scale):]
+}
+
+// MarshalJSON writes a string, the same way MetaTrader sends numbers
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if !d.set {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts both strings and numbers
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	if strings.HasPrefix(s, "\"") {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
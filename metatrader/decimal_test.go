@@ -0,0 +1,108 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDecimal(t *testing.T) {
+	println("TestParseDecimal started")
+	tests := []struct {
+		in    string
+		out   string
+		scale int
+		fail  bool
+	}{
+		{"", "", 0, false},
+		{"0", "0", 0, false},
+		{"1000.00", "1000.00", 2, false},
+		{"-10.23", "-10.23", 2, false},
+		{"1.13234", "1.13234", 5, false},
+		{"-0.05", "-0.05", 2, false},
+		{"0,5", "0.5", 1, false},
+		{"123456789012345678", "123456789012345678", 0, false},
+		{"1234567890123456789", "", 0, true},
+		{"--,.", "", 0, true},
+		{"-", "", 0, true},
+		{"1.", "", 0, true},
+		{".5", "", 0, true},
+		{"1.2.3", "", 0, true},
+		{"1-2", "", 0, true},
+		{"1e3", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		d, err := ParseDecimal(tt.in)
+		if tt.fail {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		if assert.NoError(t, err, tt.in) {
+			assert.Equal(t, tt.out, d.String(), tt.in)
+			assert.Equal(t, tt.scale, d.Scale(), tt.in)
+			assert.Equal(t, tt.in != "", d.IsSet(), tt.in)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	println("TestDecimalArithmetic started")
+	a, _ := ParseDecimal("1000.5")
+	b, _ := ParseDecimal("-0.25")
+
+	assert.Equal(t, "1000.25", a.Add(b).String())
+	assert.Equal(t, "1000.75", a.Sub(b).String())
+	assert.Equal(t, 1, a.Cmp(b))
+	assert.Equal(t, -1, b.Cmp(a))
+	assert.Equal(t, 0, NewDecimal(10, 1).Cmp(NewDecimal(1, 0)))
+	assert.Equal(t, -1, b.Sign())
+	assert.Equal(t, 0, Decimal{}.Sign())
+	assert.InDelta(t, 1000.5, a.Float64(), 1e-9)
+	assert.Equal(t, "123.45", NewDecimal(12345, 2).String())
+
+	// Absent number acts as zero
+	assert.Equal(t, "1000.5", a.Add(Decimal{}).String())
+	assert.False(t, Decimal{}.Add(Decimal{}).IsSet())
+
+	// Large values of different precision overflow int64 at the common scale
+	large, _ := ParseDecimal("99999999999999")
+	small, _ := ParseDecimal("0.00001")
+	assert.Equal(t, 1, large.Cmp(small))
+	assert.Equal(t, -1, small.Cmp(large))
+	// The sum keeps as many decimals as int64 fits
+	assert.Equal(t, "99999999999999.0000", large.Add(small).String())
+	assert.Equal(t, "99999999999998.9999", large.Sub(NewDecimal(1, 4)).Sub(small).String())
+	assert.Equal(t, "-99999999999999.0000", small.Sub(large).String())
+	frac, _ := ParseDecimal("0.00000000000000001")
+	assert.Equal(t, "100000000000000.0000", large.Add(frac).Add(NewDecimal(1, 0)).String())
+	huge := NewDecimal(999999999999999999, 0)
+	assert.Equal(t, "1000000000000000000", huge.Add(NewDecimal(1, 0)).String())
+	assert.Equal(t, "9223372036854775807", huge.Add(huge).Add(huge).Add(huge).Add(huge).Add(huge).Add(huge).Add(huge).Add(huge).Add(huge).String())
+	tiny := NewDecimal(-999999999999999999, 0)
+	assert.Equal(t, "-9223372036854775807", tiny.Add(tiny).Add(tiny).Add(tiny).Add(tiny).Add(tiny).Add(tiny).Add(tiny).Add(tiny).Add(tiny).String())
+	assert.Equal(t, "-9223372036854775808", NewDecimal(math.MinInt64, 0).String())
+	assert.Equal(t, "-922337203685477.5808", NewDecimal(math.MinInt64, 4).String())
+}
+
+func TestDecimalJSON(t *testing.T) {
+	println("TestDecimalJSON started")
+	var v struct {
+		A Decimal `json:"a"`
+		B Decimal `json:"b"`
+		C Decimal `json:"c"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"a":"1.50","b":-2.125,"c":null}`), &v))
+	assert.Equal(t, "1.50", v.A.String())
+	assert.Equal(t, "-2.125", v.B.String())
+	assert.False(t, v.C.IsSet())
+
+	data, err := json.Marshal(v)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"a":"1.50","b":"-2.125","c":null}`, string(data))
+	}
+
+	assert.Error(t, json.Unmarshal([]byte(`{"a":"1,2,3"}`), &v))
+}
@@ -0,0 +1,147 @@
+package metatrader
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// Viewer commands sent over WebSocket
+const (
+	// CommandResync asks for the delta snapshot, when a version gap is detected
+	CommandResync = "resync"
+)
+
+// ViewerCommand is the message viewer sends over WebSocket
+type ViewerCommand struct {
+	Command string `json:"command" example:"resync"`
+}
+
+// DeltaUpdate is the delta channel message
+// Snapshot is the whole account, Patch is JSON Merge Patch (RFC 7386) to the previous version
+// Patches up to the snapshot version are ignored by viewer
+// Patch with version other than the last one plus one means a gap, viewer should send resync command
+type DeltaUpdate struct {
+	Version  uint64          `json:"version" example:"42"`
+	Snapshot json.RawMessage `json:"snapshot,omitempty" swaggertype:"object"`
+	Patch    json.RawMessage `json:"patch,omitempty" swaggertype:"object"`
+}
+
+// deltaState keeps the account as the last version sent to delta viewers
+type deltaState struct {
+	version uint64
+	doc     map[string]interface{}
+	data    []byte
+	sync.Mutex
+}
+
+// snapshot returns the last version, initialized with data if nothing is sent yet
+func (d *deltaState) snapshot(data []byte) []byte {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.doc == nil {
+		d.doc, _ = decodeDoc(data)
+		d.data = data
+	}
+	msg, _ := json.Marshal(Event{Channel: ChannelDelta, Data: DeltaUpdate{Version: d.version, Snapshot: d.data}})
+	return msg
+}
+
+// next makes the new version from data, nil is returned if nothing has changed
+func (d *deltaState) next(data []byte) []byte {
+	d.Lock()
+	defer d.Unlock()
+
+	doc, err := decodeDoc(data)
+	if err != nil {
+		return nil
+	}
+	patch := mergePatch(d.doc, doc)
+	if len(patch) == 0 {
+		return nil
+	}
+	d.version++
+	d.doc = doc
+	d.data = data
+
+	p, _ := json.Marshal(patch)
+	msg, _ := json.Marshal(Event{Channel: ChannelDelta, Data: DeltaUpdate{Version: d.version, Patch: p}})
+	return msg
+}
+
+// rebase starts the new version from data, the snapshot is returned as viewers have to start over
+func (d *deltaState) rebase(data []byte) []byte {
+	d.Lock()
+	defer d.Unlock()
+
+	d.version++
+	d.doc, _ = decodeDoc(data)
+	d.data = data
+	msg, _ := json.Marshal(Event{Channel: ChannelDelta, Data: DeltaUpdate{Version: d.version, Snapshot: d.data}})
+	return msg
+}
+
+func decodeDoc(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	err := dec.Decode(&doc)
+	return doc, err
+}
+
+// mergePatch returns JSON Merge Patch turning prev into cur, removed members are set to null
+func mergePatch(prev, cur map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range cur {
+		old, ok := prev[k]
+		if !ok {
+			patch[k] = v
+			continue
+		}
+		oldObj, oldIsObj := old.(map[string]interface{})
+		obj, isObj := v.(map[string]interface{})
+		if oldIsObj && isObj {
+			if p := mergePatch(oldObj, obj); len(p) > 0 {
+				patch[k] = p
+			}
+			continue
+		}
+		if !reflect.DeepEqual(old, v) {
+			patch[k] = v
+		}
+	}
+	return patch
+}
+
+// handleCommand runs the command the viewer sent, unknown commands are ignored
+func (a *Account) handleCommand(viewer Viewer, data []byte) {
+	var cmd ViewerCommand
+	if json.Unmarshal(data, &cmd) != nil {
+		return
+	}
+	switch cmd.Command {
+	case CommandResync:
+		a.SendDeltaSnapshotToViewer(viewer)
+	}
+}
+
+// SendDeltaSnapshotToViewer sends the last delta version as snapshot
+// It's queued under broadcast lock, so the viewer gets patches of the later versions only after it
+func (a *Account) SendDeltaSnapshotToViewer(viewer Viewer) {
+	a.broadcastMu.Lock()
+	defer a.broadcastMu.Unlock()
+
+	data, raw := a.encode(a.accountData)
+	var rawSnapshot []byte
+	if raw != nil {
+		rawSnapshot = a.rawDelta.snapshot(raw)
+	}
+	a.broker.sendToViewer(viewer, ChannelDelta, a.delta.snapshot(data), rawSnapshot)
+}
@@ -0,0 +1,51 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	println("TestMergePatch started")
+	prev, err := decodeDoc([]byte(`{"page":"test","balance":"10","orderscount":2,"orders":{"1":{"symbol":"EURUSD","profit":"1"},"2":{"symbol":"GBPUSD"}}}`))
+	require.NoError(t, err)
+	cur, err := decodeDoc([]byte(`{"page":"test","balance":"11","orders":{"1":{"symbol":"EURUSD","profit":"2"},"3":{"symbol":"USDJPY"}}}`))
+	require.NoError(t, err)
+
+	patch, err := json.Marshal(mergePatch(prev, cur))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"balance":"11","orderscount":null,"orders":{"1":{"profit":"2"},"2":null,"3":{"symbol":"USDJPY"}}}`, string(patch))
+
+	assert.Empty(t, mergePatch(cur, cur))
+}
+
+func TestDeltaState(t *testing.T) {
+	println("TestDeltaState started")
+	var d deltaState
+
+	var ev struct {
+		Channel string
+		Data    DeltaUpdate
+	}
+	require.NoError(t, json.Unmarshal(d.snapshot([]byte(`{"balance":"10"}`)), &ev))
+	assert.Equal(t, ChannelDelta, ev.Channel)
+	assert.Equal(t, uint64(0), ev.Data.Version)
+	assert.JSONEq(t, `{"balance":"10"}`, string(ev.Data.Snapshot))
+
+	ev.Data = DeltaUpdate{}
+	require.NoError(t, json.Unmarshal(d.next([]byte(`{"balance":"11"}`)), &ev))
+	assert.Equal(t, uint64(1), ev.Data.Version)
+	assert.JSONEq(t, `{"balance":"11"}`, string(ev.Data.Patch))
+	assert.Empty(t, ev.Data.Snapshot)
+
+	// Nothing has changed
+	assert.Nil(t, d.next([]byte(`{"balance":"11"}`)))
+
+	ev.Data = DeltaUpdate{}
+	require.NoError(t, json.Unmarshal(d.snapshot(nil), &ev))
+	assert.Equal(t, uint64(1), ev.Data.Version)
+	assert.JSONEq(t, `{"balance":"11"}`, string(ev.Data.Snapshot))
+}
@@ -0,0 +1,113 @@
+package metatrader
+
+import (
+	"sort"
+	"time"
+)
+
+// MaxOrderEvents is the default number of order events kept per account
+const MaxOrderEvents = 200
+
+// Order event types
+const (
+	EventOrderOpened   = "opened"   // new ticket appeared
+	EventOrderModified = "modified" // SL or TP changed
+	EventOrderPartial  = "partial"  // current volume dropped, the order is partially closed
+	EventOrderClosed   = "closed"   // ticket disappeared
+)
+
+// OrderEvent describes the order change detected by account update
+// Order keeps the order values after the change, Previous only the changed ones before it
+type OrderEvent struct {
+	Seq      uint64      `json:"seq" example:"42"`
+	Type     string      `json:"type" example:"modified"`
+	Ticket   OrderTicket `json:"ticket" example:"325145411"`
+	Order    Order       `json:"order"`
+	Previous *Order      `json:"previous,omitempty"`
+	Time     time.Time   `json:"time" example:"2021-01-06T09:12:54.031357064+03:00"`
+}
+
+// EventsData used to export order events through /api/rest/{page}/events
+type EventsData struct {
+	// The last event sequence number, pass it as since with the next request
+	Seq uint64 `json:"seq" example:"42"`
+	// Some events after since are lost, the account should be read again
+	Truncated bool         `json:"truncated" example:"false"`
+	Events    []OrderEvent `json:"events"`
+}
+
+// orderEvents detects changes of the updated order, should be called under account lock
+func (a *Account) orderEvents(tick OrderTicket, prev, ord OrderState, exists bool, now time.Time) {
+	if !exists {
+		a.emitEvent(EventOrderOpened, tick, ord, nil, now)
+		return
+	}
+	if decimalChanged(prev.SL, ord.SL) || decimalChanged(prev.TP, ord.TP) {
+		a.emitEvent(EventOrderModified, tick, ord, &Order{SL: prev.SL.String(), TP: prev.TP.String()}, now)
+	}
+	if prev.CurVolume.IsSet() && ord.CurVolume.Cmp(prev.CurVolume) < 0 {
+		a.emitEvent(EventOrderPartial, tick, ord, &Order{CurVolume: prev.CurVolume.String()}, now)
+	}
+}
+
+// emitEvent appends the event, the oldest events are dropped when the buffer is full
+func (a *Account) emitEvent(typ string, tick OrderTicket, ord OrderState, prev *Order, now time.Time) {
+	if a.eventsSize <= 0 {
+		return
+	}
+	a.eventSeq++
+	ev := OrderEvent{Seq: a.eventSeq, Type: typ, Ticket: tick, Order: ord.Order(), Previous: prev, Time: now}
+
+	if len(a.events) >= a.eventsSize {
+		copy(a.events, a.events[len(a.events)-a.eventsSize+1:])
+		a.events = a.events[:a.eventsSize-1]
+	}
+	a.events = append(a.events, ev)
+	if len(a.unsentEvents) >= a.eventsSize {
+		a.unsentEvents = a.unsentEvents[1:]
+	}
+	a.unsentEvents = append(a.unsentEvents, ev)
+}
+
+// EventsSince returns kept events with sequence number above since
+func (a *Account) EventsSince(since uint64) EventsData {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	data := EventsData{Seq: a.eventSeq, Events: []OrderEvent{}}
+	for _, ev := range a.events {
+		if ev.Seq > since {
+			data.Events = append(data.Events, ev)
+		}
+	}
+	// Either the events were dropped, or since belongs to previous connection of the account
+	if len(data.Events) > 0 && data.Events[0].Seq > since+1 || since > a.eventSeq {
+		data.Truncated = true
+	}
+	return data
+}
+
+// takeUnsentEvents returns events emitted since the last broadcast
+func (a *Account) takeUnsentEvents() []OrderEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ret := a.unsentEvents
+	a.unsentEvents = nil
+	return ret
+}
+
+func decimalChanged(a, b Decimal) bool {
+	return a.IsSet() != b.IsSet() || a.Cmp(b) != 0
+}
+
+// sortTickets sorts tickets numerically, the slice is sorted in place
+func sortTickets(ticks []OrderTicket) []OrderTicket {
+	sort.Slice(ticks, func(i, j int) bool {
+		if len(ticks[i]) != len(ticks[j]) {
+			return len(ticks[i]) < len(ticks[j])
+		}
+		return ticks[i] < ticks[j]
+	})
+	return ticks
+}
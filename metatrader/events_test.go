@@ -0,0 +1,133 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOrderEvents(t *testing.T) {
+	println("TestOrderEvents started")
+	acc := NewAccount(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Orders:     map[OrderTicket]Order{"100": {Symbol: "EURUSD", InitVolume: "1", CurVolume: "1", SL: "1.1"}},
+	}, zap.NewNop().Sugar())
+
+	// Orders of the first message are not events
+	assert.Empty(t, acc.EventsSince(0).Events)
+
+	acc.update(&Message{Orders: map[OrderTicket]Order{
+		"100": {SL: "1.10", CurVolume: "1"},
+		"200": {Symbol: "GBPUSD"},
+	}})
+	acc.update(&Message{Orders: map[OrderTicket]Order{
+		"100": {SL: "1.2", TP: "1.5", CurVolume: "0.4"},
+		"200": {},
+	}})
+	acc.update(&Message{Orders: map[OrderTicket]Order{
+		"100": {},
+	}})
+
+	data := acc.EventsSince(0)
+	assert.Equal(t, uint64(4), data.Seq)
+	assert.False(t, data.Truncated)
+	require.Len(t, data.Events, 4)
+
+	// Equal SL with other precision is not a modification
+	assert.Equal(t, EventOrderOpened, data.Events[0].Type)
+	assert.Equal(t, OrderTicket("200"), data.Events[0].Ticket)
+	assert.Equal(t, "GBPUSD", data.Events[0].Order.Symbol)
+
+	assert.Equal(t, EventOrderModified, data.Events[1].Type)
+	assert.Equal(t, "1.2", data.Events[1].Order.SL)
+	assert.Equal(t, &Order{SL: "1.10", TP: ""}, data.Events[1].Previous)
+
+	assert.Equal(t, EventOrderPartial, data.Events[2].Type)
+	assert.Equal(t, "0.4", data.Events[2].Order.CurVolume)
+	assert.Equal(t, "1", data.Events[2].Order.InitVolume)
+	assert.Equal(t, &Order{CurVolume: "1"}, data.Events[2].Previous)
+
+	assert.Equal(t, EventOrderClosed, data.Events[3].Type)
+	assert.Equal(t, OrderTicket("200"), data.Events[3].Ticket)
+	for i, ev := range data.Events {
+		assert.Equal(t, uint64(i+1), ev.Seq)
+	}
+
+	data = acc.EventsSince(3)
+	if assert.Len(t, data.Events, 1) {
+		assert.Equal(t, uint64(4), data.Events[0].Seq)
+	}
+	assert.Empty(t, acc.EventsSince(4).Events)
+	// Sequence of another account connection
+	assert.True(t, acc.EventsSince(10).Truncated)
+}
+
+func TestOrderEventsDropped(t *testing.T) {
+	println("TestOrderEventsDropped started")
+	acc := NewAccount(&Message{Page: "test", UpdateFreq: "second"}, zap.NewNop().Sugar())
+	acc.eventsSize = 2
+
+	acc.update(&Message{Orders: map[OrderTicket]Order{"1": {}, "2": {}, "3": {}}})
+
+	data := acc.EventsSince(0)
+	assert.Equal(t, uint64(3), data.Seq)
+	assert.True(t, data.Truncated)
+	if assert.Len(t, data.Events, 2) {
+		assert.Equal(t, OrderTicket("2"), data.Events[0].Ticket)
+		assert.Equal(t, OrderTicket("3"), data.Events[1].Ticket)
+	}
+	assert.False(t, acc.EventsSince(1).Truncated)
+}
+
+func TestEventsAPI(t *testing.T) {
+	println("TestEventsAPI started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	get := func(page, since string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/?since="+since, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetPath("/api/rest/:page/events")
+		c.SetParamNames("page")
+		c.SetParamValues(page)
+		require.NoError(t, mt.EventsAPIHandler(c))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := get("test", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+	code, body := get("test", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"seq":0,"truncated":false,"events":[]}`, body)
+
+	acc.update(&Message{Orders: map[OrderTicket]Order{"123": {Symbol: "EURUSD"}}})
+	code, body = get("test", "0")
+	assert.Equal(t, http.StatusOK, code)
+	var data struct {
+		Seq    uint64
+		Events []struct {
+			Seq    uint64
+			Type   string
+			Ticket json.Number
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &data))
+	assert.Equal(t, uint64(1), data.Seq)
+	if assert.Len(t, data.Events, 1) {
+		assert.Equal(t, EventOrderOpened, data.Events[0].Type)
+		assert.Equal(t, json.Number("123"), data.Events[0].Ticket)
+	}
+
+	code, _ = get("test", "-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -4,9 +4,12 @@ package metatrader
 // easyjson -all <file>.go
 
 import (
+	"crypto/tls"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,49 +19,145 @@ import (
 
 // MaxFreeOrders ...
 const (
-	MaxFreeOrders int = 30   // orders limit for free accounts
-	MaxMsgSize    int = 2343 // maximum theretical incoming message
-	// MaxAwaitingSeconds int = 3    // awaiting an Account update. Drop the connection if exceeded
-	// MaxUpdateRate      int = 5    // Max updates per second. Disconnect if exceeded
+	MaxFreeOrders      int = 30    // orders limit for free accounts
+	MaxMsgSize         int = 16384 // gob message with all fields at validation limits fits it
+	MaxAwaitingUpdates int = 3     // update intervals without updates or heartbeats. Drop the connection if exceeded
+	MaxUpdateRate      int = 5     // updates per update interval. Throttle if exceeded
+	MaxFeatures        int = 16    // features requested by the client
 )
 
+// MaxJSONMsgSize limits JSON message line, field names and quotes take much more than gob
+const MaxJSONMsgSize int = 32768
+
+// Awaiting time to deliver an eviction notice to the silent client
+const evictionWriteTimeout = time.Second
+
+// Pause before accepting connections again after a failure
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Encoder writes responses to MetaTrader client, gob and json encoders fit it
+type Encoder interface {
+	Encode(e interface{}) error
+}
+
+// Decoder reads messages from MetaTrader client
+type Decoder interface {
+	Decode(e interface{}) error
+}
+
 // Factory is to manage Metatrader service
 type Factory struct {
 	addr     string
+	cfg      Config
 	accounts map[string]*Account // page as a key
+	pages    *PageRegistry
 	log      *zap.SugaredLogger
+	// Accounts fed by HTTP push, page as a key
+	pushes map[string]*pushSession
+	pushMu sync.Mutex
+	// Accounts disconnected for exceeding update rate
+	throttleDisconnects int
+	// Oversized messages per remote IP
+	rejected map[string]int
+	// Viewer requests from not allowed origins, origin as a key
+	rejectedOrigins map[string]int
+	// Account changes are logged here if store is enabled
+	store *accountStore
+	// Certificates of MetaTrader listeners, nil if TLS is disabled
+	certs *certReloader
 	sync.RWMutex
 }
 
 // NewFactory create Metatrader factory
-func NewFactory(addr string, log *zap.SugaredLogger) *Factory {
-	return &Factory{
+func NewFactory(addr string, log *zap.SugaredLogger) (*Factory, error) {
+	return NewFactoryWithConfig(addr, DefaultConfig(), log)
+}
+
+// NewFactoryWithConfig create Metatrader factory with custom settings
+// Error is returned if page registry, stored accounts or TLS certificates can not be loaded
+func NewFactoryWithConfig(addr string, cfg Config, log *zap.SugaredLogger) (*Factory, error) {
+	pages, err := NewPageRegistry(cfg.Registry)
+	if err != nil {
+		return nil, errors.New("Failed to load page registry: " + err.Error())
+	}
+
+	f := &Factory{
 		log:      log,
 		addr:     addr,
+		cfg:      cfg,
 		accounts: make(map[string]*Account),
+		pages:    pages,
+		pushes:   make(map[string]*pushSession),
+		rejected: make(map[string]int),
+
+		rejectedOrigins: make(map[string]int),
+	}
+	if cfg.TLS.Enabled() {
+		if f.certs, err = newCertReloader(cfg.TLS, log); err != nil {
+			return nil, errors.New("Failed to load TLS certificates: " + err.Error())
+		}
+	}
+	if cfg.Store.Enabled() {
+		if err := f.openStore(); err != nil {
+			return nil, errors.New("Failed to restore accounts: " + err.Error())
+		}
 	}
+	return f, nil
 }
 
 // Run our MetaTrader listener service
 func (f *Factory) Run() {
 	go f.startAPIServer(":8182")
+	go f.snapshotLoop()
+
+	if f.cfg.JSONAddr != "" {
+		ln, err := f.listen(f.cfg.JSONAddr)
+		if err != nil {
+			f.log.Error("Can not create JSON tcp listener.", err)
+		} else {
+			go f.serve(ln, f.HandleJSON)
+		}
+	}
 
-	ln, err := net.Listen("tcp", f.addr)
+	ln, err := f.listen(f.addr)
 	if err != nil {
 		f.log.Error("Can not create tcp listener.", err)
 		return
 	}
 
+	f.serve(ln, f.Handle)
+}
+
+// listen on the address, TLS is used if certificate is configured
+func (f *Factory) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if f.certs == nil {
+		return ln, nil
+	}
+	return tls.NewListener(ln, f.certs.serverConfig()), nil
+}
+
+// serve MetaTrader connections until listener is closed
+func (f *Factory) serve(ln net.Listener, handle func(net.Conn)) {
 	for {
 		// Wait for connection
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				f.log.Info("MetaTrader listener is closed: ", err)
+				return
+			}
+			// Failures like running out of file descriptors pass, retry after a pause
 			f.log.Error("Error accepting connection, err #", err)
+			time.Sleep(acceptRetryDelay)
 			continue
 		}
 
 		// Proceed with connection
-		go f.Handle(conn)
+		go handle(conn)
 	}
 }
 
@@ -66,16 +165,28 @@ func (f *Factory) Run() {
 func (f *Factory) Handle(conn net.Conn) {
 	f.log.Info("Accepted connection from ", conn.RemoteAddr())
 
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
+	stream := newFlateConn(conn)
+	dec := newGobDecoder(stream, f.cfg.MaxMsgSize)
+	enc := gob.NewEncoder(stream)
 
-	f.ProcessMessages(enc, dec, conn.RemoteAddr().String())
+	f.ProcessMessages(stream, enc, dec)
+
+	conn.Close()
+}
+
+// HandleJSON serves MetaTrader connection speaking newline-delimited JSON
+func (f *Factory) HandleJSON(conn net.Conn) {
+	f.log.Info("Accepted JSON connection from ", conn.RemoteAddr())
+
+	f.ProcessMessages(conn, json.NewEncoder(conn), newJSONDecoder(conn))
 
 	conn.Close()
 }
 
 // ProcessMessages from metatrader connection
-func (f *Factory) ProcessMessages(enc *gob.Encoder, dec *gob.Decoder, logaddr string) {
+// Connection is dropped if neither update nor heartbeat is received in time
+func (f *Factory) ProcessMessages(conn net.Conn, enc Encoder, dec Decoder) {
+	logaddr := conn.RemoteAddr().String()
 	defer func() {
 		f.log.Info("Connection is closed (", logaddr, ")")
 	}()
@@ -83,24 +194,42 @@ func (f *Factory) ProcessMessages(enc *gob.Encoder, dec *gob.Decoder, logaddr st
 	// Messaging loop
 	var page string
 	var acc *Account
+	var freq string
+	var features featureSet
 	for {
+		// Awaiting time depends on the declared update frequency
+		timeout := f.cfg.readTimeout(freq)
+		conn.SetDeadline(time.Now().Add(timeout))
+
 		// Decode new message
 		msg := new(Message)
 		if err := dec.Decode(msg); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				conn.SetWriteDeadline(time.Now().Add(evictionWriteTimeout))
+				f.writeError(enc, logaddr, page, &PageError{Code: ErrCodeEvicted, Text: "Account evicted: no updates or heartbeats within " + timeout.String()})
+				return
+			}
+			if se, ok := err.(*MsgSizeError); ok {
+				f.countRejected(conn.RemoteAddr())
+				f.writeErrorMessage(enc, logaddr, page, "Message is rejected: "+se.Error())
+				return
+			}
 			f.writeErrorMessage(enc, logaddr, page, "Failed to decode a message: "+err.Error())
 			return
 		}
 
 		// Validate message
 		if err := msg.Validate(); err != nil {
-			f.writeErrorMessage(enc, logaddr, page, "Message is not valid: "+err.Error())
+			f.writeError(enc, logaddr, page, err)
 			return
 		}
 
 		// All Subsequent messages except first one
 		if page != "" {
-			acc.update(msg)
-			acc.SendUpdateToAllViewers()
+			if err := f.applyMessage(acc, features, msg); err != nil {
+				f.writeError(enc, logaddr, page, err)
+				return
+			}
 			f.writeOkMessage(enc, "")
 			continue
 		}
@@ -110,15 +239,120 @@ func (f *Factory) ProcessMessages(enc *gob.Encoder, dec *gob.Decoder, logaddr st
 			f.writeErrorMessage(enc, logaddr, page, err.Error())
 			return
 		}
+		if err := verifyPagePin(conn, msg.Page); err != nil {
+			f.writeErrorMessage(enc, logaddr, page, err.Error())
+			return
+		}
+		var resp ResponseMsg
+		var err error
+		stream, compressible := conn.(*flateConn)
+		if acc, features, resp, err = f.register(msg, compressible); err != nil {
+			f.writeError(enc, logaddr, page, err)
+			return
+		}
 		page = msg.Page
-		acc = f.createAccount(msg)
-		defer func() {
-			f.removeAccount(page)
+		freq = msg.UpdateFreq
+		defer func(acc *Account) {
+			f.disconnectAccount(acc)
 			f.log.Info("Account disconnected: " + page + "")
-		}()
+		}(acc)
+
+		f.writeResponse(enc, resp, "New account registered: "+page+"")
+		if features[FeatureCompression] {
+			stream.compress()
+		}
+	}
+}
+
+// applyMessage from registered account to its state and broadcast it to viewers
+// Returned error means the client should be disconnected
+func (f *Factory) applyMessage(acc *Account, features featureSet, msg *Message) error {
+	// Nothing has changed, just keep the connection alive
+	// and broadcast coalesced update if any
+	if msg.Heartbeat {
+		if !features[FeatureHeartbeat] {
+			return errors.New("Heartbeat feature is not enabled for the connection")
+		}
+		acc.touch(time.Now())
+		if acc.limiter.flush() {
+			acc.SendUpdateToAllViewers()
+		}
+		return nil
+	}
+
+	if features[FeatureDeltaOrders] {
+		if cnt := acc.ordersAfter(msg); cnt > MaxFreeOrders {
+			return errMaxOrders(cnt)
+		}
+	}
+
+	if !acc.limiter.allow() {
+		switch acc.limiter.policy {
+		case ThrottleDisconnect:
+			f.Lock()
+			f.throttleDisconnects++
+			f.Unlock()
+			return &PageError{
+				Code: ErrCodeRateExceeded,
+				Text: "Update rate exceeded: " + strconv.Itoa(f.cfg.UpdateRate) + " updates per " + acc.UpdateFreq + " allowed",
+			}
+		case ThrottleCoalesce:
+			f.updateAccount(acc, msg)
+		case ThrottleDrop:
+			// Delta is not sent again, so it's applied and only the broadcast is dropped
+			if features[FeatureDeltaOrders] {
+				f.updateAccount(acc, msg)
+			}
+		}
+		return nil
+	}
+
+	f.updateAccount(acc, msg)
+	acc.SendUpdateToAllViewers()
+	return nil
+}
+
+// updateAccount applies the message and logs it to the store
+func (f *Factory) updateAccount(acc *Account, msg *Message) {
+	f.store.begin()
+	defer f.store.end()
+
+	now := time.Now()
+	acc.updateAt(msg, now)
+	f.store.append(walRecord{Op: walUpdate, Page: acc.Page, Time: now, Msg: msg})
+}
+
+// register new account with the first message, which passed firstMessageCheck
+// Returns the response to be sent to the client, stream is set if the connection may be compressed
+func (f *Factory) register(msg *Message, stream bool) (*Account, featureSet, ResponseMsg, error) {
+	features, err := f.negotiate(msg, stream)
+	if err != nil {
+		return nil, nil, ResponseMsg{}, err
+	}
+	if err := f.pages.Authenticate(msg.Page, msg.Secret); err != nil {
+		return nil, nil, ResponseMsg{}, err
+	}
+	acc, resp, err := f.openAuthenticated(msg, features)
+	if err != nil {
+		return nil, nil, ResponseMsg{}, err
+	}
+	return acc, features, resp, nil
+}
+
+// openAuthenticated opens the account of the client whose secret is checked
+// Error is returned if another client took the page after firstMessageCheck
+func (f *Factory) openAuthenticated(msg *Message, features featureSet) (*Account, ResponseMsg, error) {
+	acc, err := f.openAccount(msg, features[FeatureDeltaOrders])
+	if err != nil {
+		return nil, ResponseMsg{}, err
+	}
 
-		f.writeOkMessage(enc, "New account registered: "+page+"")
+	// Enabled features are reported only if client asked for them
+	resp := ResponseMsg{Message: f.upgradeNotice(msg.ClientVersion)}
+	if len(msg.Features) > 0 {
+		resp.Features = features.list()
 	}
+	return acc, resp, nil
 }
 
 // First message should contain mandatory fields - Page, UpdateFreq
@@ -126,7 +360,10 @@ func (f *Factory) firstMessageCheck(msg *Message) error {
 	if msg.Page == "" {
 		return errors.New("Page address is not provided")
 	}
-	if f.PageExist(msg.Page) != nil {
+	if msg.Heartbeat {
+		return errors.New("Heartbeat is not allowed before account registration")
+	}
+	if f.pageOnline(msg.Page) {
 		return errors.New("Page address " + msg.Page + " is already in use")
 	}
 	freq := strings.ToLower(msg.UpdateFreq)
@@ -136,37 +373,136 @@ func (f *Factory) firstMessageCheck(msg *Message) error {
 	return nil
 }
 
+// openAccount resumes offline account of the page or creates new one, and logs it to the store
+func (f *Factory) openAccount(msg *Message, deltaOrders bool) (*Account, error) {
+	f.store.begin()
+	defer f.store.end()
+
+	now := time.Now()
+	acc := f.resumeAccount(msg, deltaOrders, now)
+	if acc == nil {
+		if acc = f.createAccount(msg); acc == nil {
+			return nil, errors.New("Page address " + msg.Page + " is already in use")
+		}
+		acc.deltaOrders = deltaOrders
+	} else {
+		f.log.Info("Offline account resumed: ", msg.Page)
+		acc.SendStatusToAllViewers()
+	}
+	f.store.append(walRecord{Op: walRegister, Page: msg.Page, Time: now, Msg: msg, DeltaOrders: deltaOrders})
+	return acc, nil
+}
+
+// resumeAccount returns offline account of the page brought online, nil if there is none
+// Anyone may use unclaimed page, so only the owner of claimed page resumes its account
+func (f *Factory) resumeAccount(msg *Message, deltaOrders bool, now time.Time) *Account {
+	f.Lock()
+	acc := f.PageExist(msg.Page)
+	if acc == nil || acc.Online() || !f.pages.Claimed(msg.Page) {
+		f.Unlock()
+		return nil
+	}
+	// Marked online under factory lock, so concurrent registration can not resume it too
+	acc.mu.Lock()
+	acc.online = true
+	acc.mu.Unlock()
+	acc.limiter.stop()
+	acc.limiter = newUpdateLimiter(f.cfg.UpdateRate, updateInterval(msg.UpdateFreq), f.cfg.ThrottlePolicy, acc.SendUpdateToAllViewers)
+	f.Unlock()
+
+	acc.stopGrace()
+	acc.resume(msg, deltaOrders, now)
+	return acc
+}
+
+// pageOnline reports whether the page is used by connected MetaTrader
+func (f *Factory) pageOnline(page string) bool {
+	acc := f.Account(page)
+	return acc != nil && acc.Online()
+}
+
+// createAccount adds new account of the page, nil is returned if the page is taken
+// Page is checked and taken under factory lock, so concurrent registration can not replace the account
+// Offline account of the page is replaced with its viewers disconnected, should be called between store begin and end
 func (f *Factory) createAccount(msg *Message) *Account {
 	acc := NewAccount(msg, f.log)
+	acc.limiter = newUpdateLimiter(f.cfg.UpdateRate, updateInterval(msg.UpdateFreq), f.cfg.ThrottlePolicy, acc.SendUpdateToAllViewers)
+	acc.broker.setViewerQueue(f.cfg.ViewerQueueSize, f.cfg.ViewerPolicy)
+	acc.historySize = f.cfg.HistorySize
+	acc.eventsSize = f.cfg.EventsSize
+	acc.redaction = f.pages.Redaction(msg.Page)
 	f.Lock()
+	if prev := f.PageExist(msg.Page); prev != nil {
+		if prev.Online() {
+			f.Unlock()
+			acc.close()
+			return nil
+		}
+		f.log.Info("Offline account replaced: ", msg.Page)
+		f.deleteAccount(prev)
+	}
 	f.accounts[msg.Page] = acc
 	f.Unlock()
 
 	return acc
 }
 
-func (f *Factory) removeAccount(page string) {
+// removeAccount deletes the account and disconnects its viewers
+// The page may be used by another account already, then nothing is removed
+func (f *Factory) removeAccount(acc *Account) {
+	f.store.begin()
+	defer f.store.end()
 	f.Lock()
 	defer f.Unlock()
 
-	if acc := f.PageExist(page); acc != nil {
-		delete(f.accounts, page)
-		acc.close()
+	if f.accounts[acc.Page] == acc {
+		f.deleteAccount(acc)
 	}
 }
 
+// deleteAccount should be called under factory lock between store begin and end
+func (f *Factory) deleteAccount(acc *Account) {
+	delete(f.accounts, acc.Page)
+	acc.close()
+	f.store.append(walRecord{Op: walRemove, Page: acc.Page, Time: time.Now()})
+}
+
 // ExportState return slice of account pointers for Stats page
 func (f *Factory) exportState() *StateData {
 	f.RLock()
 	defer f.RUnlock()
 
-	st := StateData{Online: len(f.accounts)}
+	st := StateData{
+		ThrottleDisconnects: f.throttleDisconnects,
+	}
+	for _, cnt := range f.rejected {
+		st.RejectedMessages += cnt
+	}
+	for _, cnt := range f.rejectedOrigins {
+		st.RejectedOrigins += cnt
+	}
 	for _, acc := range f.accounts {
+		if f.pages.Visibility(acc.Page) != VisibilityPublic {
+			continue
+		}
 		started := time.Time(acc.Started)
+		online := acc.Online()
+		if online {
+			st.Online++
+		}
+		status := acc.Status()
 		entry := StateEntry{
-			Page:       acc.Page,
-			Started:    started.Format("2006-01-02 15:04:05"),
-			UpdateFreq: acc.UpdateFreq,
+			Page:        acc.Page,
+			Online:      online,
+			LastSeen:    status.LastSeen.Format("2006-01-02 15:04:05"),
+			Started:     started.Format("2006-01-02 15:04:05"),
+			UpdateFreq:  acc.UpdateFreq,
+			Throttle:    acc.limiter.stats(),
+			Viewers:     acc.broker.Stats(),
+			Performance: acc.PerformanceSummary(),
+		}
+		if status.ConnectedSince != nil {
+			entry.ConnectedSince = status.ConnectedSince.Format("2006-01-02 15:04:05")
 		}
 		st.Accounts = append(st.Accounts, entry)
 	}
@@ -174,6 +510,7 @@ func (f *Factory) exportState() *StateData {
 }
 
 // PageExist return account with page specified OR nil
+// The caller holds the factory lock, use Account otherwise
 func (f *Factory) PageExist(page string) *Account {
 	if acc, ok := f.accounts[page]; ok {
 		return acc
@@ -181,26 +518,61 @@ func (f *Factory) PageExist(page string) *Account {
 	return nil
 }
 
+// Account of the page or nil, PageExist under the factory lock
+// Go code embedding the engine gets accounts with it, e.g. to add ChannelViewer
+func (f *Factory) Account(page string) *Account {
+	f.RLock()
+	defer f.RUnlock()
+	return f.PageExist(page)
+}
+
 // NumAccounts ...
 func (f *Factory) NumAccounts() int {
+	f.RLock()
+	defer f.RUnlock()
 	return len(f.accounts)
 }
 
 // Write a response to Metatrader client
 // If page is set, then output console message also
-func (f *Factory) writeErrorMessage(enc *gob.Encoder, addr, page, text string) {
-	f.log.Error(text, ". (", addr, ", ", page, ")")
-	err := enc.Encode(ResponseMsg{
-		Error: text,
-	})
+func (f *Factory) writeErrorMessage(enc Encoder, addr, page, text string) {
+	f.writeErrorResponse(enc, addr, page, ResponseMsg{Error: text})
+}
+
+// writeError sends error text along with the code and details if any
+func (f *Factory) writeError(enc Encoder, addr, page string, err error) {
+	f.writeErrorResponse(enc, addr, page, errorResponse(err))
+}
+
+// errorResponse converts PageError and ValidationError into coded response
+func errorResponse(err error) ResponseMsg {
+	resp := ResponseMsg{Error: err.Error()}
+	switch e := err.(type) {
+	case *PageError:
+		resp.Code = e.Code
+	case *ValidationError:
+		resp.Error = "Message is not valid: " + e.Error()
+		resp.Code = ErrCodeInvalidMessage
+		resp.Validation = e
+	}
+	return resp
+}
+
+func (f *Factory) writeErrorResponse(enc Encoder, addr, page string, resp ResponseMsg) {
+	f.log.Error(resp.Error, ". (", addr, ", ", page, ")")
+	err := enc.Encode(resp)
 	if err != nil {
 		f.log.Error("Failed to encode response message: ", err)
 	}
 }
 
-func (f *Factory) writeOkMessage(enc *gob.Encoder, str string) error {
+func (f *Factory) writeOkMessage(enc Encoder, str string) error {
+	return f.writeResponse(enc, ResponseMsg{}, str)
+}
+
+func (f *Factory) writeResponse(enc Encoder, resp ResponseMsg, str string) error {
 	if str != "" {
 		f.log.Info(str)
 	}
-	return enc.Encode(ResponseMsg{})
+	return enc.Encode(resp)
 }
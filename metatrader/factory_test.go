@@ -2,6 +2,7 @@ package metatrader
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,18 +48,32 @@ func (e *engineTestSuite) SetupTest() {
 	e.zapRecorder = recorder
 	e.zapObserver = zap.New(core)
 
-	e.mt = NewFactory("", e.zapObserver.Sugar())
+	e.start(DefaultConfig())
+
+	// API requests
+	e.testEcho = echo.New()
+}
+
+// start new Factory and connect to it
+func (e *engineTestSuite) start(cfg Config) {
+	var err error
+	e.mt, err = NewFactoryWithConfig("", cfg, e.zapObserver.Sugar())
+	e.Require().NoError(err)
 
 	e.server, e.client = net.Pipe() // Emulate server connection
 	enc := gob.NewEncoder(e.server)
-	dec := gob.NewDecoder(e.server)
-	go e.mt.ProcessMessages(enc, dec, "testconn")
+	dec := newGobDecoder(e.server, cfg.MaxMsgSize)
+	go e.mt.ProcessMessages(e.server, enc, dec)
 
 	e.enc = gob.NewEncoder(e.client)
 	e.dec = gob.NewDecoder(e.client)
+}
 
-	// API requests
-	e.testEcho = echo.New()
+// restart the Factory with custom settings
+func (e *engineTestSuite) restart(cfg Config) {
+	e.client.Close()
+	e.server.Close()
+	e.start(cfg)
 }
 
 func (e *engineTestSuite) TearDownTest() {
@@ -120,7 +136,8 @@ func (e *engineTestSuite) TestRegister() {
 	if !e.NoError(err) {
 		return
 	}
-	e.Empty(resp)
+	e.Empty(resp.Error)
+	e.Equal("New API version "+ProtocolVersion+" is available", resp.Message)
 
 	acc := e.mt.PageExist("test")
 	if e.NotNil(acc) {
@@ -131,26 +148,26 @@ func (e *engineTestSuite) TestRegister() {
 		e.Equal("Login", acc.Login)
 		e.Equal("Server", acc.Server)
 		e.Equal("Company", acc.Company)
-		e.Equal("0.1", acc.Balance)
-		e.Equal("0.1", acc.Equity)
-		e.Equal("0.1", acc.Margin)
-		e.Equal("0.1", acc.FreeMargin)
-		e.Equal("1000", acc.MarginLevel)
-		e.Equal("1000", acc.ProfitTotal)
+		e.Equal("0.1", acc.Balance.String())
+		e.Equal("0.1", acc.Equity.String())
+		e.Equal("0.1", acc.Margin.String())
+		e.Equal("0.1", acc.FreeMargin.String())
+		e.Equal("1000", acc.MarginLevel.String())
+		e.Equal("1000", acc.ProfitTotal.String())
 	}
 	if e.Contains(acc.Orders, OrderTicket("11111")) {
 		ord := acc.Orders["11111"]
 		e.Equal("EURGBP", ord.Symbol)
 		e.Equal("2020.12.25 10:08:23", ord.TimeOpen)
-		e.Equal("1", ord.Type)
-		e.Equal("0.1", ord.InitVolume)
-		e.Equal("0.1", ord.CurVolume)
-		e.Equal("0.1", ord.PriceOpen)
-		e.Equal("0.1", ord.SL)
-		e.Equal("0.1", ord.TP)
-		e.Equal("0", ord.Swap)
-		e.Equal("0", ord.PriceSL)
-		e.Equal("1", ord.Profit)
+		e.Equal("1", ord.Type.Code())
+		e.Equal("0.1", ord.InitVolume.String())
+		e.Equal("0.1", ord.CurVolume.String())
+		e.Equal("0.1", ord.PriceOpen.String())
+		e.Equal("0.1", ord.SL.String())
+		e.Equal("0.1", ord.TP.String())
+		e.Equal("0", ord.Swap.String())
+		e.Equal("0", ord.PriceSL.String())
+		e.Equal("1", ord.Profit.String())
 	}
 }
 
@@ -195,7 +212,8 @@ func (e *engineTestSuite) TestAccountUpdate() {
 	if !e.NoError(err) {
 		return
 	}
-	e.Empty(resp)
+	e.Empty(resp.Error)
+	e.Equal("New API version "+ProtocolVersion+" is available", resp.Message)
 
 	acc := e.mt.PageExist("test")
 	if e.NotNil(acc) {
@@ -248,12 +266,12 @@ func (e *engineTestSuite) TestAccountUpdate() {
 		e.Equal("Login", acc.Login)
 		e.Equal("Server", acc.Server)
 		e.Equal("Company", acc.Company)
-		e.Equal("0.1", acc.Balance)
-		e.Equal("0.1", acc.Equity)
-		e.Equal("0.1", acc.Margin)
-		e.Equal("0.1", acc.FreeMargin)
-		e.Equal("1000", acc.MarginLevel)
-		e.Equal("1000", acc.ProfitTotal)
+		e.Equal("0.1", acc.Balance.String())
+		e.Equal("0.1", acc.Equity.String())
+		e.Equal("0.1", acc.Margin.String())
+		e.Equal("0.1", acc.FreeMargin.String())
+		e.Equal("1000", acc.MarginLevel.String())
+		e.Equal("1000", acc.ProfitTotal.String())
 	}
 	e.Equal(0, len(acc.Orders))
 }
@@ -309,29 +327,29 @@ func (e *engineTestSuite) TestOrdersUpdate() {
 			ord := acc.Orders["11111"]
 			e.Equal("EURGBP", ord.Symbol)
 			e.Equal("1111.11.11 11:11:11", ord.TimeOpen)
-			e.Equal("1", ord.Type)
-			e.Equal("0.1", ord.InitVolume)
-			e.Equal("0.1", ord.CurVolume)
-			e.Equal("0.1", ord.PriceOpen)
-			e.Equal("0.1", ord.SL)
-			e.Equal("0.1", ord.TP)
-			e.Equal("1", ord.Swap)
-			e.Equal("1", ord.PriceSL)
-			e.Equal("1", ord.Profit)
+			e.Equal("1", ord.Type.Code())
+			e.Equal("0.1", ord.InitVolume.String())
+			e.Equal("0.1", ord.CurVolume.String())
+			e.Equal("0.1", ord.PriceOpen.String())
+			e.Equal("0.1", ord.SL.String())
+			e.Equal("0.1", ord.TP.String())
+			e.Equal("1", ord.Swap.String())
+			e.Equal("1", ord.PriceSL.String())
+			e.Equal("1", ord.Profit.String())
 		}
 		if e.Contains(acc.Orders, OrderTicket("22222")) {
 			ord := acc.Orders["22222"]
 			e.Equal("GBPUSD", ord.Symbol)
 			e.Equal("2222.22.22 22:22:22", ord.TimeOpen)
-			e.Equal("2", ord.Type)
-			e.Equal("0.2", ord.InitVolume)
-			e.Equal("0.2", ord.CurVolume)
-			e.Equal("0.2", ord.PriceOpen)
-			e.Equal("0.2", ord.SL)
-			e.Equal("0.2", ord.TP)
-			e.Equal("2", ord.Swap)
-			e.Equal("2", ord.PriceSL)
-			e.Equal("2", ord.Profit)
+			e.Equal("2", ord.Type.Code())
+			e.Equal("0.2", ord.InitVolume.String())
+			e.Equal("0.2", ord.CurVolume.String())
+			e.Equal("0.2", ord.PriceOpen.String())
+			e.Equal("0.2", ord.SL.String())
+			e.Equal("0.2", ord.TP.String())
+			e.Equal("2", ord.Swap.String())
+			e.Equal("2", ord.PriceSL.String())
+			e.Equal("2", ord.Profit.String())
 		}
 	}
 
@@ -369,15 +387,15 @@ func (e *engineTestSuite) TestOrdersUpdate() {
 			ord := acc.Orders["22222"]
 			e.Equal("GBPJPY", ord.Symbol)
 			e.Equal("3333.33.33 33:33:33", ord.TimeOpen)
-			e.Equal("3", ord.Type)
-			e.Equal("0.3", ord.InitVolume)
-			e.Equal("0.3", ord.CurVolume)
-			e.Equal("0.3", ord.PriceOpen)
-			e.Equal("0.3", ord.SL)
-			e.Equal("0.3", ord.TP)
-			e.Equal("3", ord.Swap)
-			e.Equal("3", ord.PriceSL)
-			e.Equal("3", ord.Profit)
+			e.Equal("3", ord.Type.Code())
+			e.Equal("0.3", ord.InitVolume.String())
+			e.Equal("0.3", ord.CurVolume.String())
+			e.Equal("0.3", ord.PriceOpen.String())
+			e.Equal("0.3", ord.SL.String())
+			e.Equal("0.3", ord.TP.String())
+			e.Equal("3", ord.Swap.String())
+			e.Equal("3", ord.PriceSL.String())
+			e.Equal("3", ord.Profit.String())
 		}
 	}
 
@@ -466,6 +484,26 @@ func (e *engineTestSuite) TestValidateAccountFailed() {
 	e.zapRecorder.TakeAll()
 }
 
+func (e *engineTestSuite) TestValidationDetails() {
+	println("TestValidationDetails started")
+	resp, err := e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Orders:     map[OrderTicket]Order{"325145411": {Symbol: "<script>"}},
+	})
+	if !e.NoError(err) {
+		return
+	}
+	e.Equal(ErrCodeInvalidMessage, resp.Code)
+	e.Contains(resp.Error, "Message is not valid")
+	if e.NotNil(resp.Validation) {
+		e.Equal("orders[325145411].symbol", resp.Validation.Field)
+		e.Equal(RuleCharset, resp.Validation.Rule)
+		e.Equal("<script>", resp.Validation.Value)
+	}
+	e.Nil(e.mt.PageExist("test"))
+}
+
 func (e *engineTestSuite) TestMaxFreeOrders() {
 	println("TestMaxFreeOrders started")
 	msg := Message{
@@ -561,7 +599,8 @@ func (e *engineTestSuite) TestRestAPIHandler() {
 	if !e.NoError(err) {
 		return
 	}
-	e.Empty(resp)
+	e.Empty(resp.Error)
+	e.Equal("New API version "+ProtocolVersion+" is available", resp.Message)
 
 	// Read stats
 	code, body, err := e.GetRest("test")
@@ -657,130 +696,1115 @@ func (e *engineTestSuite) TestWebSocket() {
 	}
 }
 
-func (e *engineTestSuite) wsHandler(w http.ResponseWriter, r *http.Request) {
-	c := e.testEcho.NewContext(r, w)
-	c.SetPath("/api/rest/test")
-	c.SetParamNames("page")
-	c.SetParamValues("test")
-	e.mt.WssAPIHandler(c)
+func (e *engineTestSuite) TestHeartbeat() {
+	println("TestHeartbeat started")
+
+	cfg := DefaultConfig()
+	cfg.SecondTimeout = Duration(300 * time.Millisecond)
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+	})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+
+	// Heartbeats keep the connection alive longer than timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Duration(cfg.SecondTimeout) / 2)
+		resp, err = e.Push(&Message{Heartbeat: true, Balance: "100"})
+		if e.NoError(err) {
+			e.Empty(resp)
+		}
+	}
+
+	acc := e.mt.PageExist("test")
+	if e.NotNil(acc) {
+		e.Empty(acc.Balance, "Heartbeat should not update an account")
+	}
 }
 
-// TODO:
-// - Account.ToJSON() !!!
-// - Validate account success
-// - Validate orders
-// - Performance check
-// - Messages frequency
-// - Read timeout
-// - Max message size
-// - Broadcast for low-speed or stalled clients
+func (e *engineTestSuite) TestHeartbeatFirstMessage() {
+	println("TestHeartbeatFirstMessage started")
 
-func (e *engineTestSuite) GetStats() (code int, body string, err error) {
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	rec := httptest.NewRecorder()
-	c := e.testEcho.NewContext(req, rec)
-	c.SetPath("/api/stats")
-	err = e.mt.StatsAPIHandler(c)
-	return rec.Code, rec.Body.String(), err
+	resp, err := e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Heartbeat:  true,
+	})
+	if e.NoError(err) {
+		e.NotEmpty(resp.Error)
+	}
+	e.Nil(e.mt.PageExist("test"))
 }
 
-func (e *engineTestSuite) GetRest(page string) (code int, body string, err error) {
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	rec := httptest.NewRecorder()
-	c := e.testEcho.NewContext(req, rec)
-	c.SetPath("/api/rest/:page")
-	c.SetParamNames("page")
-	c.SetParamValues(page)
+func (e *engineTestSuite) TestReadTimeout() {
+	println("TestReadTimeout started")
 
-	err = e.mt.RestAPIHandler(c)
-	return rec.Code, rec.Body.String(), err
+	cfg := DefaultConfig()
+	cfg.SecondTimeout = Duration(100 * time.Millisecond)
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+	})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+	e.NotNil(e.mt.PageExist("test"))
+
+	// Keep silence, the account should be evicted
+	resp, err = e.Recv()
+	if e.NoError(err) {
+		e.Contains(resp.Error, "evicted")
+		e.Equal(ErrCodeEvicted, resp.Code)
+	}
+	e.NoError(e.waitLogMessage("Account disconnected: test"))
+	if acc := e.mt.PageExist("test"); e.NotNil(acc) {
+		e.False(acc.Online())
+	}
 }
 
-func (e *engineTestSuite) PushToNewInstance(msg *Message) (*ResponseMsg, error) {
-	errChan := make(chan error)
-	respChan := make(chan *ResponseMsg)
-	go func() {
-		server, client := net.Pipe()
-		enc := gob.NewEncoder(server)
-		dec := gob.NewDecoder(server)
-		go e.mt.ProcessMessages(enc, dec, "testconn")
+func (e *engineTestSuite) TestHandshakeTimeout() {
+	println("TestHandshakeTimeout started")
 
-		enc2 := gob.NewEncoder(client)
-		dec2 := gob.NewDecoder(client)
+	cfg := DefaultConfig()
+	cfg.HandshakeTimeout = Duration(100 * time.Millisecond)
+	e.restart(cfg)
 
-		if err := enc2.Encode(msg); err != nil {
-			errChan <- err
-			return
-		}
+	resp, err := e.Recv()
+	if e.NoError(err) {
+		e.Contains(resp.Error, "evicted")
+		e.Equal(ErrCodeEvicted, resp.Code)
+	}
+}
 
-		// Wait for confirmation!
-		resp := new(ResponseMsg)
-		if err := dec2.Decode(&resp); err != nil {
-			errChan <- err
-			return
+func (e *engineTestSuite) TestThrottleCoalesce() {
+	println("TestThrottleCoalesce started")
+
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 2
+	cfg.ThrottlePolicy = ThrottleCoalesce
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{Page: "test", UpdateFreq: "minute"})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+
+	for i := 1; i <= 5; i++ {
+		resp, err = e.Push(&Message{Balance: strconv.Itoa(i)})
+		if e.NoError(err) {
+			e.Empty(resp)
 		}
-		errChan <- nil
-		respChan <- resp
-	}()
+	}
 
-	err := <-errChan
-	if err != nil {
-		return nil, err
+	// The latest state is kept anyway
+	acc := e.mt.PageExist("test")
+	if e.NotNil(acc) {
+		e.Equal("5", acc.Balance.String())
+		e.Equal(ThrottleStats{Throttled: 3, Coalesced: 3}, acc.limiter.stats())
 	}
-	return <-respChan, err
-}
 
-func (e *engineTestSuite) Push(msg *Message) (*ResponseMsg, error) {
-	if err := e.Send(msg); err != nil {
-		return nil, err
+	code, body, err := e.GetStats()
+	if e.Nil(err) {
+		e.Equal(200, code)
+		e.Contains(body, "\"throttle\":{\"throttled\":3,\"dropped\":0,\"coalesced\":3}")
 	}
-	return e.Recv()
 }
 
-func (e *engineTestSuite) Send(msg *Message) error {
-	errChan := make(chan error)
-	go func() {
-		err := e.enc.Encode(*msg)
-		if err != nil {
-			errChan <- err
-			return
+func (e *engineTestSuite) TestThrottleCoalesceFlush() {
+	println("TestThrottleCoalesceFlush started")
+
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 2
+	cfg.ThrottlePolicy = ThrottleCoalesce
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{Page: "test", UpdateFreq: "second"})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+
+	acc := e.mt.Account("test")
+	if !e.NotNil(acc) {
+		return
+	}
+	viewer := NewChannelViewer("viewer", 10)
+	e.NoError(acc.AddViewer(viewer))
+
+	for i := 1; i <= 5; i++ {
+		resp, err = e.Push(&Message{Balance: strconv.Itoa(i)})
+		if e.NoError(err) {
+			e.Empty(resp)
 		}
-		errChan <- nil
-	}()
+	}
 
-	timer := time.NewTimer(TestTimeoutSeconds)
-	select {
-	case <-timer.C:
-		return errors.New("Write failed: timeout")
-	case err := <-errChan:
-		if err != nil {
-			return err
+	// The latest state is broadcasted with the next token, no heartbeat or update is needed
+	timeout := time.After(TestTimeoutSeconds)
+	for {
+		select {
+		case msg := <-viewer.Messages():
+			if strings.Contains(string(msg.Data), "\"balance\":\"5\"") {
+				e.Equal(ThrottleStats{Throttled: 3, Coalesced: 3}, acc.limiter.stats())
+				return
+			}
+		case <-timeout:
+			e.Fail("Coalesced update is not flushed")
+			return
 		}
-		return nil
 	}
 }
 
-func (e *engineTestSuite) Recv() (*ResponseMsg, error) {
-	errChan := make(chan error)
-	respChan := make(chan *ResponseMsg)
-	go func() {
-		msg := new(ResponseMsg)
-		err := e.dec.Decode(msg)
-		if err != nil {
-			errChan <- err
-			return
+func (e *engineTestSuite) TestThrottleDrop() {
+	println("TestThrottleDrop started")
+
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 2
+	cfg.ThrottlePolicy = ThrottleDrop
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{Page: "test", UpdateFreq: "minute"})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+
+	for i := 1; i <= 5; i++ {
+		resp, err = e.Push(&Message{Balance: strconv.Itoa(i)})
+		if e.NoError(err) {
+			e.Empty(resp)
 		}
-		respChan <- msg
-	}()
+	}
 
-	timer := time.NewTimer(TestTimeoutSeconds)
-	select {
-	case <-timer.C:
-		return nil, errors.New("Read failed: timeout")
-	case err := <-errChan:
-		return nil, err
-	case msg := <-respChan:
-		return msg, nil
+	// Only first updates are within the limit
+	acc := e.mt.PageExist("test")
+	if e.NotNil(acc) {
+		e.Equal("2", acc.Balance.String())
+		e.Equal(ThrottleStats{Throttled: 3, Dropped: 3}, acc.limiter.stats())
+	}
+}
+
+func (e *engineTestSuite) TestThrottleDropDelta() {
+	println("TestThrottleDropDelta started")
+
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 1
+	cfg.ThrottlePolicy = ThrottleDrop
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{
+		Page:          "test",
+		UpdateFreq:    "minute",
+		ClientVersion: "1.2",
+		Features:      []string{"deltaorders"},
+		Orders:        map[OrderTicket]Order{"11111": {Symbol: "EURUSD"}},
+	})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp.Error)
+
+	resp, err = e.Push(&Message{Balance: "1"})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	// Closed orders of throttled delta are not lost
+	resp, err = e.Push(&Message{Closed: []OrderTicket{"11111"}})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+
+	acc := e.mt.PageExist("test")
+	if e.NotNil(acc) {
+		e.Equal(0, acc.OrdersCount)
+		e.NotContains(acc.Orders, OrderTicket("11111"))
+		e.Equal(ThrottleStats{Throttled: 1, Dropped: 1}, acc.limiter.stats())
+	}
+}
+
+func (e *engineTestSuite) TestThrottleDisconnect() {
+	println("TestThrottleDisconnect started")
+
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 2
+	cfg.ThrottlePolicy = ThrottleDisconnect
+	e.restart(cfg)
+
+	resp, err := e.Push(&Message{Page: "test", UpdateFreq: "minute"})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp)
+
+	resp, err = e.Push(&Message{Balance: "1"})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	resp, err = e.Push(&Message{Balance: "2"})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	resp, err = e.Push(&Message{Balance: "3"})
+	if e.NoError(err) {
+		e.Contains(resp.Error, "Update rate exceeded")
+	}
+
+	e.NoError(e.waitLogMessage("Account disconnected: test"))
+	if acc := e.mt.PageExist("test"); e.NotNil(acc) {
+		e.False(acc.Online())
+	}
+
+	code, body, err := e.GetStats()
+	if e.Nil(err) {
+		e.Equal(200, code)
+		e.Contains(body, "\"throttleDisconnects\":1")
+	}
+}
+
+func (e *engineTestSuite) TestPageSecret() {
+	println("TestPageSecret started")
+
+	// Claim the page and disconnect
+	resp, err := e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "secret"})
+	if e.NoError(err) {
+		e.Empty(resp.Error)
+	}
+	e.True(e.mt.pages.Claimed("test"))
+	e.mt.removeAccount(e.mt.PageExist("test"))
+
+	resp, err = e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second"})
+	if e.NoError(err) {
+		e.Equal(ErrCodeWrongSecret, resp.Code)
+	}
+	resp, err = e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "another"})
+	if e.NoError(err) {
+		e.Equal(ErrCodeWrongSecret, resp.Code)
+	}
+	e.Nil(e.mt.PageExist("test"))
+
+	// Suite connection may exceed handshake timeout after the bcrypt checks, so new one is used
+	resp, err = e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "secret"})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	if acc := e.mt.PageExist("test"); e.NotNil(acc) {
+		e.Empty(acc.Snapshot().Secret, "Secret should never be exposed")
+	}
+}
+
+func (e *engineTestSuite) TestUnknownPage() {
+	println("TestUnknownPage started")
+
+	cfg := DefaultConfig()
+	cfg.Registry.OpenRegistration = false
+	e.restart(cfg)
+
+	resp, err := e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "secret"})
+	if e.NoError(err) {
+		e.Equal(ErrCodeUnknownPage, resp.Code)
+	}
+
+	e.NoError(e.mt.pages.Transfer("test", "secret"))
+	// Suite connection may exceed handshake timeout after the bcrypt checks, so new one is used
+	resp, err = e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "secret"})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+}
+
+func (e *engineTestSuite) TestAdminAPI() {
+	println("TestAdminAPI started")
+
+	cfg := DefaultConfig()
+	cfg.Registry.AdminToken = "admin"
+	e.restart(cfg)
+
+	// Wrong token
+	code, _ := e.Admin(http.MethodGet, "", "wrong", "")
+	e.Equal(http.StatusForbidden, code)
+
+	// Create
+	code, _ = e.Admin(http.MethodPut, "test", "admin", "{\"secret\":\"secret\"}")
+	e.Equal(http.StatusNoContent, code)
+	code, body := e.Admin(http.MethodGet, "", "admin", "")
+	e.Equal(http.StatusOK, code)
+	e.Equal("[\"test\"]", strings.TrimSpace(body))
+
+	// Transfer
+	code, _ = e.Admin(http.MethodPut, "test", "admin", "{\"secret\":\"new-secret\"}")
+	e.Equal(http.StatusNoContent, code)
+	e.NoError(e.mt.pages.Authenticate("test", "new-secret"))
+	code, _ = e.Admin(http.MethodPut, "test", "admin", "{}")
+	e.Equal(http.StatusBadRequest, code)
+
+	// Reset
+	code, _ = e.Admin(http.MethodDelete, "test", "admin", "")
+	e.Equal(http.StatusNoContent, code)
+	e.False(e.mt.pages.Claimed("test"))
+	code, _ = e.Admin(http.MethodDelete, "test", "admin", "")
+	e.Equal(http.StatusNotFound, code)
+}
+
+func (e *engineTestSuite) TestMinClientVersion() {
+	println("TestMinClientVersion started")
+
+	cfg := DefaultConfig()
+	cfg.MinClientVersion = "1.0"
+	e.restart(cfg)
+
+	for _, v := range []string{"", "0.9", "0.10.1"} {
+		resp, err := e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", ClientVersion: v})
+		if e.NoError(err) {
+			e.Equal(ErrCodeVersionUnsupported, resp.Code)
+			e.Contains(resp.Error, "please upgrade to "+ProtocolVersion)
+		}
+	}
+	e.Nil(e.mt.PageExist("test"))
+
+	resp, err := e.Push(&Message{Page: "test", UpdateFreq: "second", ClientVersion: ProtocolVersion})
+	if e.NoError(err) {
+		e.Empty(resp, "Up to date client should not be notified")
+	}
+}
+
+func (e *engineTestSuite) TestFeatures() {
+	println("TestFeatures started")
+
+	// Old client can not use new features
+	resp, err := e.PushToNewInstance(&Message{
+		Page:          "old",
+		UpdateFreq:    "second",
+		ClientVersion: "1.1",
+		Features:      []string{"heartbeat", "deltaorders", "compression"},
+	})
+	if e.NoError(err) {
+		e.Empty(resp.Error)
+		e.Equal([]string{"heartbeat"}, resp.Features)
+	}
+
+	// Unknown features are ignored, compression needs the stream switching connection
+	resp, err = e.Push(&Message{
+		Page:          "test",
+		UpdateFreq:    "second",
+		ClientVersion: "1.2",
+		Features:      []string{"DeltaOrders", "compression"},
+	})
+	if e.NoError(err) {
+		e.Empty(resp.Error)
+		e.Equal([]string{"deltaorders"}, resp.Features)
+	}
+}
+
+func (e *engineTestSuite) TestDeltaOrders() {
+	println("TestDeltaOrders started")
+
+	resp, err := e.Push(&Message{
+		Page:          "test",
+		UpdateFreq:    "second",
+		ClientVersion: "1.2",
+		Features:      []string{"deltaorders"},
+		Orders: map[OrderTicket]Order{
+			"11111": {Symbol: "EURUSD", Profit: "1"},
+			"22222": {Symbol: "GBPUSD", Profit: "2"},
+		},
+	})
+	if !e.NoError(err) {
+		return
+	}
+	e.Empty(resp.Error)
+
+	// Omitted orders are kept
+	resp, err = e.Push(&Message{
+		Orders: map[OrderTicket]Order{"22222": {Profit: "3"}},
+	})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	acc := e.mt.PageExist("test")
+	if e.NotNil(acc) {
+		e.Equal(2, acc.OrdersCount)
+		e.Equal("3", acc.Orders["22222"].Profit.String())
+	}
+
+	// Closed are removed
+	resp, err = e.Push(&Message{Closed: []OrderTicket{"11111"}})
+	if e.NoError(err) {
+		e.Empty(resp)
+	}
+	if e.NotNil(acc) {
+		e.Equal(1, acc.OrdersCount)
+		e.NotContains(acc.Orders, OrderTicket("11111"))
+	}
+
+	// Orders limit is checked against accumulated orders
+	for i := 0; i < MaxFreeOrders; i += 10 {
+		msg := Message{Orders: make(map[OrderTicket]Order)}
+		for j := i; j < i+10; j++ {
+			msg.Orders[OrderTicket(strconv.Itoa(100+j))] = Order{}
+		}
+		resp, err = e.Push(&msg)
+		if !e.NoError(err) {
+			return
+		}
+	}
+	e.Contains(resp.Error, "Exceeded maximum orders number")
+}
+
+func (e *engineTestSuite) TestHistory() {
+	println("TestHistory started")
+
+	code, _, err := e.GetHistory("test")
+	if e.NoError(err) {
+		e.Equal(404, code)
+	}
+
+	_, err = e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Orders: map[OrderTicket]Order{
+			"11111": {Symbol: "EURGBP", Type: "0", CurVolume: "0.1", Swap: "-1", Profit: "5"},
+			"22222": {Symbol: "EURUSD", Type: "1", CurVolume: "0.2"},
+		},
+	})
+	if !e.NoError(err) {
+		return
+	}
+
+	code, body, err := e.GetHistory("test")
+	if e.NoError(err) {
+		e.Equal(200, code)
+		e.JSONEq("[]", body)
+	}
+
+	// Missing order is closed with the last known values
+	_, err = e.Push(&Message{
+		Orders: map[OrderTicket]Order{
+			"11111": {Profit: "7"},
+		},
+	})
+	if !e.NoError(err) {
+		return
+	}
+	_, err = e.Push(&Message{
+		Orders: map[OrderTicket]Order{},
+	})
+	if !e.NoError(err) {
+		return
+	}
+
+	code, body, err = e.GetHistory("test")
+	if e.NoError(err) {
+		e.Equal(200, code)
+		// Tickets are written as numbers
+		var hist []struct {
+			Ticket json.Number
+			Order
+			Closed time.Time
+		}
+		if e.NoError(json.Unmarshal([]byte(body), &hist)) && e.Len(hist, 2) {
+			e.Equal(json.Number("22222"), hist[0].Ticket)
+			e.Equal("0.2", hist[0].CurVolume)
+			e.Equal(json.Number("11111"), hist[1].Ticket)
+			e.Equal("7", hist[1].Profit)
+			e.Equal("-1", hist[1].Swap)
+			e.Equal("0.1", hist[1].CurVolume)
+			e.False(hist[1].Closed.IsZero())
+		}
+	}
+}
+
+func (e *engineTestSuite) TestHistorySize() {
+	println("TestHistorySize started")
+
+	cfg := DefaultConfig()
+	cfg.HistorySize = 2
+	e.restart(cfg)
+
+	_, err := e.Push(&Message{Page: "test", UpdateFreq: "second"})
+	if !e.NoError(err) {
+		return
+	}
+	for _, tick := range []OrderTicket{"1", "2", "3"} {
+		_, err = e.Push(&Message{Orders: map[OrderTicket]Order{tick: {Symbol: "EURUSD"}}})
+		if !e.NoError(err) {
+			return
+		}
+	}
+	_, err = e.Push(&Message{Orders: map[OrderTicket]Order{}})
+	if !e.NoError(err) {
+		return
+	}
+
+	// The oldest order is dropped
+	hist := e.mt.PageExist("test").History()
+	if e.Len(hist, 2) {
+		e.Equal(OrderTicket("2"), hist[0].Ticket)
+		e.Equal(OrderTicket("3"), hist[1].Ticket)
+	}
+}
+
+func (e *engineTestSuite) TestWebSocketHistory() {
+	println("TestWebSocketHistory started")
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	e.Nil(err)
+	u.Scheme = "ws"
+
+	_, err = e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Orders:     map[OrderTicket]Order{"11111": {Symbol: "EURGBP", Profit: "5"}},
+	})
+	if !e.NoError(err) {
+		return
+	}
+
+	// Unknown channel is refused
+	u.RawQuery = "channels=account,trades"
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if e.Error(err) {
+		e.Equal(400, resp.StatusCode)
+	}
+
+	// History subscriber gets no account updates
+	u.RawQuery = "channels=history"
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+
+	var ev Event
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.Equal(ChannelHistory, ev.Channel)
+		e.Empty(ev.Data)
+	}
+
+	_, err = e.Push(&Message{Balance: "100", Orders: map[OrderTicket]Order{}})
+	if !e.NoError(err) {
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, p, err := ws.ReadMessage()
+	if e.NoError(err) {
+		str := string(p)
+		e.NotContains(str, "balance")
+		e.Contains(str, "\"channel\":\"history\"")
+		e.Contains(str, "\"ticket\":11111")
+		e.Contains(str, "\"profit\":\"5\"")
+	}
+}
+
+func (e *engineTestSuite) TestWebSocketEvents() {
+	println("TestWebSocketEvents started")
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	e.Nil(err)
+	u.Scheme = "ws"
+	u.RawQuery = "channels=events"
+
+	_, err = e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Orders:     map[OrderTicket]Order{"11111": {Symbol: "EURGBP", SL: "1"}},
+	})
+	if !e.NoError(err) {
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+
+	var ev Event
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.Equal(ChannelEvents, ev.Channel)
+		e.Empty(ev.Data)
+	}
+
+	_, err = e.Push(&Message{Orders: map[OrderTicket]Order{"11111": {SL: "2"}}})
+	if !e.NoError(err) {
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, p, err := ws.ReadMessage()
+	if e.NoError(err) {
+		str := string(p)
+		e.Contains(str, "\"channel\":\"events\"")
+		e.Contains(str, "\"seq\":1")
+		e.Contains(str, "\"type\":\"modified\"")
+		e.Contains(str, "\"previous\":{\"sl\":\"1\"}")
+	}
+}
+
+func (e *engineTestSuite) TestWebSocketDelta() {
+	println("TestWebSocketDelta started")
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	e.Nil(err)
+	u.Scheme = "ws"
+	u.RawQuery = "channels=delta"
+
+	_, err = e.Push(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Balance:    "10",
+		Orders:     map[OrderTicket]Order{"11111": {Symbol: "EURGBP", Profit: "1"}},
+	})
+	if !e.NoError(err) {
+		return
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+
+	type deltaEvent struct {
+		Channel string
+		Data    DeltaUpdate
+	}
+	var ev deltaEvent
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.Equal(ChannelDelta, ev.Channel)
+		e.Equal(uint64(0), ev.Data.Version)
+		e.Contains(string(ev.Data.Snapshot), "\"balance\":\"10\"")
+		e.Empty(ev.Data.Patch)
+	}
+
+	// Only the changed values are sent
+	_, err = e.Push(&Message{Orders: map[OrderTicket]Order{"11111": {Profit: "2"}}})
+	if !e.NoError(err) {
+		return
+	}
+	ev = deltaEvent{}
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.Equal(uint64(1), ev.Data.Version)
+		patch := string(ev.Data.Patch)
+		e.Contains(patch, "\"orders\":{\"11111\":{\"profit\":\"2\"}}")
+		e.NotContains(patch, "balance")
+		e.NotContains(patch, "EURGBP")
+	}
+
+	// Viewer asks for the snapshot again
+	if e.NoError(ws.WriteJSON(ViewerCommand{Command: CommandResync})) {
+		ev = deltaEvent{}
+		if e.NoError(ws.ReadJSON(&ev)) {
+			e.Equal(uint64(1), ev.Data.Version)
+			e.Contains(string(ev.Data.Snapshot), "\"profit\":\"2\"")
+		}
+	}
+}
+
+func (e *engineTestSuite) TestOfflineAccount() {
+	println("TestOfflineAccount started")
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	e.Nil(err)
+	u.Scheme = "ws"
+	u.RawQuery = "channels=status"
+
+	// Only claimed page is resumed
+	_, err = e.Push(&Message{Page: "test", UpdateFreq: "second", Secret: "secret", Balance: "10"})
+	if !e.NoError(err) {
+		return
+	}
+	acc := e.mt.PageExist("test")
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+
+	type statusEvent struct {
+		Channel string
+		Data    AccountStatus
+	}
+	var ev statusEvent
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.Equal(ChannelStatus, ev.Channel)
+		e.True(ev.Data.Online)
+		e.NotNil(ev.Data.ConnectedSince)
+	}
+
+	// Viewer stays connected and is told MetaTrader is gone
+	e.client.Close()
+	e.NoError(e.waitLogMessage("Account disconnected: test"))
+	ev = statusEvent{}
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.False(ev.Data.Online)
+		e.Nil(ev.Data.ConnectedSince)
+		e.False(ev.Data.LastSeen.IsZero())
+	}
+
+	code, body, err := e.GetRest("test")
+	if e.NoError(err) {
+		e.Equal(http.StatusOK, code)
+		e.Contains(body, "\"balance\":\"10\"")
+		e.Contains(body, "\"online\":false")
+		e.Contains(body, "\"lastSeen\":")
+		e.NotContains(body, "connectedSince")
+	}
+	code, body, err = e.GetStats()
+	if e.NoError(err) {
+		e.Equal(http.StatusOK, code)
+		e.Contains(body, "\"online\":false")
+		e.Contains(body, "\"connectedSince\":\"\"")
+	}
+
+	// The same account is resumed by reconnected MetaTrader
+	resp, err := e.PushToNewInstance(&Message{Page: "test", UpdateFreq: "second", Secret: "secret"})
+	if e.NoError(err) {
+		e.Empty(resp.Error)
+	}
+	e.True(e.mt.PageExist("test") == acc)
+	ev = statusEvent{}
+	if e.NoError(ws.ReadJSON(&ev)) {
+		e.True(ev.Data.Online)
+		e.NotNil(ev.Data.ConnectedSince)
+	}
+}
+
+func (e *engineTestSuite) TestWebSocketClose() {
+	println("TestWebSocketClose started")
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	_, err := e.Push(&Message{Page: "test", UpdateFreq: "second"})
+	if !e.NoError(err) {
+		return
+	}
+	acc := e.mt.PageExist("test")
+
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, _, err = ws.ReadMessage()
+	e.NoError(err)
+	e.Equal(1, acc.broker.Stats().Viewers)
+
+	// Viewer is removed as soon as the close frame is received
+	e.NoError(ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	e.Eventually(func() bool { return acc.broker.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+	_, _, err = ws.ReadMessage()
+	e.True(websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func (e *engineTestSuite) TestWebSocketPing() {
+	println("TestWebSocketPing started")
+
+	cfg := DefaultConfig()
+	cfg.ViewerPingInterval = Duration(20 * time.Millisecond)
+	cfg.ViewerPongTimeout = Duration(100 * time.Millisecond)
+	e.restart(cfg)
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	_, err := e.Push(&Message{Page: "test", UpdateFreq: "second"})
+	if !e.NoError(err) {
+		return
+	}
+	acc := e.mt.PageExist("test")
+
+	dial := func(pong bool) (*websocket.Conn, chan error, *int32) {
+		ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+		if !e.NoError(err) {
+			return nil, nil, nil
+		}
+		pings := new(int32)
+		ws.SetPingHandler(func(data string) error {
+			atomic.AddInt32(pings, 1)
+			if !pong {
+				return nil
+			}
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		// Control frames are handled while reading
+		errs := make(chan error, 1)
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		return ws, errs, pings
+	}
+
+	// Answering viewer stays connected
+	alive, aliveErrs, pings := dial(true)
+	if alive == nil {
+		return
+	}
+	defer alive.Close()
+	time.Sleep(300 * time.Millisecond)
+	e.GreaterOrEqual(atomic.LoadInt32(pings), int32(3))
+	e.Equal(1, acc.broker.Stats().Viewers)
+	e.Empty(aliveErrs)
+
+	// Silent viewer is dropped after pong timeout
+	dead, deadErrs, pings := dial(false)
+	if dead == nil {
+		return
+	}
+	defer dead.Close()
+	select {
+	case err := <-deadErrs:
+		e.Error(err)
+	case <-time.After(TestTimeoutSeconds):
+		e.Fail("Silent viewer is not disconnected")
+	}
+	e.GreaterOrEqual(atomic.LoadInt32(pings), int32(1))
+	e.Eventually(func() bool { return acc.broker.Stats().Viewers == 1 }, TestTimeoutSeconds, time.Millisecond)
+}
+
+func (e *engineTestSuite) TestWebSocketMaxMsgSize() {
+	println("TestWebSocketMaxMsgSize started")
+
+	cfg := DefaultConfig()
+	cfg.ViewerMaxMsgSize = 64
+	e.restart(cfg)
+
+	s := httptest.NewServer(http.HandlerFunc(e.wsHandler))
+	defer s.Close()
+
+	_, err := e.Push(&Message{Page: "test", UpdateFreq: "second"})
+	if !e.NoError(err) {
+		return
+	}
+	acc := e.mt.PageExist("test")
+
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1)+"?channels=delta", nil)
+	if !e.NoError(err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, _, err = ws.ReadMessage()
+	e.NoError(err)
+
+	// Short commands are accepted
+	e.NoError(ws.WriteJSON(ViewerCommand{Command: CommandResync}))
+	_, data, err := ws.ReadMessage()
+	if e.NoError(err) {
+		e.Contains(string(data), "snapshot")
+	}
+
+	e.NoError(ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 65))))
+	_, _, err = ws.ReadMessage()
+	e.True(websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+	e.Eventually(func() bool { return acc.broker.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+}
+
+func (e *engineTestSuite) wsHandler(w http.ResponseWriter, r *http.Request) {
+	c := e.testEcho.NewContext(r, w)
+	c.SetPath("/api/rest/test")
+	c.SetParamNames("page")
+	c.SetParamValues("test")
+	e.mt.WssAPIHandler(c)
+}
+
+// TODO:
+// - Account.ToJSON() !!!
+// - Validate account success
+// - Performance check
+// - Max message size
+// - Broadcast for low-speed or stalled clients
+
+func (e *engineTestSuite) GetStats() (code int, body string, err error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.testEcho.NewContext(req, rec)
+	c.SetPath("/api/stats")
+	err = e.mt.StatsAPIHandler(c)
+	return rec.Code, rec.Body.String(), err
+}
+
+func (e *engineTestSuite) GetRest(page string) (code int, body string, err error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.testEcho.NewContext(req, rec)
+	c.SetPath("/api/rest/:page")
+	c.SetParamNames("page")
+	c.SetParamValues(page)
+
+	err = e.mt.RestAPIHandler(c)
+	return rec.Code, rec.Body.String(), err
+}
+
+func (e *engineTestSuite) GetHistory(page string) (code int, body string, err error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.testEcho.NewContext(req, rec)
+	c.SetPath("/api/rest/:page/history")
+	c.SetParamNames("page")
+	c.SetParamValues(page)
+
+	err = e.mt.HistoryAPIHandler(c)
+	return rec.Code, rec.Body.String(), err
+}
+
+// Admin calls admin API for the page, or lists pages if page is empty
+func (e *engineTestSuite) Admin(method, page, token, body string) (code int, resp string) {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set("X-Admin-Token", token)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.testEcho.NewContext(req, rec)
+
+	handler := e.mt.AdminPagesHandler
+	if page != "" {
+		c.SetPath("/api/admin/pages/:page")
+		c.SetParamNames("page")
+		c.SetParamValues(page)
+		handler = e.mt.AdminResetHandler
+		if method == http.MethodPut {
+			handler = e.mt.AdminTransferHandler
+		}
+	}
+
+	if err := e.mt.adminAuth(handler)(c); err != nil {
+		e.testEcho.HTTPErrorHandler(err, c)
+	}
+	return rec.Code, rec.Body.String()
+}
+
+func (e *engineTestSuite) PushToNewInstance(msg *Message) (*ResponseMsg, error) {
+	errChan := make(chan error)
+	respChan := make(chan *ResponseMsg)
+	go func() {
+		server, client := net.Pipe()
+		enc := gob.NewEncoder(server)
+		dec := gob.NewDecoder(server)
+		go e.mt.ProcessMessages(server, enc, dec)
+
+		enc2 := gob.NewEncoder(client)
+		dec2 := gob.NewDecoder(client)
+
+		if err := enc2.Encode(msg); err != nil {
+			errChan <- err
+			return
+		}
+
+		// Wait for confirmation!
+		resp := new(ResponseMsg)
+		if err := dec2.Decode(&resp); err != nil {
+			errChan <- err
+			return
+		}
+		errChan <- nil
+		respChan <- resp
+	}()
+
+	err := <-errChan
+	if err != nil {
+		return nil, err
+	}
+	return <-respChan, err
+}
+
+func (e *engineTestSuite) Push(msg *Message) (*ResponseMsg, error) {
+	if err := e.Send(msg); err != nil {
+		return nil, err
+	}
+	return e.Recv()
+}
+
+func (e *engineTestSuite) Send(msg *Message) error {
+	errChan := make(chan error)
+	enc := e.enc // TearDownTest resets it while the write may still be pending
+	go func() {
+		err := enc.Encode(*msg)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		errChan <- nil
+	}()
+
+	timer := time.NewTimer(TestTimeoutSeconds)
+	select {
+	case <-timer.C:
+		return errors.New("Write failed: timeout")
+	case err := <-errChan:
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func (e *engineTestSuite) Recv() (*ResponseMsg, error) {
+	errChan := make(chan error)
+	respChan := make(chan *ResponseMsg)
+	dec := e.dec // TearDownTest resets it while the read may still be pending
+	go func() {
+		msg := new(ResponseMsg)
+		err := dec.Decode(msg)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		respChan <- msg
+	}()
+
+	timer := time.NewTimer(TestTimeoutSeconds)
+	select {
+	case <-timer.C:
+		return nil, errors.New("Read failed: timeout")
+	case err := <-errChan:
+		return nil, err
+	case msg := <-respChan:
+		return msg, nil
+	}
+}
+
+func (e *engineTestSuite) waitLogMessage(msg string) error {
+	ts := time.Now()
+	for {
+		for _, log := range e.zapRecorder.All() {
+			if strings.Contains(log.Message, msg) {
+				return nil
+			}
+		}
+		if time.Since(ts) > TestTimeoutSeconds {
+			return errors.New("Log message awaiting failed: timeout")
+		}
+		time.Sleep(time.Millisecond)
 	}
 }
 
@@ -0,0 +1,128 @@
+package metatrader
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Rejections are counted for this number of addresses, the rest are summed up as "other"
+const maxRejectedAddrs = 1024
+
+// MsgSizeError is returned by decoders for messages exceeding the limit
+type MsgSizeError struct {
+	Size int // 0 if the message is not read to the end
+	Max  int
+}
+
+func (e *MsgSizeError) Error() string {
+	if e.Size == 0 {
+		return "Message exceeds the limit of " + strconv.Itoa(e.Max) + " bytes"
+	}
+	return "Message of " + strconv.Itoa(e.Size) + " bytes exceeds the limit of " + strconv.Itoa(e.Max) + " bytes"
+}
+
+// gobFrameReader passes gob stream through checking the length prefix of each message
+// gob.Decoder allocates the buffer for the whole message upfront,
+// so the oversized message is rejected before the decoder sees its length
+type gobFrameReader struct {
+	r      io.Reader
+	max    int
+	remain int    // body bytes left in the current message
+	header []byte // length prefix not yet passed to the decoder
+}
+
+// newGobDecoder creates gob decoder rejecting messages larger than max bytes
+func newGobDecoder(r io.Reader, max int) *gob.Decoder {
+	return gob.NewDecoder(&gobFrameReader{r: r, max: max})
+}
+
+func (g *gobFrameReader) Read(p []byte) (int, error) {
+	if len(g.header) == 0 && g.remain == 0 {
+		if err := g.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(g.header) > 0 {
+		n := copy(p, g.header)
+		g.header = g.header[n:]
+		return n, nil
+	}
+
+	// Never read ahead of the current message, the next length prefix is checked first
+	if len(p) > g.remain {
+		p = p[:g.remain]
+	}
+	n, err := g.r.Read(p)
+	g.remain -= n
+	return n, err
+}
+
+// next reads the length prefix of the following message
+// Gob encodes small lengths in a single byte, otherwise the first byte is the negated
+// number of big-endian bytes to follow
+func (g *gobFrameReader) next() error {
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(g.r, buf[:1]); err != nil {
+		return err
+	}
+
+	size := uint64(buf[0])
+	width := 1
+	if buf[0] > 0x7f {
+		width += -int(int8(buf[0]))
+		if width > len(buf) {
+			return errors.New("Malformed message length")
+		}
+		if _, err := io.ReadFull(g.r, buf[1:width]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		size = 0
+		for _, b := range buf[1:width] {
+			size = size<<8 | uint64(b)
+		}
+	}
+
+	if size > uint64(g.max) {
+		ret := &MsgSizeError{Max: g.max, Size: int(size)}
+		if size > uint64(^uint(0)>>1) {
+			ret.Size = 0
+		}
+		return ret
+	}
+	g.remain = int(size)
+	g.header = buf[:width]
+	return nil
+}
+
+// countRejected message from remote address
+func (f *Factory) countRejected(addr net.Addr) {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.rejected[host]; !ok && len(f.rejected) >= maxRejectedAddrs {
+		host = "other"
+	}
+	f.rejected[host]++
+}
+
+// rejectedStats returns copy of rejections per remote address
+func (f *Factory) rejectedStats() map[string]int {
+	f.RLock()
+	defer f.RUnlock()
+
+	ret := make(map[string]int, len(f.rejected))
+	for host, cnt := range f.rejected {
+		ret[host] = cnt
+	}
+	return ret
+}
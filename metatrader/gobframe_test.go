@@ -0,0 +1,164 @@
+package metatrader
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// maxMessage has all fields at their validation limits
+func maxMessage() *Message {
+	str := strings.Repeat("a", 32)
+	num := strings.Repeat("1", 32)
+	msg := &Message{
+		Page:          str,
+		ClientVersion: str,
+		Secret:        strings.Repeat("a", 64),
+		UpdateFreq:    str,
+		Name:          str,
+		Login:         str,
+		Server:        str,
+		Company:       str,
+		Balance:       num,
+		Equity:        num,
+		Margin:        num,
+		FreeMargin:    num,
+		MarginLevel:   num,
+		ProfitTotal:   num,
+		OrdersCount:   1 << 62,
+		Orders:        make(map[OrderTicket]Order),
+	}
+	for i := 0; i < MaxFeatures; i++ {
+		msg.Features = append(msg.Features, str)
+	}
+	for i := 0; i < MaxFreeOrders; i++ {
+		tick := OrderTicket(strings.Repeat("1", 30) + strconv.Itoa(10+i))
+		msg.Closed = append(msg.Closed, tick)
+		msg.Orders[tick] = Order{num, num, num, num, num, num, num, num, num, num, num}
+	}
+	return msg
+}
+
+// gobStream encodes messages into single stream
+func gobStream(t testing.TB, msgs ...*Message) []byte {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, msg := range msgs {
+		require.NoError(t, enc.Encode(msg))
+	}
+	return buf.Bytes()
+}
+
+func TestGobFrameMaxMessage(t *testing.T) {
+	println("TestGobFrameMaxMessage started")
+	msg := maxMessage()
+	dec := newGobDecoder(bytes.NewReader(gobStream(t, msg, msg)), MaxMsgSize)
+
+	for i := 0; i < 2; i++ {
+		var got Message
+		if assert.NoError(t, dec.Decode(&got)) {
+			assert.Equal(t, msg.Orders, got.Orders)
+		}
+	}
+	assert.Equal(t, io.EOF, dec.Decode(new(Message)))
+}
+
+func TestGobFrameOversized(t *testing.T) {
+	println("TestGobFrameOversized started")
+	dec := newGobDecoder(bytes.NewReader(gobStream(t, maxMessage())), 1024)
+
+	err := dec.Decode(new(Message))
+	if se, ok := err.(*MsgSizeError); assert.True(t, ok, "MsgSizeError expected, got %v", err) {
+		assert.Equal(t, 1024, se.Max)
+		assert.True(t, se.Size > 1024)
+	}
+
+	// Huge length prefix is rejected without reading the body
+	dec = newGobDecoder(bytes.NewReader([]byte{0xf8, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}), MaxMsgSize)
+	err = dec.Decode(new(Message))
+	assert.IsType(t, &MsgSizeError{}, err)
+
+	dec = newGobDecoder(bytes.NewReader([]byte{0x80}), MaxMsgSize)
+	assert.EqualError(t, dec.Decode(new(Message)), "Malformed message length")
+}
+
+func TestGobFrameRejectedCount(t *testing.T) {
+	println("TestGobFrameRejectedCount started")
+	cfg := DefaultConfig()
+	cfg.MaxMsgSize = 1024
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp := processStream(mt, gobStream(t, maxMessage()))
+		assert.Contains(t, resp, "Message is rejected: Message of")
+	}
+	assert.Equal(t, map[string]int{"pipe": 2}, mt.rejectedStats())
+	assert.Equal(t, 2, mt.exportState().RejectedMessages)
+}
+
+// processStream pushes raw bytes to ProcessMessages and returns error responses
+func processStream(mt *Factory, data []byte) string {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		mt.ProcessMessages(server, gob.NewEncoder(server), newGobDecoder(server, mt.cfg.MaxMsgSize))
+		server.Close()
+		close(done)
+	}()
+
+	// Server stops reading on error, the pipe is unblocked by closing
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	var errs []string
+	dec := gob.NewDecoder(client)
+	for {
+		var resp ResponseMsg
+		if err := dec.Decode(&resp); err != nil {
+			break
+		}
+		errs = append(errs, resp.Error)
+	}
+	io.Copy(ioutil.Discard, client)
+
+	select {
+	case <-done:
+	case <-time.After(TestTimeoutSeconds):
+		panic("ProcessMessages did not return")
+	}
+	return strings.Join(errs, "\n")
+}
+
+func FuzzProcessMessages(f *testing.F) {
+	valid := gobStream(f, &Message{Page: "test", UpdateFreq: "second"}, &Message{Balance: "100"})
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(gobStream(f, maxMessage()))
+	f.Add([]byte{0xf8, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x80})
+	f.Add([]byte{0x05, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	cfg := DefaultConfig()
+	cfg.OfflineGrace = 0
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(f, err)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		processStream(mt, data)
+		mt.RLock()
+		defer mt.RUnlock()
+		assert.Empty(t, mt.accounts)
+	})
+}
@@ -0,0 +1,56 @@
+package metatrader
+
+import (
+	"time"
+)
+
+// MaxHistoryOrders is the default number of closed orders kept per account
+const MaxHistoryOrders = 100
+
+// ClosedOrder is the order disappeared from the account, values are the last known ones
+type ClosedOrder struct {
+	Ticket OrderTicket `json:"ticket" example:"325145411"`
+	Order
+	Closed time.Time `json:"closed" example:"2021-01-06T09:12:54.031357064+03:00"`
+}
+
+// closeOrder moves the order to history, should be called under account lock
+// The oldest orders are dropped when history is full
+func (a *Account) closeOrder(tick OrderTicket, ord OrderState, now time.Time) {
+	closed := ClosedOrder{Ticket: tick, Order: ord.Order(), Closed: now}
+
+	if a.historySize <= 0 {
+		return
+	}
+	if len(a.history) >= a.historySize {
+		// Shift instead of reslicing, so the array does not grow forever
+		copy(a.history, a.history[len(a.history)-a.historySize+1:])
+		a.history = a.history[:a.historySize-1]
+	}
+	a.history = append(a.history, closed)
+	// Viewers never get more than the history keeps
+	if len(a.unsentHistory) >= a.historySize {
+		a.unsentHistory = a.unsentHistory[1:]
+	}
+	a.unsentHistory = append(a.unsentHistory, closed)
+}
+
+// History returns closed orders, the oldest first
+func (a *Account) History() []ClosedOrder {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	ret := make([]ClosedOrder, len(a.history))
+	copy(ret, a.history)
+	return ret
+}
+
+// takeUnsentHistory returns orders closed since the last broadcast
+func (a *Account) takeUnsentHistory() []ClosedOrder {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ret := a.unsentHistory
+	a.unsentHistory = nil
+	return ret
+}
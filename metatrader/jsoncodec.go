@@ -0,0 +1,40 @@
+package metatrader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// jsonDecoder reads newline-delimited JSON messages
+// Lines are limited with MaxJSONMsgSize, so the client can not exhaust server memory
+type jsonDecoder struct {
+	r *bufio.Reader
+}
+
+func newJSONDecoder(r io.Reader) *jsonDecoder {
+	return &jsonDecoder{r: bufio.NewReaderSize(r, MaxJSONMsgSize)}
+}
+
+// Decode next non-empty line into e
+func (d *jsonDecoder) Decode(e interface{}) error {
+	for {
+		line, err := d.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return &MsgSizeError{Max: MaxJSONMsgSize}
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// The last line may come without a newline
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return json.Unmarshal(line, e)
+	}
+}
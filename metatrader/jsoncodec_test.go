@@ -0,0 +1,109 @@
+package metatrader
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// jsonClient talks to the Factory over newline-delimited JSON
+type jsonClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newJSONClient(t *testing.T) (*Factory, *jsonClient) {
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	server, client := net.Pipe()
+	go mt.HandleJSON(server)
+	return mt, &jsonClient{t: t, conn: client, r: bufio.NewReader(client)}
+}
+
+// send raw line and read the response
+func (c *jsonClient) send(line string) ResponseMsg {
+	c.conn.SetDeadline(time.Now().Add(TestTimeoutSeconds))
+
+	// Pipe writes block until the server reads, so do not wait for it
+	go c.conn.Write([]byte(line))
+
+	data, err := c.r.ReadString('\n')
+	require.NoError(c.t, err)
+	var resp ResponseMsg
+	require.NoError(c.t, json.Unmarshal([]byte(data), &resp))
+	return resp
+}
+
+func TestJSONRegisterUpdate(t *testing.T) {
+	println("TestJSONRegisterUpdate started")
+	mt, c := newJSONClient(t)
+	defer c.conn.Close()
+
+	resp := c.send(`{"page":"test","clientversion":"` + ProtocolVersion + `","updatefreq":"second","balance":"10"}` + "\n")
+	assert.Empty(t, resp.Error)
+	assert.Empty(t, resp.Message)
+
+	// Empty lines are skipped
+	resp = c.send("\n\n" + `{"balance":"100","orders":{"123":{"symbol":"EURUSD","type":"1"}}}` + "\n")
+	assert.Empty(t, resp.Error)
+
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "100", acc.Balance.String())
+		assert.Equal(t, "EURUSD", acc.Orders["123"].Symbol)
+	}
+
+	resp = c.send(`{"heartbeat":true}` + "\n")
+	assert.Empty(t, resp.Error)
+}
+
+func TestJSONNotValid(t *testing.T) {
+	println("TestJSONNotValid started")
+	mt, c := newJSONClient(t)
+	defer c.conn.Close()
+
+	resp := c.send(`{"page":"test","updatefreq":"second","balance":"ten"}` + "\n")
+	assert.Contains(t, resp.Error, "Message is not valid")
+	assert.Nil(t, mt.PageExist("test"))
+
+	mt, c = newJSONClient(t)
+	defer c.conn.Close()
+
+	resp = c.send(`{"page":"test",` + "\n")
+	assert.Contains(t, resp.Error, "Failed to decode a message")
+	assert.Nil(t, mt.PageExist("test"))
+}
+
+func TestJSONTooLong(t *testing.T) {
+	println("TestJSONTooLong started")
+	mt, c := newJSONClient(t)
+	defer c.conn.Close()
+
+	resp := c.send(`{"page":"test","updatefreq":"second","name":"` + strings.Repeat("a", MaxJSONMsgSize) + `"}` + "\n")
+	assert.Contains(t, resp.Error, "Message exceeds")
+	assert.Nil(t, mt.PageExist("test"))
+}
+
+func TestJSONDecoder(t *testing.T) {
+	println("TestJSONDecoder started")
+	dec := newJSONDecoder(strings.NewReader("{\"page\":\"one\"}\r\n \n{\"page\":\"two\"}"))
+
+	var msg Message
+	require.NoError(t, dec.Decode(&msg))
+	assert.Equal(t, "one", msg.Page)
+
+	// The last line has no newline
+	msg = Message{}
+	require.NoError(t, dec.Decode(&msg))
+	assert.Equal(t, "two", msg.Page)
+
+	assert.Equal(t, io.EOF, dec.Decode(&msg))
+}
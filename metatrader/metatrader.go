@@ -1,8 +1,8 @@
 package metatrader
 
 import (
-	"errors"
-	"fmt"
+	"encoding/json"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -17,6 +17,8 @@ type OrderTicket string
 type Message struct {
 	Page          string    `json:"page,omitempty" example:"my-test-page"`
 	ClientVersion string    `json:"clientversion,omitempty" example:"1.0"`
+	Secret        string    `json:"secret,omitempty" example:"my-secret-key"`
+	Features      []string  `json:"features,omitempty" example:"heartbeat,deltaorders"`
 	Started       time.Time `json:"started,omitempty" example:"2021-01-06T09:12:54.031357064+03:00"`
 	Updated       time.Time `json:"updated,omitempty" example:"2021-01-06T09:12:54.031357064+03:00"`
 	UpdateFreq    string    `json:"updatefreq,omitempty" example:"minute"`
@@ -31,8 +33,12 @@ type Message struct {
 	MarginLevel   string    `json:"marginlevel,omitempty" example:"100.0"`
 	ProfitTotal   string    `json:"profittotal,omitempty" example:"0.0"`
 	OrdersCount   int       `json:"orderscount,omitempty" example:"3"`
+	// Heartbeat is sent instead of update when nothing has changed, other fields are ignored
+	Heartbeat bool `json:"heartbeat,omitempty"`
 	// Ticket is used as Order key
 	Orders map[OrderTicket]Order `json:"orders,omitempty"`
+	// Closed tickets, used instead of omitted orders if deltaorders feature is enabled
+	Closed []OrderTicket `json:"closed,omitempty"`
 }
 
 // Order represent one Metatrader order
@@ -54,7 +60,12 @@ type Order struct {
 // ResponseMsg is sending to MetaTrader
 type ResponseMsg struct {
 	Error   string `json:"error,omitempty" example:"Exceeded maximum orders number"`
+	Code    string `json:"code,omitempty" example:"wrong_secret"`
 	Message string `json:"message,omitempty" example:"New API version is available"`
+	// Features enabled for the connection, sent in reply to requested ones
+	Features []string `json:"features,omitempty" example:"heartbeat"`
+	// Details of the invalid_message error
+	Validation *ValidationError `json:"validation,omitempty"`
 }
 
 // MarshalJSON ...
@@ -62,229 +73,275 @@ func (t OrderTicket) MarshalJSON() ([]byte, error) {
 	return []byte(string(t)), nil
 }
 
+// UnmarshalJSON accepts both numbers and strings
+func (t *OrderTicket) UnmarshalJSON(data []byte) error {
+	var s string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*t = OrderTicket(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*t = OrderTicket(n)
+	return nil
+}
+
+// ValidationError describes the message field failed validation
+type ValidationError struct {
+	Field string `json:"field" example:"orders[325145411].symbol"`
+	Rule  string `json:"rule" example:"charset"`
+	Value string `json:"value" example:"<script>"`
+	text  string
+}
+
+func (e *ValidationError) Error() string {
+	return e.text
+}
+
+// Validation rules reported in ValidationError.Rule
+const (
+	RuleMaxLength = "maxlength" // value is too long
+	RuleCharset   = "charset"   // value contains forbidden characters
+	RuleMaxCount  = "maxcount"  // too many elements
+	RuleFormat    = "format"    // value can not be parsed
+	RuleEnum      = "enum"      // value is not one of known constants
+)
+
+// Offending values are cut in responses, the whole message may be sent as a value
+const maxReportedValue = 64
+
+func newValidationError(field, rule, value, text string) *ValidationError {
+	if len(value) > maxReportedValue {
+		value = value[:maxReportedValue] + "..."
+	}
+	return &ValidationError{Field: field, Rule: rule, Value: value, text: text}
+}
+
 // Validate incoming Message
+// Fields are checked in a fixed order, orders by ticket, so the same message always reports the same error
 func (t *Message) Validate() error {
 	if err := validPage(t.Page); err != nil {
 		return err
 	}
-	if err := validString(t.ClientVersion, "ClientVersion"); err != nil {
+	if err := validString(t.ClientVersion, "clientversion"); err != nil {
+		return err
+	}
+	if err := validSecret(t.Secret); err != nil {
 		return err
 	}
-	if err := validString(t.UpdateFreq, "UpdateFrequency"); err != nil {
+	if err := validString(t.UpdateFreq, "updatefreq"); err != nil {
 		return err
 	}
-	if err := validString(t.Name, "Name"); err != nil {
+	if err := validString(t.Name, "name"); err != nil {
 		return err
 	}
-	if err := validString(t.Login, "Login"); err != nil {
+	if err := validString(t.Login, "login"); err != nil {
 		return err
 	}
-	if err := validString(t.Server, "Server"); err != nil {
+	if err := validString(t.Server, "server"); err != nil {
 		return err
 	}
-	if err := validString(t.Company, "Company"); err != nil {
+	if err := validString(t.Company, "company"); err != nil {
 		return err
 	}
-	if err := validNumber(t.Balance, "Balance"); err != nil {
+	if err := validNumber(t.Balance, "balance"); err != nil {
 		return err
 	}
-	if err := validNumber(t.Equity, "Equity"); err != nil {
+	if err := validNumber(t.Equity, "equity"); err != nil {
 		return err
 	}
-	if err := validNumber(t.Margin, "Margin"); err != nil {
+	if err := validNumber(t.Margin, "margin"); err != nil {
 		return err
 	}
-	if err := validNumber(t.FreeMargin, "FreeMargin"); err != nil {
+	if err := validNumber(t.FreeMargin, "freemargin"); err != nil {
 		return err
 	}
-	if err := validNumber(t.MarginLevel, "MarginLevel"); err != nil {
+	if err := validNumber(t.MarginLevel, "marginlevel"); err != nil {
 		return err
 	}
-	if err := validNumber(t.ProfitTotal, "ProfitTotal"); err != nil {
+	if err := validNumber(t.ProfitTotal, "profittotal"); err != nil {
 		return err
 	}
+	if len(t.Features) > MaxFeatures {
+		return newValidationError("features", RuleMaxCount, strconv.Itoa(len(t.Features)),
+			"Exceeded maximum features number ("+strconv.Itoa(MaxFeatures)+")")
+	}
+	for i, v := range t.Features {
+		if err := validString(v, "features["+strconv.Itoa(i)+"]"); err != nil {
+			return err
+		}
+	}
+	if len(t.Closed) > MaxFreeOrders {
+		return newValidationError("closed", RuleMaxCount, strconv.Itoa(len(t.Closed)),
+			"Exceeded maximum closed orders number ("+strconv.Itoa(MaxFreeOrders)+")")
+	}
+	for i, v := range t.Closed {
+		if err := validTicket(string(v), "closed["+strconv.Itoa(i)+"]"); err != nil {
+			return err
+		}
+	}
 	if len(t.Orders) > MaxFreeOrders {
-		return errors.New("Exceeded maximum orders number (" + strconv.Itoa(MaxFreeOrders) + ")")
+		return errMaxOrders(len(t.Orders))
 	}
-	for k, v := range t.Orders {
-		if err := validNumber(string(k), "Ticket"); err != nil {
-			return nil
+
+	tickets := make([]string, 0, len(t.Orders))
+	for k := range t.Orders {
+		tickets = append(tickets, string(k))
+	}
+	sort.Strings(tickets)
+	for _, k := range tickets {
+		// Ticket is checked before it becomes a part of field path
+		if err := validTicket(k, "orders"); err != nil {
+			return err
 		}
-		if err := validString(v.Symbol, "Symbol"); err != nil {
-			return nil
+		v := t.Orders[OrderTicket(k)]
+		path := "orders[" + k + "]."
+		if err := validString(v.Symbol, path+"symbol"); err != nil {
+			return err
 		}
-		if err := validTime(v.TimeOpen, "TimeOpen"); err != nil {
-			return nil
+		if err := validTime(v.TimeOpen, path+"timeopen"); err != nil {
+			return err
 		}
-		if err := validNumber(v.Type, "Type"); err != nil {
-			return nil
+		if err := validOrderType(v.Type, path+"type"); err != nil {
+			return err
 		}
-		if err := validNumber(v.InitVolume, "Number"); err != nil {
-			return nil
+		if err := validNumber(v.InitVolume, path+"initvolume"); err != nil {
+			return err
 		}
-		if err := validNumber(v.CurVolume, "CurVolume"); err != nil {
-			return nil
+		if err := validNumber(v.CurVolume, path+"curvolume"); err != nil {
+			return err
 		}
-		if err := validNumber(v.PriceOpen, "PriceOpen"); err != nil {
-			return nil
+		if err := validNumber(v.PriceOpen, path+"priceopen"); err != nil {
+			return err
 		}
-		if err := validNumber(v.SL, "SL"); err != nil {
-			return nil
+		if err := validNumber(v.SL, path+"sl"); err != nil {
+			return err
 		}
-		if err := validNumber(v.TP, "TP"); err != nil {
-			return nil
+		if err := validNumber(v.TP, path+"tp"); err != nil {
+			return err
 		}
-		if err := validNumber(v.Swap, "Swap"); err != nil {
-			return nil
+		if err := validNumber(v.Swap, path+"swap"); err != nil {
+			return err
 		}
-		if err := validNumber(v.PriceSL, "PriceSl"); err != nil {
-			return nil
+		if err := validNumber(v.PriceSL, path+"pricesl"); err != nil {
+			return err
 		}
-		if err := validNumber(v.Profit, "Profit"); err != nil {
-			return nil
+		if err := validNumber(v.Profit, path+"profit"); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// errMaxOrders is reported for messages leading to more than MaxFreeOrders orders
+func errMaxOrders(cnt int) error {
+	return newValidationError("orders", RuleMaxCount, strconv.Itoa(cnt),
+		"Exceeded maximum orders number ("+strconv.Itoa(MaxFreeOrders)+")")
+}
+
 func validPage(bt string) error {
 	// Using simple lexer is faster than regexp's
 	// https://commandcenter.blogspot.com/2011/08/regular-expressions-in-lexing-and.html
 	if len(bt) > 32 {
-		return errors.New("'Page' is limited to 32 characters")
+		return newValidationError("page", RuleMaxLength, bt, "'page' is limited to 32 characters")
 	}
 
 	for _, b := range bt {
 		if (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || b == '_' || b == '-' {
 			continue
 		}
-		return errors.New("'Page' may only contain lowercase latin letters, digits and following symbols '_-'")
+		return newValidationError("page", RuleCharset, bt, "'page' may only contain lowercase latin letters, digits and following symbols '_-'")
 	}
 
 	return nil
 }
 
+// validSecret never reports the value, it may be almost correct secret
+func validSecret(bt string) error {
+	if len(bt) > 64 {
+		return newValidationError("secret", RuleMaxLength, "", "'secret' field is limited to 64 characters")
+	}
+
+	for _, b := range bt {
+		if b > ' ' && b <= '~' {
+			continue
+		}
+		return newValidationError("secret", RuleCharset, "", "'secret' field may only contain printable latin characters without spaces")
+	}
+	return nil
+}
+
 func validString(bt string, fn string) error {
 	if len(bt) > 32 {
-		return errors.New("'" + fn + "' field is limited to 32 characters")
+		return newValidationError(fn, RuleMaxLength, bt, "'"+fn+"' field is limited to 32 characters")
 	}
 
 	for _, b := range bt {
 		if (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || b == '-' || b == ' ' || b == '(' || b == ')' || b == '.' || b == ',' {
 			continue
 		}
-		return errors.New("'" + fn + "' field may only contain latin letters, digits and following symbols '_- ().,'")
+		return newValidationError(fn, RuleCharset, bt, "'"+fn+"' field may only contain latin letters, digits and following symbols '_- ().,'")
 	}
 	return nil
 }
 
 func validTime(bt string, fn string) error {
 	if len(bt) > 32 {
-		return errors.New("'" + fn + "' field is limited to 32 characters")
+		return newValidationError(fn, RuleMaxLength, bt, "'"+fn+"' field is limited to 32 characters")
 	}
 
 	for _, b := range bt {
 		if (b >= '0' && b <= '9') || b == ' ' || b == '.' || b == ',' || b == ':' {
 			continue
 		}
-		return errors.New("'" + fn + "' field may only contain digits and following symbols ' .,:'")
+		return newValidationError(fn, RuleCharset, bt, "'"+fn+"' field may only contain digits and following symbols ' .,:'")
 	}
 
 	return nil
 }
 
+// validNumber checks the value fits Decimal
 func validNumber(bt string, fn string) error {
 	if len(bt) > 32 {
-		return errors.New("'" + fn + "' field is limited to 32 characters")
+		return newValidationError(fn, RuleMaxLength, bt, "'"+fn+"' field is limited to 32 characters")
 	}
 
 	for _, b := range bt {
 		if (b >= '0' && b <= '9') || b == '.' || b == ',' || b == '-' {
 			continue
 		}
-		return errors.New("'" + fn + "' field may only contain digits and following symbols '.,-'")
+		return newValidationError(fn, RuleCharset, bt, "'"+fn+"' field may only contain digits and following symbols '.,-'")
 	}
 
+	if _, err := ParseDecimal(bt); err != nil {
+		return newValidationError(fn, RuleFormat, bt, "'"+fn+"' field is not a valid number: "+err.Error())
+	}
 	return nil
 }
 
-func (t Message) String() string {
-	var ret string
-	ret += fmt.Sprintf("{\"Page\":\"%s\",", string(t.Page))
-	ret += fmt.Sprintf("\"ClientVersion\":\"%s\",", string(t.ClientVersion))
-	ret += fmt.Sprintf("\"UpdateFreq\":\"%s\",", string(t.UpdateFreq))
-	ret += fmt.Sprintf("\"Name\":\"%s\",", string(t.Name))
-	ret += fmt.Sprintf("\"Login\":\"%s\",", string(t.Login))
-	ret += fmt.Sprintf("\"Server\":\"%s\",", string(t.Server))
-	ret += fmt.Sprintf("\"Company\":\"%s\",", string(t.Company))
-	ret += fmt.Sprintf("\"Balance\":\"%s\",", string(t.Balance))
-	ret += fmt.Sprintf("\"Equity\":\"%s\",", string(t.Equity))
-	ret += fmt.Sprintf("\"Margin\":\"%s\",", string(t.Margin))
-	ret += fmt.Sprintf("\"FreeMargin\":\"%s\",", string(t.FreeMargin))
-	ret += fmt.Sprintf("\"MarginLevel\":\"%s\",", string(t.MarginLevel))
-	ret += fmt.Sprintf("\"ProfitTotal\":\"%s\",", string(t.ProfitTotal))
-	ret += fmt.Sprintf("\"Orders\":[")
-
-	for _, v := range t.Orders {
-		ret += fmt.Sprint(v)
-	}
-
-	ret += "]"
-
-	return ret
-}
-
-// UpdateWith order a with data from order b
-func (a *Order) UpdateWith(b Order) {
-	if b.Symbol != "" {
-		a.Symbol = b.Symbol
-	}
-	if b.TimeOpen != "" {
-		a.TimeOpen = b.TimeOpen
-	}
-	if b.Type != "" {
-		a.Type = b.Type
-	}
-	if b.InitVolume != "" {
-		a.InitVolume = b.InitVolume
-	}
-	if b.CurVolume != "" {
-		a.CurVolume = b.CurVolume
-	}
-	if b.PriceOpen != "" {
-		a.PriceOpen = b.PriceOpen
-	}
-	if b.SL != "" {
-		a.SL = b.SL
-	}
-	if b.TP != "" {
-		a.TP = b.TP
-	}
-	if b.Swap != "" {
-		a.Swap = b.Swap
-	}
-	if b.PriceSL != "" {
-		a.PriceSL = b.PriceSL
+func validTicket(bt string, fn string) error {
+	if len(bt) > 32 {
+		return newValidationError(fn, RuleMaxLength, bt, "'"+fn+"' ticket is limited to 32 characters")
 	}
-	if b.Profit != "" {
-		a.Profit = b.Profit
+
+	for _, b := range bt {
+		if b >= '0' && b <= '9' {
+			continue
+		}
+		return newValidationError(fn, RuleCharset, bt, "'"+fn+"' ticket may only contain digits")
 	}
+	return nil
 }
 
-// String returns string representation
-func (a Order) String() string {
-	var ret string
-	ret += fmt.Sprintf("{\"Symbol\":\"%s\",", string(a.Symbol))
-	ret += fmt.Sprintf("\"TimeOpen\":\"%s\",", string(a.TimeOpen))
-	ret += fmt.Sprintf("\"Type\":\"%s\",", string(a.Type))
-	ret += fmt.Sprintf("\"InitVolume\":\"%s\",", string(a.InitVolume))
-	ret += fmt.Sprintf("\"CurVolume\":\"%s\",", string(a.CurVolume))
-	ret += fmt.Sprintf("\"PriceOpen\":\"%s\",", string(a.PriceOpen))
-	ret += fmt.Sprintf("\"SL\":\"%s\",", string(a.SL))
-	ret += fmt.Sprintf("\"TP\":\"%s\",", string(a.TP))
-	ret += fmt.Sprintf("\"Swap\":\"%s\",", string(a.Swap))
-	ret += fmt.Sprintf("\"PriceSL\":\"%s\",", string(a.PriceSL))
-	ret += fmt.Sprintf("\"Profit\":\"%s\"}", string(a.Profit))
-	return ret
+func validOrderType(bt string, fn string) error {
+	if _, err := ParseOrderType(bt); err != nil {
+		return newValidationError(fn, RuleEnum, bt, "'"+fn+"' field is not valid: "+err.Error())
+	}
+	return nil
 }
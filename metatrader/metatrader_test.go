@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -63,6 +64,117 @@ func TestMetatrader(t *testing.T) {
 	}
 }
 
+func TestValidateOrder(t *testing.T) {
+	println("TestValidateOrder started")
+	long := strings.Repeat("1", 33)
+	tests := []struct {
+		name  string
+		order Order
+		field string
+		rule  string
+		value string
+	}{
+		{"Valid", Order{Symbol: "EURUSD", TimeOpen: "2020.12.25 10:08:23", Type: "1", InitVolume: "0.1", CurVolume: "0.1",
+			PriceOpen: "1.1", SL: "1.0", TP: "1.2", Swap: "-0.1", PriceSL: "1,0", Profit: "-10.23"}, "", "", ""},
+		{"SymbolCharset", Order{Symbol: "<script>"}, "symbol", RuleCharset, "<script>"},
+		{"SymbolLength", Order{Symbol: long}, "symbol", RuleMaxLength, long},
+		{"TimeOpenCharset", Order{TimeOpen: "yesterday"}, "timeopen", RuleCharset, "yesterday"},
+		{"TimeOpenLength", Order{TimeOpen: long}, "timeopen", RuleMaxLength, long},
+		{"TypeName", Order{Type: "buy"}, "type", RuleEnum, "buy"},
+		{"TypeUnknown", Order{Type: "9"}, "type", RuleEnum, "9"},
+		{"TypeLength", Order{Type: long}, "type", RuleEnum, long},
+		{"InitVolumeCharset", Order{InitVolume: "1e3"}, "initvolume", RuleCharset, "1e3"},
+		{"InitVolumeLength", Order{InitVolume: long}, "initvolume", RuleMaxLength, long},
+		{"InitVolumeFormat", Order{InitVolume: "--,."}, "initvolume", RuleFormat, "--,."},
+		{"CurVolumeCharset", Order{CurVolume: "1e3"}, "curvolume", RuleCharset, "1e3"},
+		{"CurVolumeLength", Order{CurVolume: long}, "curvolume", RuleMaxLength, long},
+		{"CurVolumeFormat", Order{CurVolume: "1.2.3"}, "curvolume", RuleFormat, "1.2.3"},
+		{"PriceOpenCharset", Order{PriceOpen: "$1"}, "priceopen", RuleCharset, "$1"},
+		{"PriceOpenLength", Order{PriceOpen: long}, "priceopen", RuleMaxLength, long},
+		{"PriceOpenFormat", Order{PriceOpen: "1.2.3"}, "priceopen", RuleFormat, "1.2.3"},
+		{"SLCharset", Order{SL: "none"}, "sl", RuleCharset, "none"},
+		{"SLLength", Order{SL: long}, "sl", RuleMaxLength, long},
+		{"SLFormat", Order{SL: "1.2.3"}, "sl", RuleFormat, "1.2.3"},
+		{"TPCharset", Order{TP: "none"}, "tp", RuleCharset, "none"},
+		{"TPLength", Order{TP: long}, "tp", RuleMaxLength, long},
+		{"TPFormat", Order{TP: "1.2.3"}, "tp", RuleFormat, "1.2.3"},
+		{"SwapCharset", Order{Swap: "+1"}, "swap", RuleCharset, "+1"},
+		{"SwapLength", Order{Swap: long}, "swap", RuleMaxLength, long},
+		{"SwapFormat", Order{Swap: "1.2.3"}, "swap", RuleFormat, "1.2.3"},
+		{"PriceSLCharset", Order{PriceSL: "1 0"}, "pricesl", RuleCharset, "1 0"},
+		{"PriceSLLength", Order{PriceSL: long}, "pricesl", RuleMaxLength, long},
+		{"PriceSLFormat", Order{PriceSL: "1.2.3"}, "pricesl", RuleFormat, "1.2.3"},
+		{"ProfitCharset", Order{Profit: "10$"}, "profit", RuleCharset, "10$"},
+		{"ProfitLength", Order{Profit: long}, "profit", RuleMaxLength, long},
+		{"ProfitFormat", Order{Profit: "1.2.3"}, "profit", RuleFormat, "1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{Page: "page", Orders: map[OrderTicket]Order{"325145411": tt.order}}
+			err := msg.Validate()
+			if tt.field == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if ve, ok := err.(*ValidationError); assert.True(t, ok, "ValidationError expected, got %v", err) {
+				assert.Equal(t, "orders[325145411]."+tt.field, ve.Field)
+				assert.Equal(t, tt.rule, ve.Rule)
+				assert.Equal(t, tt.value, ve.Value)
+				assert.Contains(t, ve.Error(), "'orders[325145411]."+tt.field+"'")
+			}
+		})
+	}
+}
+
+func TestValidateTicket(t *testing.T) {
+	println("TestValidateTicket started")
+	tests := []struct {
+		ticket string
+		rule   string
+	}{
+		{"325145411", ""},
+		{"12ab", RuleCharset},
+		{"<script>", RuleCharset},
+		{strings.Repeat("1", 33), RuleMaxLength},
+	}
+
+	for _, tt := range tests {
+		msg := Message{Page: "page", Orders: map[OrderTicket]Order{OrderTicket(tt.ticket): {Symbol: "EURUSD"}}}
+		err := msg.Validate()
+		if tt.rule == "" {
+			assert.NoError(t, err, tt.ticket)
+			continue
+		}
+		if ve, ok := err.(*ValidationError); assert.True(t, ok, "ValidationError expected for %s, got %v", tt.ticket, err) {
+			assert.Equal(t, "orders", ve.Field)
+			assert.Equal(t, tt.rule, ve.Rule)
+			assert.Equal(t, tt.ticket, ve.Value)
+		}
+	}
+
+	// Invalid orders are reported in ticket order
+	msg := Message{Page: "page", Orders: map[OrderTicket]Order{"2": {Symbol: "$"}, "1": {Profit: "$"}, "3": {SL: "$"}}}
+	for i := 0; i < 10; i++ {
+		if ve, ok := msg.Validate().(*ValidationError); assert.True(t, ok) {
+			assert.Equal(t, "orders[1].profit", ve.Field)
+		}
+	}
+
+	// Long values are cut in response
+	msg = Message{Page: strings.Repeat("p", 100)}
+	if ve, ok := msg.Validate().(*ValidationError); assert.True(t, ok) {
+		assert.Equal(t, strings.Repeat("p", maxReportedValue)+"...", ve.Value)
+	}
+
+	// Secret is never reported
+	msg = Message{Page: "page", Secret: "my secret"}
+	if ve, ok := msg.Validate().(*ValidationError); assert.True(t, ok) {
+		assert.Equal(t, "secret", ve.Field)
+		assert.Empty(t, ve.Value)
+	}
+}
+
 func connection(t *testing.T) {
 	msg := new(Message)
 	err := dec.Decode(msg)
@@ -2,37 +2,112 @@ package metatrader
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
+// Viewer channels, account updates are sent to viewers by default
+const (
+	ChannelAccount = "account"
+	ChannelHistory = "history"
+	ChannelEvents  = "events"
+	ChannelDelta   = "delta"
+	ChannelStatus  = "status"
+)
+
+// Channels lists all channels viewer may subscribe to
+var Channels = []string{ChannelAccount, ChannelHistory, ChannelEvents, ChannelDelta, ChannelStatus}
+
+// Event wraps messages of channels other than account
+// Account updates are sent as is to keep old viewers working
+type Event struct {
+	Channel string      `json:"channel" example:"history"`
+	Data    interface{} `json:"data"`
+}
+
+// ViewerPolicy defines what to do with messages when the viewer queue is full
+type ViewerPolicy string
+
+// Viewer policies
+const (
+	// ViewerDropOldest drops the oldest queued message
+	ViewerDropOldest ViewerPolicy = "drop-oldest"
+	// ViewerConflate keeps only the latest account and status messages queued,
+	// the oldest message is dropped if the queue is still full
+	ViewerConflate ViewerPolicy = "conflate"
+	// ViewerDisconnect closes the viewer connection
+	ViewerDisconnect ViewerPolicy = "disconnect"
+)
+
+// MaxViewerQueue is the default number of messages queued per viewer
+const MaxViewerQueue = 16
+
+// Channels carrying the whole state, the latest message supersedes queued ones
+var conflatedChannels = map[string]bool{ChannelAccount: true, ChannelStatus: true}
+
+// ViewerStats counts messages slow viewers did not get in time
+type ViewerStats struct {
+	Viewers      int `json:"viewers" example:"1"`
+	Dropped      int `json:"dropped" example:"0"`
+	Conflated    int `json:"conflated" example:"0"`
+	Disconnected int `json:"disconnected" example:"0"`
+}
+
+// What happened to the message sent to viewer queue
+const (
+	viewerQueued = iota
+	viewerConflated
+	viewerDropped
+	viewerOverflow // the queue is full and the viewer should be disconnected
+)
+
+// viewUpdater sends queued messages to the viewer
+// The broker never waits for the viewer, slow viewers lose messages by the policy
 type viewUpdater struct {
-	ws         *websocket.Conn
-	dataChan   chan []byte
-	closeChan  chan bool
-	signalChan chan *websocket.Conn
+	viewer     Viewer
+	channels   map[string]bool
+	raw        bool // owner gets messages without redaction
+	size       int
+	policy     ViewerPolicy
+	queue      []*brokerMessage
+	mu         sync.Mutex
+	notify     chan struct{}
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	signalChan chan Viewer
+	epoch      int64
 	log        *zap.SugaredLogger
 }
 
 func (v *viewUpdater) run() {
 	go func() {
 		defer func() {
-			v.ws.Close()
-			v.log.Info("Viewer disconnected ", v.ws.RemoteAddr())
+			v.viewer.Close()
+			v.log.Info("Viewer disconnected ", v.viewer.ID())
 		}()
 		for {
 			select {
 			case <-v.closeChan:
 				return
-			case data := <-v.dataChan:
-				v.log.Debug("Viewer sent a message to websocket ", v.ws.RemoteAddr())
-				v.ws.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
-				err := v.ws.WriteMessage(websocket.TextMessage, data)
+			case <-v.notify:
+			}
+			for msg := v.next(); msg != nil; msg = v.next() {
+				v.log.Debug("Viewer sent a message to ", v.viewer.ID())
+				err := v.viewer.Send(ViewerMessage{
+					ID:      eventID(v.epoch, msg.seq),
+					Channel: msg.channel,
+					Data:    msg.payload(v.raw),
+				})
 				if err != nil {
 					// Let the Broker know we're finished
-					v.signalChan <- v.ws
+					select {
+					case v.signalChan <- v.viewer:
+					case <-v.closeChan:
+					}
 					return
 				}
 			}
@@ -40,37 +115,136 @@ func (v *viewUpdater) run() {
 	}()
 }
 
-// Send data to Updater
-func (v *viewUpdater) send(data []byte) {
-	v.dataChan <- data
+// wants the message of subscribed channel, if there is a variant for the viewer
+func (v *viewUpdater) wants(msg *brokerMessage) bool {
+	return v.channels[msg.channel] && msg.payload(v.raw) != nil
 }
 
+// next takes the oldest queued message, nil if the queue is empty
+func (v *viewUpdater) next() *brokerMessage {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.queue) == 0 {
+		return nil
+	}
+	msg := v.queue[0]
+	v.queue = v.queue[1:]
+	return msg
+}
+
+// Send data to Updater, never blocks
+func (v *viewUpdater) send(msg *brokerMessage) int {
+	v.mu.Lock()
+	ret := viewerQueued
+	if v.policy == ViewerConflate && conflatedChannels[msg.channel] {
+		kept := v.queue[:0]
+		for _, m := range v.queue {
+			if m.channel == msg.channel {
+				ret = viewerConflated
+				continue
+			}
+			kept = append(kept, m)
+		}
+		v.queue = kept
+	}
+	if len(v.queue) >= v.size {
+		if v.policy == ViewerDisconnect {
+			v.mu.Unlock()
+			return viewerOverflow
+		}
+		v.queue = v.queue[1:]
+		ret = viewerDropped
+	}
+	v.queue = append(v.queue, msg)
+	v.mu.Unlock()
+
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+	return ret
+}
+
+// close the viewer, safe to call more than once
+// Viewer is closed at once to stop the message being sent, without waiting for it
 func (v *viewUpdater) close() {
-	v.closeChan <- true
+	v.closeOnce.Do(func() {
+		close(v.closeChan)
+		go v.viewer.Close()
+	})
+}
+
+// MaxReplayMessages is the number of the last broadcasted messages kept to resume viewers
+const MaxReplayMessages = 100
+
+// Message broadcasted to viewers subscribed to the channel, or sent directly to one viewer
+// Direct messages get the sequence number of the last broadcasted one
+// Redacted page messages have raw variant for the owner, nil data is not sent to other viewers
+type brokerMessage struct {
+	channel string
+	data    []byte
+	raw     []byte
+	seq     uint64
+	to      Viewer // direct message recipient, nil for broadcast
+}
+
+// payload of the message for the viewer, owner gets data if there is no raw variant
+func (m *brokerMessage) payload(raw bool) []byte {
+	if raw && m.raw != nil {
+		return m.raw
+	}
+	return m.data
+}
+
+// New viewer with its channels
+// Viewer resumes after the message if since is set and the message is still kept
+type viewerSubscription struct {
+	viewer   Viewer
+	channels map[string]bool
+	raw      bool
+	since    string
+	resumed  bool
+	result   chan error
+}
+
+// eventID is unique across broker restarts, so a viewer never resumes from another broker messages
+func eventID(epoch int64, seq uint64) string {
+	return strconv.FormatInt(epoch, 36) + "-" + strconv.FormatUint(seq, 10)
 }
 
 // BrokerFactory manage broadcasting of messages
 type BrokerFactory struct {
-	dataChan   chan []byte
-	customChan chan *customMessage
-	closeChan  chan bool
-	addChan    chan *websocket.Conn
-	removeChan chan *websocket.Conn
-	updaters   map[*websocket.Conn]*viewUpdater
-	signalChan chan *websocket.Conn
+	dataChan   chan *brokerMessage // direct messages go along with broadcasts to keep them ordered
+	closeChan  chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+	addChan    chan *viewerSubscription
+	removeChan chan Viewer
+	updaters   map[Viewer]*viewUpdater
+	signalChan chan Viewer
+	queueSize  int
+	policy     ViewerPolicy
+	epoch      int64
+	seq        uint64
+	replay     []*brokerMessage
+	stats      ViewerStats
+	statsMu    sync.Mutex
 	log        *zap.SugaredLogger
 }
 
 // NewBroker ...
 func NewBroker(log *zap.SugaredLogger) *BrokerFactory {
 	br := BrokerFactory{
-		updaters:   make(map[*websocket.Conn]*viewUpdater),
-		dataChan:   make(chan []byte, 5),
-		customChan: make(chan *customMessage, 5),
-		closeChan:  make(chan bool, 1),
-		signalChan: make(chan *websocket.Conn, 5),
-		addChan:    make(chan *websocket.Conn, 5),
-		removeChan: make(chan *websocket.Conn, 5),
+		updaters:   make(map[Viewer]*viewUpdater),
+		dataChan:   make(chan *brokerMessage, 5),
+		closeChan:  make(chan struct{}),
+		done:       make(chan struct{}),
+		signalChan: make(chan Viewer, 5),
+		addChan:    make(chan *viewerSubscription, 5),
+		removeChan: make(chan Viewer, 5),
+		queueSize:  MaxViewerQueue,
+		policy:     ViewerConflate,
+		epoch:      time.Now().UnixNano(),
 		log:        log,
 	}
 
@@ -82,6 +256,7 @@ func NewBroker(log *zap.SugaredLogger) *BrokerFactory {
 func (b *BrokerFactory) run() {
 	go func() {
 		defer func() {
+			close(b.done)
 			b.log.Debug("Broker is closed")
 		}()
 		for {
@@ -92,78 +267,227 @@ func (b *BrokerFactory) run() {
 				}
 				b.log.Debug("Broker just closed all the Viewers")
 				return
-			case c := <-b.customChan: // Send a message to one particular viewer
-				b.updaters[c.ws].send(c.data)
-				b.log.Debug("Broker sent particular message to viewer ", c.ws.RemoteAddr())
-			case data := <-b.dataChan: // Broadcast message to all viewers
+			case msg := <-b.dataChan:
+				if msg.to != nil { // Send a message to one particular viewer
+					if upd, ok := b.updaters[msg.to]; ok {
+						msg.seq = b.seq
+						b.deliver(upd, msg)
+						b.log.Debug("Broker sent particular message to viewer ", msg.to.ID())
+					}
+					continue
+				}
+				// Broadcast message to all viewers subscribed to the channel
+				b.seq++
+				msg.seq = b.seq
+				b.replay = append(b.replay, msg)
+				if len(b.replay) > MaxReplayMessages {
+					b.replay = b.replay[1:]
+				}
 				for _, upd := range b.updaters {
-					upd.send(data)
+					if upd.wants(msg) {
+						b.deliver(upd, msg)
+					}
+				}
+				b.log.Debug("Broker broadcasted a message to ", msg.channel)
+			case sub := <-b.addChan: // Add new Viewer
+				viewer := sub.viewer
+				if _, ok := b.updaters[viewer]; ok {
+					sub.result <- errors.New("Failed to add a Viewer: already exists")
+					continue
 				}
-				b.log.Debug("Broker broadcasted a message")
-			case ws := <-b.addChan: // Add new Viewer
-				b.updaters[ws] = &viewUpdater{
-					ws:         ws,
+				b.updaters[viewer] = &viewUpdater{
+					viewer:     viewer,
+					channels:   sub.channels,
+					raw:        sub.raw,
+					size:       b.queueSize,
+					policy:     b.policy,
 					log:        b.log,
-					dataChan:   make(chan []byte, 5),
-					closeChan:  make(chan bool),
+					notify:     make(chan struct{}, 1),
+					closeChan:  make(chan struct{}),
 					signalChan: b.signalChan,
+					epoch:      b.epoch,
+				}
+				if sub.since != "" {
+					sub.resumed = b.resume(b.updaters[viewer], sub.since)
 				}
-				b.updaters[ws].run()
-				b.log.Debug("Broker added new viewer to pool ", ws.RemoteAddr)
-			case ws := <-b.removeChan: // Remove Viewer
-				if _, ok := b.updaters[ws]; ok {
-					b.updaters[ws].close()
-					delete(b.updaters, ws)
-					b.log.Debug("Broker removed viewer from pool ", ws.RemoteAddr)
+				b.updaters[viewer].run()
+				b.countViewers()
+				sub.result <- nil
+				b.log.Debug("Broker added new viewer to pool ", viewer.ID())
+			case viewer := <-b.removeChan: // Remove Viewer
+				if _, ok := b.updaters[viewer]; ok {
+					b.updaters[viewer].close()
+					delete(b.updaters, viewer)
+					b.countViewers()
+					b.log.Debug("Broker removed viewer from pool ", viewer.ID())
 				}
 			case closedUpdater := <-b.signalChan: // Viewer got a Send error and sould be removed
 				delete(b.updaters, closedUpdater)
-				b.log.Debug("Broker got Closed signal from viewer, and removed it from pool ", closedUpdater)
+				b.countViewers()
+				b.log.Debug("Broker got Closed signal from viewer, and removed it from pool ", closedUpdater.ID())
 			}
 		}
 	}()
 }
 
+// deliver the message to viewer queue, disconnect the viewer if the policy says so
+func (b *BrokerFactory) deliver(upd *viewUpdater, msg *brokerMessage) {
+	res := upd.send(msg)
+	if res == viewerQueued {
+		return
+	}
+
+	b.statsMu.Lock()
+	switch res {
+	case viewerConflated:
+		b.stats.Conflated++
+	case viewerDropped:
+		b.stats.Dropped++
+	case viewerOverflow:
+		b.stats.Dropped++
+		b.stats.Disconnected++
+	}
+	b.statsMu.Unlock()
+
+	if res == viewerOverflow {
+		upd.close()
+		delete(b.updaters, upd.viewer)
+		b.countViewers()
+		b.log.Info("Slow viewer disconnected ", upd.viewer.ID())
+	}
+}
+
+// resume queues messages broadcasted after the one with the ID
+// Returns false if the ID is of another broker, the messages are not kept already
+// or they don't fit the viewer queue, then the viewer should get the current state
+func (b *BrokerFactory) resume(upd *viewUpdater, since string) bool {
+	i := strings.LastIndexByte(since, '-')
+	if i < 0 || since[:i] != strconv.FormatInt(b.epoch, 36) {
+		return false
+	}
+	seq, err := strconv.ParseUint(since[i+1:], 10, 64)
+	if err != nil || seq > b.seq {
+		return false
+	}
+	if seq < b.seq && (len(b.replay) == 0 || b.replay[0].seq > seq+1) {
+		return false
+	}
+
+	var missed []*brokerMessage
+	for _, msg := range b.replay {
+		if msg.seq > seq && upd.wants(msg) {
+			missed = append(missed, msg)
+		}
+	}
+	if len(missed) > upd.size {
+		return false
+	}
+	for _, msg := range missed {
+		upd.send(msg)
+	}
+	return true
+}
+
+// countViewers updates the number of viewers in stats
+func (b *BrokerFactory) countViewers() {
+	b.statsMu.Lock()
+	b.stats.Viewers = len(b.updaters)
+	b.statsMu.Unlock()
+}
+
+// Stats returns the number of viewers and messages they missed
+func (b *BrokerFactory) Stats() ViewerStats {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	return b.stats
+}
+
+// setViewerQueue applies to viewers added later, so it's set before the account is shared
+func (b *BrokerFactory) setViewerQueue(size int, policy ViewerPolicy) {
+	b.queueSize = size
+	b.policy = policy
+}
+
 // AddViewer to viewers pool, also create processing goroutine
-func (b *BrokerFactory) AddViewer(viewer *websocket.Conn) error {
-	if _, ok := b.updaters[viewer]; !ok {
-		b.addChan <- viewer
-		return nil
+// Viewer is subscribed to the account channel if no channels are given
+func (b *BrokerFactory) AddViewer(viewer Viewer, channels ...string) error {
+	_, err := b.addViewerSince(viewer, "", false, channels...)
+	return err
+}
+
+// AddRawViewer adds the viewer getting messages without redaction, it's the page owner
+func (b *BrokerFactory) AddRawViewer(viewer Viewer, channels ...string) error {
+	_, err := b.addViewerSince(viewer, "", true, channels...)
+	return err
+}
+
+// addViewerSince adds the viewer and queues messages it missed after the ID
+// Returns false if it can't be resumed, so the viewer should get the current state
+func (b *BrokerFactory) addViewerSince(viewer Viewer, since string, raw bool, channels ...string) (bool, error) {
+	if len(channels) == 0 {
+		channels = []string{ChannelAccount}
+	}
+	sub := &viewerSubscription{viewer: viewer, channels: make(map[string]bool), raw: raw, since: since, result: make(chan error, 1)}
+	for _, ch := range channels {
+		sub.channels[ch] = true
 	}
+	b.addChan <- sub
 
-	return errors.New("Failed to add a Viewer: already exists")
+	// Messages sent after AddViewer returns reach the viewer
+	select {
+	case err := <-sub.result:
+		return sub.resumed, err
+	case <-b.done:
+		return false, errors.New("Failed to add a Viewer: broker is closed")
+	}
 }
 
-// RemoveViewer from viewers pool
-func (b *BrokerFactory) RemoveViewer(viewer *websocket.Conn) {
-	b.removeChan <- viewer
+// RemoveViewer from viewers pool, does nothing if the broker is stopped
+func (b *BrokerFactory) RemoveViewer(viewer Viewer) {
+	select {
+	case b.removeChan <- viewer:
+	case <-b.done:
+	}
 }
 
 // SendMessage to Broker Manager (and further for all connected Viewers)
 func (b *BrokerFactory) SendMessage(data []byte) {
-	b.dataChan <- data
+	b.Publish(ChannelAccount, data)
+}
+
+// Publish the message to viewers subscribed to the channel
+func (b *BrokerFactory) Publish(channel string, data []byte) {
+	b.publish(channel, data, nil)
+}
+
+// publish the message with raw variant for owners, they get data if raw is nil
+// Nothing is sent if the broker is stopped
+func (b *BrokerFactory) publish(channel string, data, raw []byte) {
+	select {
+	case b.dataChan <- &brokerMessage{channel: channel, data: data, raw: raw}:
+	case <-b.done:
+	}
 }
 
 // ViewersNumber for testing purposes
 func (b *BrokerFactory) ViewersNumber() int {
-	return len(b.updaters)
+	return b.Stats().Viewers
 }
 
-// Send message to one particular Viewer
-type customMessage struct {
-	ws   *websocket.Conn
-	data []byte
+// SendMessageToViewer sends a direct account channel message to one particular viewer
+func (b *BrokerFactory) SendMessageToViewer(viewer Viewer, data []byte) {
+	b.sendToViewer(viewer, ChannelAccount, data, nil)
 }
 
-// SendMessageToViewer sends a direct message to one particular viewer
-func (b *BrokerFactory) SendMessageToViewer(ws *websocket.Conn, data []byte) {
-	b.customChan <- &customMessage{
-		ws:   ws,
-		data: data,
+// sendToViewer queues the message after the ones published before, nothing is sent if the broker is stopped
+func (b *BrokerFactory) sendToViewer(viewer Viewer, channel string, data, raw []byte) {
+	select {
+	case b.dataChan <- &brokerMessage{channel: channel, data: data, raw: raw, to: viewer}:
+	case <-b.done:
 	}
 }
 
-// Stop the broker
+// Stop the broker, it may be called more than once
 func (b *BrokerFactory) Stop() {
-	b.closeChan <- true
+	b.stopOnce.Do(func() { close(b.closeChan) })
 }
@@ -2,14 +2,12 @@ package metatrader
 
 import (
 	"errors"
-	"log"
-	"net/http"
-	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -19,8 +17,6 @@ import (
 type brokerTestSuite struct {
 	suite.Suite
 	br          *BrokerFactory
-	ws          *websocket.Conn
-	testServer  *httptest.Server
 	zapRecorder *observer.ObservedLogs
 	zapObserver *zap.Logger
 }
@@ -29,26 +25,15 @@ func TestBroker(t *testing.T) {
 	suite.Run(t, new(brokerTestSuite))
 }
 
-func (b *brokerTestSuite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("upgrade:", err)
-		return
-	}
-	b.ws = ws
-}
-
 func (b *brokerTestSuite) SetupTest() {
 	core, recorder := observer.New(zapcore.DebugLevel)
 	b.zapRecorder = recorder
 	b.zapObserver = zap.New(core)
 	b.br = NewBroker(b.zapObserver.Sugar())
-	b.testServer = httptest.NewServer(b)
 }
 
 func (b *brokerTestSuite) TearDownTest() {
-	b.testServer.Close()
+	b.br.Stop()
 
 	println("*** Recorded logs ***")
 	for _, log := range b.zapRecorder.All() {
@@ -60,43 +45,37 @@ func (b *brokerTestSuite) TearDownTest() {
 func (b *brokerTestSuite) TestAddRemoveViewer() {
 	println("TestAddViewer started")
 
-	srvWs, _, err := b.makeClient()
-	if b.NoError(err) {
-		b.br.AddViewer(srvWs)
-		b.NoError(b.waitForLogMessage("new viewer"))
-		b.Equal(1, b.br.ViewersNumber())
+	viewer := NewChannelViewer("viewer", 1)
+	b.NoError(b.br.AddViewer(viewer))
+	b.NoError(b.waitForLogMessage("new viewer"))
+	b.Equal(1, b.br.ViewersNumber())
 
-		b.br.RemoveViewer(srvWs)
-		b.NoError(b.waitForLogMessage("Viewer disconnected"))
-		b.Equal(0, b.br.ViewersNumber())
-	}
+	b.br.RemoveViewer(viewer)
+	b.NoError(b.waitForLogMessage("Viewer disconnected"))
+	b.Equal(0, b.br.ViewersNumber())
+	b.Eventually(func() bool { return isClosed(viewer) }, TestTimeoutSeconds, time.Millisecond)
 }
 
 func (b *brokerTestSuite) TestSameViewer() {
 	println("TestSameViewer started")
 
-	srvWs, _, err := b.makeClient()
-	if b.NoError(err) {
-		b.NoError(b.br.AddViewer(srvWs))
-		b.NoError(b.waitForLogMessage("new viewer"))
-		b.Equal(1, b.br.ViewersNumber())
+	viewer := NewChannelViewer("viewer", 1)
+	b.NoError(b.br.AddViewer(viewer))
+	b.NoError(b.waitForLogMessage("new viewer"))
+	b.Equal(1, b.br.ViewersNumber())
 
-		b.Error(b.br.AddViewer(srvWs))
-		b.Equal(1, b.br.ViewersNumber())
-	}
+	b.Error(b.br.AddViewer(viewer))
+	b.Equal(1, b.br.ViewersNumber())
 }
 
 func (b *brokerTestSuite) TestViewersNumber() {
 	println("Test1KViewers started")
 
 	cnt := 100
-	srv := make([]*websocket.Conn, cnt)
+	viewers := make([]*ChannelViewer, cnt)
 	for i := 0; i < cnt; i++ {
-		srvconn, _, err := b.makeClient()
-		if b.NoError(err) {
-			b.NoError(b.br.AddViewer(srvconn))
-			srv[i] = srvconn
-		}
+		viewers[i] = NewChannelViewer(strconv.Itoa(i), 1)
+		b.NoError(b.br.AddViewer(viewers[i]))
 	}
 	// Wait Broker to complete
 	b.NoError(b.waitForCountLogMessages("new viewer", cnt))
@@ -104,7 +83,7 @@ func (b *brokerTestSuite) TestViewersNumber() {
 
 	// Remove all
 	for i := 0; i < cnt; i++ {
-		b.br.RemoveViewer(srv[i])
+		b.br.RemoveViewer(viewers[i])
 	}
 	b.NoError(b.waitForCountLogMessages("Viewer disconnected", cnt))
 	b.Equal(0, b.br.ViewersNumber())
@@ -114,36 +93,30 @@ func (b *brokerTestSuite) TestViewersNumber() {
 }
 
 func (b *brokerTestSuite) TestDirectMessage() {
-	println("TestBroadcast started")
+	println("TestDirectMessage started")
 
 	cnt := 30
-	srv := make([]*websocket.Conn, cnt)
-	cli := make([]*websocket.Conn, cnt)
+	viewers := make([]*ChannelViewer, cnt)
 	for i := 0; i < cnt; i++ {
-		srvconn, cliconn, err := b.makeClient()
-		if b.NoError(err) {
-			b.NoError(b.br.AddViewer(srvconn))
-			srv[i] = srvconn
-			cli[i] = cliconn
-		}
+		viewers[i] = NewChannelViewer(strconv.Itoa(i), 1)
+		b.NoError(b.br.AddViewer(viewers[i]))
 	}
 	// Wait Broker to complete
 	b.NoError(b.waitForCountLogMessages("new viewer", cnt))
 	b.Equal(cnt, b.br.ViewersNumber())
 
 	readerNum := 22
-	b.br.SendMessageToViewer(srv[readerNum], []byte("test"))
+	b.br.SendMessageToViewer(viewers[readerNum], []byte("test"))
 	b.NoError(b.waitForLogMessage("particular message"))
 
 	for i := 0; i < cnt; i++ {
-		cli[i].SetReadDeadline(time.Now().Add(10 * time.Millisecond))
-		_, data, err := cli[i].ReadMessage()
-		if i == readerNum {
-			if b.NoError(err) {
-				b.Equal("test", string(data))
-			}
-		} else {
-			b.Error(err)
+		select {
+		case msg := <-viewers[i].Messages():
+			b.Equal(readerNum, i)
+			b.Equal("test", string(msg.Data))
+			b.Equal(ChannelAccount, msg.Channel)
+		case <-time.After(10 * time.Millisecond):
+			b.NotEqual(readerNum, i)
 		}
 	}
 
@@ -151,19 +124,42 @@ func (b *brokerTestSuite) TestDirectMessage() {
 	b.zapRecorder.TakeAll()
 }
 
+func (b *brokerTestSuite) TestDirectMessageOrder() {
+	println("TestDirectMessageOrder started")
+
+	viewer := NewChannelViewer("viewer", 100)
+	b.NoError(b.br.AddViewer(viewer, ChannelDelta))
+
+	// Direct message is delivered after the ones published before it
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 4; i++ {
+			b.br.Publish(ChannelDelta, []byte("patch"))
+		}
+		b.br.sendToViewer(viewer, ChannelDelta, []byte("snapshot"), nil)
+		for i := 0; i < 5; i++ {
+			select {
+			case msg := <-viewer.Messages():
+				if i < 4 {
+					b.Equal("patch", string(msg.Data))
+				} else {
+					b.Equal("snapshot", string(msg.Data))
+				}
+			case <-time.After(TestTimeoutSeconds):
+				b.FailNow("Message is not received")
+			}
+		}
+	}
+	b.zapRecorder.TakeAll()
+}
+
 func (b *brokerTestSuite) TestBroadcast() {
 	println("TestBroadcast started")
 
 	cnt := 100
-	srv := make([]*websocket.Conn, cnt)
-	cli := make([]*websocket.Conn, cnt)
+	viewers := make([]*ChannelViewer, cnt)
 	for i := 0; i < cnt; i++ {
-		srvconn, cliconn, err := b.makeClient()
-		if b.NoError(err) {
-			b.NoError(b.br.AddViewer(srvconn))
-			srv[i] = srvconn
-			cli[i] = cliconn
-		}
+		viewers[i] = NewChannelViewer(strconv.Itoa(i), 1)
+		b.NoError(b.br.AddViewer(viewers[i]))
 	}
 	// Wait Broker to complete
 	b.NoError(b.waitForCountLogMessages("new viewer", cnt))
@@ -173,11 +169,12 @@ func (b *brokerTestSuite) TestBroadcast() {
 	b.br.SendMessage([]byte("test"))
 
 	for i := 0; i < cnt; i++ {
-		_, data, err := cli[i].ReadMessage()
-		if b.NoError(err) {
-			b.Equal("test", string(data))
-		} else {
-			return
+		select {
+		case msg := <-viewers[i].Messages():
+			b.Equal("test", string(msg.Data))
+			b.NotEmpty(msg.ID)
+		case <-time.After(TestTimeoutSeconds):
+			b.FailNow("Message is not received")
 		}
 	}
 
@@ -187,18 +184,162 @@ func (b *brokerTestSuite) TestBroadcast() {
 
 func (b *brokerTestSuite) TestStop() {
 	println("TestStop started")
+	viewer := NewChannelViewer("viewer", 1)
+	b.NoError(b.br.AddViewer(viewer))
 	b.br.Stop()
 	b.NoError(b.waitForLogMessage("Broker just closed all the Viewers"))
 	b.NoError(b.waitForLogMessage("Broker is closed"))
+	b.Eventually(func() bool { return isClosed(viewer) }, TestTimeoutSeconds, time.Millisecond)
+
+	// Late messages do not block when the buffer is full
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			b.br.Publish(ChannelAccount, []byte("test"))
+			b.br.SendMessageToViewer(viewer, []byte("test"))
+		}
+		b.br.Stop()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(TestTimeoutSeconds):
+		b.Fail("Stopped broker blocks senders")
+	}
+}
+
+func (b *brokerTestSuite) TestSlowViewerDropOldest() {
+	println("TestSlowViewerDropOldest started")
+	b.br.setViewerQueue(4, ViewerDropOldest)
+
+	slow, fast := newTestViewer(true), newTestViewer(false)
+	b.NoError(b.br.AddViewer(slow))
+	b.NoError(b.br.AddViewer(fast))
+
+	// The stalled viewer does not block broadcasting
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			b.br.SendMessage([]byte(strconv.Itoa(i)))
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(TestTimeoutSeconds):
+		b.FailNow("Broker is blocked by slow viewer")
+	}
+
+	b.Eventually(func() bool { return fast.last() == "99" }, TestTimeoutSeconds, time.Millisecond)
+	b.Eventually(func() bool { return b.br.Stats().Dropped >= 100-4-1 }, TestTimeoutSeconds, time.Millisecond)
+
+	// The newest messages are kept
+	slow.release()
+	b.Eventually(func() bool { return slow.last() == "99" }, TestTimeoutSeconds, time.Millisecond)
+	b.LessOrEqual(len(slow.messages()), 4+1)
+	b.Equal(2, b.br.Stats().Viewers)
+	b.Equal(0, b.br.Stats().Disconnected)
+}
+
+func (b *brokerTestSuite) TestSlowViewerConflate() {
+	println("TestSlowViewerConflate started")
+	b.br.setViewerQueue(4, ViewerConflate)
+
+	slow := newTestViewer(true)
+	b.NoError(b.br.AddViewer(slow, ChannelAccount, ChannelHistory))
+	for i := 0; i < 10; i++ {
+		b.br.SendMessage([]byte(strconv.Itoa(i)))
+		if i == 5 {
+			b.br.Publish(ChannelHistory, []byte("history"))
+		}
+	}
+	b.Eventually(func() bool { return b.br.Stats().Conflated >= 8 }, TestTimeoutSeconds, time.Millisecond)
+
+	// Only the latest account snapshot is left next to history
+	slow.release()
+	b.Eventually(func() bool { return slow.last() == "9" }, TestTimeoutSeconds, time.Millisecond)
+	msgs := slow.messages()
+	b.Contains(msgs, "history")
+	b.LessOrEqual(len(msgs), 3)
+	b.Equal(0, b.br.Stats().Dropped)
+}
+
+func (b *brokerTestSuite) TestSlowViewerDisconnect() {
+	println("TestSlowViewerDisconnect started")
+	b.br.setViewerQueue(4, ViewerDisconnect)
+
+	slow := newTestViewer(true)
+	b.NoError(b.br.AddViewer(slow))
+	for i := 0; i < 10; i++ {
+		b.br.SendMessage([]byte(strconv.Itoa(i)))
+	}
+
+	b.NoError(b.waitForLogMessage("Slow viewer disconnected"))
+	b.Eventually(func() bool { return isClosed(slow.ChannelViewer) }, TestTimeoutSeconds, time.Millisecond)
+	b.Eventually(func() bool { return b.br.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+	st := b.br.Stats()
+	b.Equal(1, st.Disconnected)
+	b.Equal(1, st.Dropped)
+}
+
+// testViewer is the channel viewer with a reader collecting its messages
+// Stalled one is not read until released
+type testViewer struct {
+	*ChannelViewer
+	msgs    []string
+	unblock chan struct{}
+	sync.Mutex
+}
+
+func newTestViewer(stalled bool) *testViewer {
+	v := &testViewer{ChannelViewer: NewChannelViewer("test", 0), unblock: make(chan struct{})}
+	if !stalled {
+		close(v.unblock)
+	}
+	go func() {
+		select {
+		case <-v.unblock:
+		case <-v.Done():
+			return
+		}
+		for {
+			select {
+			case msg := <-v.Messages():
+				v.Lock()
+				v.msgs = append(v.msgs, string(msg.Data))
+				v.Unlock()
+			case <-v.Done():
+				return
+			}
+		}
+	}()
+	return v
+}
+
+func (v *testViewer) release() { close(v.unblock) }
+
+func (v *testViewer) messages() []string {
+	v.Lock()
+	defer v.Unlock()
+	return append([]string(nil), v.msgs...)
+}
+
+func (v *testViewer) last() string {
+	v.Lock()
+	defer v.Unlock()
+	if len(v.msgs) == 0 {
+		return ""
+	}
+	return v.msgs[len(v.msgs)-1]
 }
 
-func (b *brokerTestSuite) makeClient() (server, client *websocket.Conn, err error) {
-	wsURL := strings.Replace(b.testServer.URL, "http://", "ws://", 1)
-	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if b.NoError(err) {
-		return b.ws, ws, nil
+func isClosed(v *ChannelViewer) bool {
+	select {
+	case <-v.Done():
+		return true
+	default:
+		return false
 	}
-	return nil, nil, err
 }
 
 func (b *brokerTestSuite) waitForCountLogMessages(msg string, count int) error {
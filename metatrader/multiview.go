@@ -0,0 +1,267 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Commands of multi-page viewers, resync of delta channel needs the page too
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandList        = "list"
+)
+
+// MaxSubscriptions is the default number of pages one connection may subscribe to
+const MaxSubscriptions = 50
+
+// PageCommand is sent by multi-page viewers
+type PageCommand struct {
+	Command  string   `json:"command" example:"subscribe"`
+	Page     string   `json:"page,omitempty" example:"my-test-page"`
+	Channels []string `json:"channels,omitempty" example:"account,history"`
+	Token    string   `json:"token,omitempty" example:""` // viewer token of private page
+}
+
+// PageCommandResult answers the command
+// The subscription closed by server is reported as unsubscribe result with error
+type PageCommandResult struct {
+	Command string   `json:"command" example:"subscribe"`
+	Page    string   `json:"page,omitempty" example:"my-test-page"`
+	Pages   []string `json:"pages,omitempty" example:"my-test-page"`
+	Error   string   `json:"error,omitempty" example:""`
+}
+
+// PageMessage wraps page messages sent to multi-page viewers
+type PageMessage struct {
+	Page string          `json:"page" example:"my-test-page"`
+	Data json.RawMessage `json:"data" swaggertype:"object"`
+}
+
+// multiViewer is a connection subscribed to several pages
+// Brokers of the pages write to it concurrently, so writes are serialized
+type multiViewer struct {
+	ws      *websocket.Conn
+	origin  string // cross-origin browser page, checked for every subscribed page
+	max     int
+	subs    map[string]*pageViewer
+	subsMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+// pageViewer is one page subscription, the page broker sees it as a viewer
+type pageViewer struct {
+	page   string
+	acc    *Account
+	conn   *multiViewer
+	expiry *time.Timer // removes the viewer when the token expires
+}
+
+// Send the page message wrapped in PageMessage
+func (p *pageViewer) Send(msg ViewerMessage) error {
+	data, _ := json.Marshal(PageMessage{Page: p.page, Data: msg.Data})
+	return p.conn.write(data)
+}
+
+// Close is called by the broker when it drops the viewer
+func (p *pageViewer) Close() error {
+	p.conn.closed(p)
+	return nil
+}
+
+// ID is the connection address with the page
+func (p *pageViewer) ID() string {
+	return p.conn.ws.RemoteAddr().String() + "/" + p.page
+}
+
+// write the message to the connection
+func (m *multiViewer) write(msg []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.ws.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	return m.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+// reply with the command result
+func (m *multiViewer) reply(res PageCommandResult) {
+	msg, _ := json.Marshal(res)
+	m.write(msg)
+}
+
+// handle the viewer command, the result is sent back
+func (f *Factory) handlePageCommand(m *multiViewer, data []byte) {
+	var cmd PageCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		m.reply(PageCommandResult{Error: "Command is not valid JSON"})
+		return
+	}
+
+	res := PageCommandResult{Command: cmd.Command, Page: cmd.Page}
+	var err error
+	switch cmd.Command {
+	case CommandSubscribe:
+		err = f.subscribe(m, cmd.Page, cmd.Channels, cmd.Token)
+		if err == nil {
+			return
+		}
+	case CommandUnsubscribe:
+		err = m.unsubscribe(cmd.Page)
+	case CommandList:
+		res.Pages = m.pages()
+	case CommandResync:
+		if p := m.subscription(cmd.Page); p != nil {
+			p.acc.SendDeltaSnapshotToViewer(p)
+		} else {
+			err = errors.New("Page " + cmd.Page + " is not subscribed")
+		}
+	default:
+		err = errors.New("Command " + cmd.Command + " is unknown")
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if cmd.Command != CommandResync || err != nil {
+		m.reply(res)
+	}
+}
+
+// subscribe the connection to the page channels and send their current state
+// The result is sent before any page message
+func (f *Factory) subscribe(m *multiViewer, page string, channels []string, token string) error {
+	if len(channels) == 0 {
+		channels = []string{ChannelAccount}
+	}
+	for _, ch := range channels {
+		if !containsString(Channels, ch) {
+			return errors.New("Channel " + ch + " is unknown")
+		}
+	}
+
+	if m.origin != "" && !f.cfg.Origins.allow(page, m.origin) {
+		f.countRejectedOrigin(m.origin)
+		return errors.New("Origin " + m.origin + " is not allowed to view page " + page)
+	}
+	claims, err := f.authorizeViewer(page, token)
+	if err != nil {
+		return err
+	}
+
+	acc := f.Account(page)
+	if acc == nil {
+		return errors.New("Page " + page + " not found")
+	}
+
+	m.subsMu.Lock()
+	if _, ok := m.subs[page]; ok {
+		m.subsMu.Unlock()
+		return errors.New("Page " + page + " is subscribed already")
+	}
+	if len(m.subs) >= m.max {
+		m.subsMu.Unlock()
+		return errors.New("Subscriptions limit exceeded")
+	}
+	p := &pageViewer{page: page, acc: acc, conn: m}
+	m.subs[page] = p
+	m.subsMu.Unlock()
+
+	m.reply(PageCommandResult{Command: CommandSubscribe, Page: page})
+	if acc.addViewer(p, claims, channels...) != nil {
+		// The account is removed meanwhile
+		m.closed(p)
+		return nil
+	}
+	acc.sendChannels(p, channels)
+	p.expire(claims.Expires)
+	return nil
+}
+
+// expire the subscription with the token
+func (p *pageViewer) expire(expires time.Time) {
+	p.conn.subsMu.Lock()
+	defer p.conn.subsMu.Unlock()
+	if p.conn.subs[p.page] == p {
+		p.expiry = p.acc.expireViewer(p, expires)
+	}
+}
+
+// stop expiration timer of the removed subscription
+func (p *pageViewer) stop() {
+	p.conn.subsMu.Lock()
+	defer p.conn.subsMu.Unlock()
+	if p.expiry != nil {
+		p.expiry.Stop()
+	}
+}
+
+// unsubscribe the connection from the page
+func (m *multiViewer) unsubscribe(page string) error {
+	m.subsMu.Lock()
+	p, ok := m.subs[page]
+	delete(m.subs, page)
+	m.subsMu.Unlock()
+	if !ok {
+		return errors.New("Page " + page + " is not subscribed")
+	}
+	p.stop()
+	p.acc.RemoveViewer(p)
+	return nil
+}
+
+// closed tells the viewer its subscription was dropped by the broker
+// Nothing is sent if the viewer unsubscribed itself
+func (m *multiViewer) closed(p *pageViewer) {
+	m.subsMu.Lock()
+	own := m.subs[p.page] == p
+	if own {
+		delete(m.subs, p.page)
+	}
+	m.subsMu.Unlock()
+	if own {
+		m.reply(PageCommandResult{Command: CommandUnsubscribe, Page: p.page, Error: "Subscription closed by server"})
+	}
+}
+
+func (m *multiViewer) subscription(page string) *pageViewer {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	return m.subs[page]
+}
+
+// pages returns subscribed pages sorted
+func (m *multiViewer) pages() []string {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	ret := make([]string, 0, len(m.subs))
+	for page := range m.subs {
+		ret = append(ret, page)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// unsubscribeAll when the connection is closed
+func (m *multiViewer) unsubscribeAll() {
+	m.subsMu.Lock()
+	subs := m.subs
+	m.subs = make(map[string]*pageViewer)
+	m.subsMu.Unlock()
+	for _, p := range subs {
+		p.stop()
+		p.acc.RemoveViewer(p)
+	}
+}
+
+// serveMultiViewer reads commands until the connection is closed
+// Origin is empty for same-origin and non-browser connections
+func (f *Factory) serveMultiViewer(ws *websocket.Conn, origin string) {
+	m := &multiViewer{ws: ws, origin: origin, max: f.cfg.MaxSubscriptions, subs: make(map[string]*pageViewer)}
+	defer m.unsubscribeAll()
+	f.readViewer(ws, func(data []byte) {
+		f.handlePageCommand(m, data)
+	})
+}
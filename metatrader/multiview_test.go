@@ -0,0 +1,135 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// multiMessage is either PageCommandResult or PageMessage
+type multiMessage struct {
+	PageCommandResult
+	Data json.RawMessage `json:"data"`
+}
+
+func newMultiViewer(t *testing.T, mt *Factory) (*websocket.Conn, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mt.MultiWssAPIHandler(echo.New().NewContext(r, w))
+	}))
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	require.NoError(t, err)
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	return ws, func() {
+		ws.Close()
+		s.Close()
+	}
+}
+
+func readMulti(t *testing.T, ws *websocket.Conn) multiMessage {
+	var msg multiMessage
+	require.NoError(t, ws.ReadJSON(&msg))
+	return msg
+}
+
+func TestMultiViewer(t *testing.T) {
+	println("TestMultiViewer started")
+	cfg := DefaultConfig()
+	cfg.MaxSubscriptions = 2
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	acc1 := mt.createAccount(&Message{Page: "page1", UpdateFreq: "second", Balance: "100"})
+	acc2 := mt.createAccount(&Message{Page: "page2", UpdateFreq: "second", Balance: "200"})
+	mt.createAccount(&Message{Page: "page3", UpdateFreq: "second"})
+
+	ws, done := newMultiViewer(t, mt)
+	defer done()
+
+	// The result comes first, then the current state of the page
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "page1"}))
+	msg := readMulti(t, ws)
+	assert.Equal(t, PageCommandResult{Command: CommandSubscribe, Page: "page1"}, msg.PageCommandResult)
+	msg = readMulti(t, ws)
+	assert.Equal(t, "page1", msg.Page)
+	assert.Contains(t, string(msg.Data), `"balance":"100"`)
+
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "page2", Channels: []string{ChannelStatus}}))
+	assert.Empty(t, readMulti(t, ws).Error)
+	msg = readMulti(t, ws)
+	assert.Equal(t, "page2", msg.Page)
+	assert.Contains(t, string(msg.Data), `"channel":"status"`)
+
+	// Errors
+	for _, cmd := range []PageCommand{
+		{Command: CommandSubscribe, Page: "page1"},
+		{Command: CommandSubscribe, Page: "page3"},
+		{Command: CommandSubscribe, Page: "unknown"},
+		{Command: CommandSubscribe, Page: "page1", Channels: []string{"unknown"}},
+		{Command: CommandUnsubscribe, Page: "page3"},
+		{Command: "unknown"},
+	} {
+		require.NoError(t, ws.WriteJSON(cmd))
+		msg = readMulti(t, ws)
+		assert.Equal(t, cmd.Command, msg.Command)
+		assert.NotEmpty(t, msg.Error, cmd)
+	}
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "page3"}))
+	assert.Equal(t, "Subscriptions limit exceeded", readMulti(t, ws).Error)
+
+	// Updates are tagged with the page
+	acc2.update(&Message{Balance: "250"})
+	acc2.SendUpdateToAllViewers()
+	acc1.update(&Message{Balance: "150"})
+	acc1.SendUpdateToAllViewers()
+	msg = readMulti(t, ws)
+	assert.Equal(t, "page1", msg.Page)
+	assert.Contains(t, string(msg.Data), `"balance":"150"`)
+
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandList}))
+	assert.Equal(t, []string{"page1", "page2"}, readMulti(t, ws).Pages)
+
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandUnsubscribe, Page: "page1"}))
+	assert.Equal(t, PageCommandResult{Command: CommandUnsubscribe, Page: "page1"}, readMulti(t, ws).PageCommandResult)
+	assert.Eventually(t, func() bool { return acc1.broker.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandList}))
+	assert.Equal(t, []string{"page2"}, readMulti(t, ws).Pages)
+
+	// Viewer is told when the page is gone
+	mt.removeAccount(acc2)
+	msg = readMulti(t, ws)
+	assert.Equal(t, CommandUnsubscribe, msg.Command)
+	assert.Equal(t, "page2", msg.Page)
+	assert.NotEmpty(t, msg.Error)
+}
+
+func TestMultiViewerClose(t *testing.T) {
+	println("TestMultiViewerClose started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+
+	ws, done := newMultiViewer(t, mt)
+	defer done()
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "test", Channels: []string{ChannelDelta}}))
+	assert.Empty(t, readMulti(t, ws).Error)
+	assert.Contains(t, string(readMulti(t, ws).Data), `"snapshot"`)
+
+	// Resync is sent to the page
+	require.NoError(t, ws.WriteJSON(PageCommand{Command: CommandResync, Page: "test"}))
+	msg := readMulti(t, ws)
+	assert.Equal(t, "test", msg.Page)
+	assert.Contains(t, string(msg.Data), `"snapshot"`)
+
+	// All subscriptions are removed with the connection
+	assert.Equal(t, 1, acc.broker.Stats().Viewers)
+	ws.Close()
+	assert.Eventually(t, func() bool { return acc.broker.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+}
@@ -0,0 +1,140 @@
+package metatrader
+
+import (
+	"errors"
+	"strconv"
+)
+
+// OrderType as MetaTrader ENUM_ORDER_TYPE, MetaTrader 4 uses the first six values
+type OrderType int8
+
+// Order types, MetaTrader numbering starts with OrderBuy as 0
+const (
+	OrderTypeNone OrderType = iota // type is not received yet
+	OrderBuy
+	OrderSell
+	OrderBuyLimit
+	OrderSellLimit
+	OrderBuyStop
+	OrderSellStop
+	OrderBuyStopLimit
+	OrderSellStopLimit
+	OrderCloseBy
+)
+
+var orderTypeNames = [...]string{"buy", "sell", "buylimit", "selllimit", "buystop", "sellstop", "buystoplimit", "sellstoplimit", "closeby"}
+
+// ParseOrderType parses type number sent by MetaTrader, empty string is OrderTypeNone
+func ParseOrderType(s string) (OrderType, error) {
+	if s == "" {
+		return OrderTypeNone, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= len(orderTypeNames) {
+		return OrderTypeNone, errors.New("Order type " + s + " is unknown")
+	}
+	return OrderType(n + 1), nil
+}
+
+// String returns type name like "buylimit", empty for OrderTypeNone
+func (t OrderType) String() string {
+	if t <= OrderTypeNone || int(t) > len(orderTypeNames) {
+		return ""
+	}
+	return orderTypeNames[t-1]
+}
+
+// Code returns type number as sent by MetaTrader, empty for OrderTypeNone
+func (t OrderType) Code() string {
+	if t <= OrderTypeNone || int(t) > len(orderTypeNames) {
+		return ""
+	}
+	return strconv.Itoa(int(t) - 1)
+}
+
+// IsMarket reports whether the order is an open position rather than pending order
+func (t OrderType) IsMarket() bool {
+	return t == OrderBuy || t == OrderSell
+}
+
+// MarshalText writes type name
+func (t OrderType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText accepts both type names and numbers
+func (t *OrderType) UnmarshalText(data []byte) error {
+	for i, name := range orderTypeNames {
+		if string(data) == name {
+			*t = OrderType(i + 1)
+			return nil
+		}
+	}
+	v, err := ParseOrderType(string(data))
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// OrderState is the order kept by Account with parsed values
+// Order is its wire form, values are sent only if changed
+type OrderState struct {
+	Symbol     string
+	TimeOpen   string
+	Type       OrderType
+	InitVolume Decimal
+	CurVolume  Decimal
+	PriceOpen  Decimal
+	SL         Decimal
+	TP         Decimal
+	Swap       Decimal
+	PriceSL    Decimal
+	Profit     Decimal
+}
+
+// apply values received in the update, the order should be validated
+func (o *OrderState) apply(upd Order) {
+	if upd.Symbol != "" {
+		o.Symbol = upd.Symbol
+	}
+	if upd.TimeOpen != "" {
+		o.TimeOpen = upd.TimeOpen
+	}
+	if t, err := ParseOrderType(upd.Type); err == nil && t != OrderTypeNone {
+		o.Type = t
+	}
+	applyDecimal(&o.InitVolume, upd.InitVolume)
+	applyDecimal(&o.CurVolume, upd.CurVolume)
+	applyDecimal(&o.PriceOpen, upd.PriceOpen)
+	applyDecimal(&o.SL, upd.SL)
+	applyDecimal(&o.TP, upd.TP)
+	applyDecimal(&o.Swap, upd.Swap)
+	applyDecimal(&o.PriceSL, upd.PriceSL)
+	applyDecimal(&o.Profit, upd.Profit)
+}
+
+// Order returns wire form of the order
+func (o OrderState) Order() Order {
+	return Order{
+		Symbol:     o.Symbol,
+		TimeOpen:   o.TimeOpen,
+		Type:       o.Type.Code(),
+		InitVolume: o.InitVolume.String(),
+		CurVolume:  o.CurVolume.String(),
+		PriceOpen:  o.PriceOpen.String(),
+		SL:         o.SL.String(),
+		TP:         o.TP.String(),
+		Swap:       o.Swap.String(),
+		PriceSL:    o.PriceSL.String(),
+		Profit:     o.Profit.String(),
+	}
+}
+
+// applyDecimal sets the value if it's received
+func applyDecimal(d *Decimal, s string) {
+	if v, err := ParseDecimal(s); err == nil && v.IsSet() {
+		*d = v
+	}
+}
@@ -0,0 +1,69 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderType(t *testing.T) {
+	println("TestOrderType started")
+	tests := []struct {
+		code string
+		typ  OrderType
+		name string
+	}{
+		{"", OrderTypeNone, ""},
+		{"0", OrderBuy, "buy"},
+		{"1", OrderSell, "sell"},
+		{"2", OrderBuyLimit, "buylimit"},
+		{"3", OrderSellLimit, "selllimit"},
+		{"4", OrderBuyStop, "buystop"},
+		{"5", OrderSellStop, "sellstop"},
+		{"6", OrderBuyStopLimit, "buystoplimit"},
+		{"7", OrderSellStopLimit, "sellstoplimit"},
+		{"8", OrderCloseBy, "closeby"},
+	}
+	for _, tt := range tests {
+		typ, err := ParseOrderType(tt.code)
+		if assert.NoError(t, err, tt.code) {
+			assert.Equal(t, tt.typ, typ)
+			assert.Equal(t, tt.name, typ.String())
+			assert.Equal(t, tt.code, typ.Code())
+		}
+	}
+
+	for _, code := range []string{"-1", "9", "buy", "1.0"} {
+		_, err := ParseOrderType(code)
+		assert.Error(t, err, code)
+	}
+
+	assert.True(t, OrderSell.IsMarket())
+	assert.False(t, OrderSellStop.IsMarket())
+
+	var v struct {
+		A OrderType `json:"a"`
+		B OrderType `json:"b"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"a":"sellstop","b":"2"}`), &v))
+	assert.Equal(t, OrderSellStop, v.A)
+	assert.Equal(t, OrderBuyLimit, v.B)
+	data, _ := json.Marshal(v)
+	assert.Equal(t, `{"a":"sellstop","b":"buylimit"}`, string(data))
+}
+
+func TestOrderStateApply(t *testing.T) {
+	println("TestOrderStateApply started")
+	var ord OrderState
+	ord.apply(Order{Symbol: "EURUSD", Type: "0", PriceOpen: "1.13230", Profit: "-10.20"})
+	ord.apply(Order{Profit: "5.5", SL: "1.1"})
+
+	assert.Equal(t, OrderBuy, ord.Type)
+	assert.Equal(t, "1.13230", ord.PriceOpen.String())
+	assert.Equal(t, "5.5", ord.Profit.String())
+	assert.False(t, ord.TP.IsSet())
+
+	// Wire form keeps absent values empty
+	assert.Equal(t, Order{Symbol: "EURUSD", Type: "0", PriceOpen: "1.13230", SL: "1.1", Profit: "5.5"}, ord.Order())
+}
@@ -0,0 +1,148 @@
+package metatrader
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// corsMaxAge is how long browsers may cache the preflight answer, in seconds
+const corsMaxAge = "600"
+
+// OriginConfig lists web sites whose pages may use viewer API from browsers
+// Requests without Origin header, as from MetaTrader or scripts, and same-origin requests are always allowed
+type OriginConfig struct {
+	// Origins allowed for every page, like "https://metatrader.live". "https://*.example.com" allows subdomains, "*" allows any site
+	Allowed []string `json:"allowed"`
+	// Origins allowed for the page in addition to the common ones, page as a key, for sites embedding its widget
+	Pages map[string][]string `json:"pages"`
+}
+
+// validate origins, they have scheme and host only
+func (c *OriginConfig) validate() error {
+	lists := [][]string{c.Allowed}
+	for _, origins := range c.Pages {
+		lists = append(lists, origins)
+	}
+	for _, origins := range lists {
+		for _, origin := range origins {
+			if err := validOrigin(origin); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+		return errors.New("Origin " + origin + " should be like https://example.com")
+	}
+	return nil
+}
+
+// allow checks the origin for the page
+// Origin allowed for any page is enough if page is empty, as for stats and multi-page viewers
+func (c *OriginConfig) allow(page, origin string) bool {
+	if matchOrigins(c.Allowed, origin) {
+		return true
+	}
+	if page != "" {
+		return matchOrigins(c.Pages[page], origin)
+	}
+	for _, origins := range c.Pages {
+		if matchOrigins(origins, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigins(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, p := range patterns {
+		if matchOrigin(strings.TrimSuffix(strings.ToLower(p), "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	// Wildcard matches one or more subdomain levels, not the domain itself
+	i := strings.Index(pattern, "://*.")
+	if i < 0 {
+		return false
+	}
+	scheme, domain := pattern[:i+3], pattern[i+4:]
+	return len(origin) > len(scheme)+len(domain) && strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain)
+}
+
+// browserOrigin returns Origin of cross-origin request, empty if there is none or it is the same host
+func browserOrigin(r *http.Request) string {
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return ""
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return ""
+	}
+	return origin
+}
+
+// originAuth middleware rejects browser pages of sites not allowed to view the page
+// Allowed cross-origin requests get CORS headers, preflight requests are answered here
+func (f *Factory) originAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		origin := browserOrigin(c.Request())
+		if origin != "" {
+			if !f.cfg.Origins.allow(c.Param("page"), origin) {
+				f.countRejectedOrigin(origin)
+				return c.String(http.StatusForbidden, "Origin "+origin+" is not allowed")
+			}
+			h := c.Response().Header()
+			h.Add(echo.HeaderVary, echo.HeaderOrigin)
+			h.Set(echo.HeaderAccessControlAllowOrigin, origin)
+		}
+		if c.Request().Method == http.MethodOptions {
+			h := c.Response().Header()
+			h.Set(echo.HeaderAccessControlAllowMethods, "GET, HEAD, OPTIONS")
+			h.Set(echo.HeaderAccessControlAllowHeaders, "Authorization, Last-Event-ID")
+			h.Set(echo.HeaderAccessControlMaxAge, corsMaxAge)
+			return c.NoContent(http.StatusNoContent)
+		}
+		return next(c)
+	}
+}
+
+// countRejectedOrigin of the request, the number of kept origins is limited as for oversized messages
+func (f *Factory) countRejectedOrigin(origin string) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.rejectedOrigins[origin]; !ok && len(f.rejectedOrigins) >= maxRejectedAddrs {
+		origin = "other"
+	}
+	f.rejectedOrigins[origin]++
+}
+
+// rejectedOriginStats returns copy of rejections per origin
+func (f *Factory) rejectedOriginStats() map[string]int {
+	f.RLock()
+	defer f.RUnlock()
+
+	ret := make(map[string]int, len(f.rejectedOrigins))
+	for origin, cnt := range f.rejectedOrigins {
+		ret[origin] = cnt
+	}
+	return ret
+}
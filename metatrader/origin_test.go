@@ -0,0 +1,132 @@
+package metatrader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOriginConfig(t *testing.T) {
+	println("TestOriginConfig started")
+	c := OriginConfig{
+		Allowed: []string{"https://metatrader.live", "https://*.example.com/"},
+		Pages:   map[string][]string{"widget": {"http://Customer.com:8080"}},
+	}
+	require.NoError(t, c.validate())
+
+	assert.True(t, c.allow("test", "https://metatrader.live"))
+	assert.True(t, c.allow("test", "https://METATRADER.live"))
+	assert.False(t, c.allow("test", "http://metatrader.live"))
+	assert.False(t, c.allow("test", "https://metatrader.live.evil.com"))
+	assert.True(t, c.allow("test", "https://a.example.com"))
+	assert.True(t, c.allow("test", "https://a.b.example.com"))
+	assert.False(t, c.allow("test", "https://example.com"))
+	assert.False(t, c.allow("test", "https://evilexample.com"))
+
+	// Page origins are added to the common ones
+	assert.True(t, c.allow("widget", "http://customer.com:8080"))
+	assert.True(t, c.allow("widget", "https://metatrader.live"))
+	assert.False(t, c.allow("test", "http://customer.com:8080"))
+	assert.True(t, c.allow("", "http://customer.com:8080"))
+	assert.False(t, c.allow("", "https://other.com"))
+
+	assert.True(t, (&OriginConfig{Allowed: []string{"*"}}).allow("test", "https://other.com"))
+	assert.False(t, (&OriginConfig{}).allow("test", "https://other.com"))
+
+	for _, origin := range []string{"metatrader.live", "ftp://metatrader.live", "https://metatrader.live/page", "https://"} {
+		assert.Error(t, (&OriginConfig{Allowed: []string{origin}}).validate(), origin)
+	}
+	assert.Error(t, (&OriginConfig{Pages: map[string][]string{"test": {"*.example.com"}}}).validate())
+
+	cfg := DefaultConfig()
+	cfg.Origins.Allowed = []string{"example.com"}
+	assert.Error(t, cfg.validate())
+}
+
+func TestOriginAuth(t *testing.T) {
+	println("TestOriginAuth started")
+	cfg := DefaultConfig()
+	cfg.Registry.AdminToken = "admin"
+	cfg.Origins = OriginConfig{
+		Allowed: []string{"https://metatrader.live"},
+		Pages:   map[string][]string{"widget": {"https://customer.com"}},
+	}
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	s := httptest.NewServer(mt.newAPIServer())
+	defer s.Close()
+	mt.createAccount(&Message{Page: "test", UpdateFreq: "second", Balance: "100"})
+	mt.createAccount(&Message{Page: "widget", UpdateFreq: "second", Balance: "200"})
+
+	// Requests without origin and same-origin ones are not checked
+	code, _ := apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "", "Origin", s.URL)
+	assert.Equal(t, http.StatusOK, code)
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/api/rest/widget", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://customer.com")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://customer.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+
+	code, body := apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "", "Origin", "https://customer.com")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "Origin https://customer.com is not allowed", body)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/stats", "", "Origin", "https://customer.com")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = apiCall(t, http.MethodGet, s.URL+"/api/stats", "", "Origin", "https://evil.com")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Preflight
+	req, err = http.NewRequest(http.MethodOptions, s.URL+"/api/sse/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://metatrader.live")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://metatrader.live", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+	code, _ = apiCall(t, http.MethodOptions, s.URL+"/api/rest/test", "", "Origin", "https://evil.com")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// WebSocket upgrade
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"/api/wss/test", http.Header{"Origin": {"https://customer.com"}})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss/widget", http.Header{"Origin": {"https://customer.com"}})
+	require.NoError(t, err)
+	ws.Close()
+
+	// Multi-page viewer is checked on subscribe
+	multi, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss", http.Header{"Origin": {"https://customer.com"}})
+	require.NoError(t, err)
+	defer multi.Close()
+	multi.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	require.NoError(t, multi.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "test"}))
+	assert.Equal(t, "Origin https://customer.com is not allowed to view page test", readMulti(t, multi).Error)
+	require.NoError(t, multi.WriteJSON(PageCommand{Command: CommandSubscribe, Page: "widget"}))
+	assert.Empty(t, readMulti(t, multi).Error)
+	assert.Contains(t, string(readMulti(t, multi).Data), `"balance":"200"`)
+
+	// Rejections are counted per origin
+	assert.Equal(t, 5, mt.exportState().RejectedOrigins)
+	code, body = apiCall(t, http.MethodGet, s.URL+"/api/admin/origins", "", "X-Admin-Token", "admin")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"https://customer.com":3,"https://evil.com":2}`, body)
+}
@@ -0,0 +1,213 @@
+package metatrader
+
+import (
+	"time"
+)
+
+// PerformanceStats describes how the account trades since it's connected
+// Trade result is the last known profit plus swap of the closed order
+type PerformanceStats struct {
+	Trades       int      `json:"trades" example:"20"`
+	Wins         int      `json:"wins" example:"12"`
+	Losses       int      `json:"losses" example:"8"`
+	WinRate      float64  `json:"winRate" example:"60"`
+	GrossProfit  Decimal  `json:"grossProfit" swaggertype:"string" example:"350.20"`
+	GrossLoss    Decimal  `json:"grossLoss" swaggertype:"string" example:"-120.00"`
+	NetProfit    Decimal  `json:"netProfit" swaggertype:"string" example:"230.20"`
+	ProfitFactor *float64 `json:"profitFactor" example:"2.92"` // null without losses
+	AverageWin   float64  `json:"averageWin" example:"29.18"`
+	AverageLoss  float64  `json:"averageLoss" example:"-15"`
+	LargestWin   Decimal  `json:"largestWin" swaggertype:"string" example:"80.00"`
+	LargestLoss  Decimal  `json:"largestLoss" swaggertype:"string" example:"-40.00"`
+	// Closed trades per symbol
+	Symbols map[string]int `json:"symbols"`
+	// Equity drop from its peak
+	MaxDrawdown        Decimal `json:"maxDrawdown" swaggertype:"string" example:"55.30"`
+	MaxDrawdownPercent float64 `json:"maxDrawdownPercent" example:"5.1"`
+	// Seconds with at least one open position
+	TimeInMarket        int64   `json:"timeInMarket" example:"3600"`
+	TimeInMarketPercent float64 `json:"timeInMarketPercent" example:"25"`
+}
+
+// PerformanceSummary is the compact form of PerformanceStats for /api/stats
+type PerformanceSummary struct {
+	Trades             int      `json:"trades" example:"20"`
+	WinRate            float64  `json:"winRate" example:"60"`
+	ProfitFactor       *float64 `json:"profitFactor" example:"2.92"`
+	MaxDrawdownPercent float64  `json:"maxDrawdownPercent" example:"5.1"`
+}
+
+// performance collects the values stats are computed from
+type performance struct {
+	trades      int
+	wins        int
+	losses      int
+	grossProfit Decimal
+	grossLoss   Decimal
+	largestWin  Decimal
+	largestLoss Decimal
+	symbols     map[string]int
+
+	equityPeak         Decimal
+	maxDrawdown        Decimal
+	maxDrawdownPercent float64
+
+	inMarket    time.Duration
+	marketSince time.Time
+}
+
+// addTrade counts the closed order, deleted or expired pending orders are not trades
+func (p *performance) addTrade(ord OrderState) {
+	if !ord.Type.IsMarket() {
+		return
+	}
+	result := ord.Profit
+	if ord.Swap.IsSet() {
+		result = result.Add(ord.Swap)
+	}
+	if !result.IsSet() {
+		result = NewDecimal(0, 0)
+	}
+
+	p.trades++
+	if p.symbols == nil {
+		p.symbols = make(map[string]int)
+	}
+	p.symbols[ord.Symbol]++
+
+	switch {
+	case result.Sign() > 0:
+		p.wins++
+		p.grossProfit = p.grossProfit.Add(result)
+		if !p.largestWin.IsSet() || result.Cmp(p.largestWin) > 0 {
+			p.largestWin = result
+		}
+	case result.Sign() < 0:
+		p.losses++
+		p.grossLoss = p.grossLoss.Add(result)
+		if !p.largestLoss.IsSet() || result.Cmp(p.largestLoss) < 0 {
+			p.largestLoss = result
+		}
+	}
+}
+
+// updateEquity tracks the drawdown from equity peak
+func (p *performance) updateEquity(equity Decimal) {
+	if !equity.IsSet() {
+		return
+	}
+	if !p.equityPeak.IsSet() || equity.Cmp(p.equityPeak) > 0 {
+		p.equityPeak = equity
+		return
+	}
+	dd := p.equityPeak.Sub(equity)
+	if !p.maxDrawdown.IsSet() || dd.Cmp(p.maxDrawdown) > 0 {
+		p.maxDrawdown = dd
+	}
+	if peak := p.equityPeak.Float64(); peak > 0 {
+		if pct := dd.Float64() / peak * 100; pct > p.maxDrawdownPercent {
+			p.maxDrawdownPercent = pct
+		}
+	}
+}
+
+// updateMarket accumulates time with open positions
+func (p *performance) updateMarket(now time.Time, inMarket bool) {
+	if !p.marketSince.IsZero() {
+		p.inMarket += now.Sub(p.marketSince)
+	}
+	p.marketSince = time.Time{}
+	if inMarket {
+		p.marketSince = now
+	}
+}
+
+func (p *performance) summary() PerformanceSummary {
+	return PerformanceSummary{
+		Trades:             p.trades,
+		WinRate:            p.winRate(),
+		ProfitFactor:       p.profitFactor(),
+		MaxDrawdownPercent: p.maxDrawdownPercent,
+	}
+}
+
+func (p *performance) winRate() float64 {
+	if p.trades == 0 {
+		return 0
+	}
+	return float64(p.wins) / float64(p.trades) * 100
+}
+
+func (p *performance) profitFactor() *float64 {
+	if p.losses == 0 {
+		return nil
+	}
+	pf := p.grossProfit.Float64() / -p.grossLoss.Float64()
+	return &pf
+}
+
+// stats computes PerformanceStats, the account is online since started
+func (p *performance) stats(started, now time.Time) PerformanceStats {
+	st := PerformanceStats{
+		Trades:             p.trades,
+		Wins:               p.wins,
+		Losses:             p.losses,
+		WinRate:            p.winRate(),
+		GrossProfit:        p.grossProfit,
+		GrossLoss:          p.grossLoss,
+		NetProfit:          p.grossProfit.Add(p.grossLoss),
+		ProfitFactor:       p.profitFactor(),
+		LargestWin:         p.largestWin,
+		LargestLoss:        p.largestLoss,
+		Symbols:            make(map[string]int, len(p.symbols)),
+		MaxDrawdown:        p.maxDrawdown,
+		MaxDrawdownPercent: p.maxDrawdownPercent,
+	}
+	if p.wins > 0 {
+		st.AverageWin = p.grossProfit.Float64() / float64(p.wins)
+	}
+	if p.losses > 0 {
+		st.AverageLoss = p.grossLoss.Float64() / float64(p.losses)
+	}
+	for sym, cnt := range p.symbols {
+		st.Symbols[sym] = cnt
+	}
+
+	inMarket := p.inMarket
+	if !p.marketSince.IsZero() {
+		inMarket += now.Sub(p.marketSince)
+	}
+	st.TimeInMarket = int64(inMarket / time.Second)
+	if online := now.Sub(started); online > 0 {
+		st.TimeInMarketPercent = float64(inMarket) / float64(online) * 100
+	}
+	return st
+}
+
+// trackPerformance updates equity and market time, should be called under account lock
+func (a *Account) trackPerformance(now time.Time) {
+	a.perf.updateEquity(a.Equity)
+
+	inMarket := false
+	for _, ord := range a.Orders {
+		if ord.Type.IsMarket() {
+			inMarket = true
+			break
+		}
+	}
+	a.perf.updateMarket(now, inMarket)
+}
+
+// Performance returns trading statistics of the account
+func (a *Account) Performance() PerformanceStats {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.perf.stats(a.Started, time.Now())
+}
+
+// PerformanceSummary returns compact trading statistics of the account
+func (a *Account) PerformanceSummary() PerformanceSummary {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.perf.summary()
+}
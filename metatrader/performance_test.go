@@ -0,0 +1,122 @@
+package metatrader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPerformance(t *testing.T) {
+	println("TestPerformance started")
+	acc := NewAccount(&Message{Page: "test", UpdateFreq: "second", Equity: "1000"}, zap.NewNop().Sugar())
+
+	acc.update(&Message{Equity: "1100", Orders: map[OrderTicket]Order{
+		"1": {Symbol: "EURUSD", Type: "0", Profit: "50", Swap: "-1.5"},
+		"2": {Symbol: "EURUSD", Type: "1", Profit: "-20"},
+		"3": {Symbol: "GBPUSD", Type: "2"},
+	}})
+	acc.update(&Message{Equity: "990", Orders: map[OrderTicket]Order{"2": {Profit: "-30.25"}, "3": {}}})
+	acc.update(&Message{Equity: "1045", Orders: map[OrderTicket]Order{"3": {}}})
+
+	st := acc.Performance()
+	assert.Equal(t, 2, st.Trades)
+	assert.Equal(t, 1, st.Wins)
+	assert.Equal(t, 1, st.Losses)
+	assert.Equal(t, 50.0, st.WinRate)
+	assert.Equal(t, "48.5", st.GrossProfit.String())
+	assert.Equal(t, "-30.25", st.GrossLoss.String())
+	assert.Equal(t, "18.25", st.NetProfit.String())
+	if assert.NotNil(t, st.ProfitFactor) {
+		assert.InDelta(t, 48.5/30.25, *st.ProfitFactor, 1e-9)
+	}
+	assert.InDelta(t, 48.5, st.AverageWin, 1e-9)
+	assert.InDelta(t, -30.25, st.AverageLoss, 1e-9)
+	assert.Equal(t, "48.5", st.LargestWin.String())
+	assert.Equal(t, "-30.25", st.LargestLoss.String())
+	assert.Equal(t, map[string]int{"EURUSD": 2}, st.Symbols)
+	assert.Equal(t, "110", st.MaxDrawdown.String())
+	assert.InDelta(t, 10.0, st.MaxDrawdownPercent, 1e-9)
+
+	sum := acc.PerformanceSummary()
+	assert.Equal(t, 2, sum.Trades)
+	assert.Equal(t, st.MaxDrawdownPercent, sum.MaxDrawdownPercent)
+}
+
+func TestPerformancePendingCancelled(t *testing.T) {
+	println("TestPerformancePendingCancelled started")
+	acc := NewAccount(&Message{Page: "test", UpdateFreq: "second", Equity: "1000"}, zap.NewNop().Sugar())
+
+	acc.update(&Message{Orders: map[OrderTicket]Order{
+		"1": {Symbol: "EURUSD", Type: "0", Profit: "10"},
+		"2": {Symbol: "GBPUSD", Type: "2"},
+		"3": {Symbol: "GBPUSD", Type: "5"},
+	}})
+	// Limit order is deleted, stop order expires, the position is closed
+	acc.update(&Message{Orders: map[OrderTicket]Order{"1": {}, "3": {}}})
+	acc.update(&Message{Orders: map[OrderTicket]Order{}})
+
+	st := acc.Performance()
+	assert.Equal(t, 1, st.Trades)
+	assert.Equal(t, 1, st.Wins)
+	assert.Equal(t, 100.0, st.WinRate)
+	assert.Equal(t, map[string]int{"EURUSD": 1}, st.Symbols)
+	assert.Len(t, acc.History(), 3, "Cancelled orders stay in history")
+}
+
+func TestPerformanceTimeInMarket(t *testing.T) {
+	println("TestPerformanceTimeInMarket started")
+	var p performance
+	start := time.Date(2021, 1, 6, 9, 0, 0, 0, time.UTC)
+
+	p.updateMarket(start, true)
+	p.updateMarket(start.Add(time.Minute), true)
+	p.updateMarket(start.Add(2*time.Minute), false)
+	p.updateMarket(start.Add(3*time.Minute), true)
+
+	st := p.stats(start, start.Add(4*time.Minute))
+	assert.Equal(t, int64(180), st.TimeInMarket)
+	assert.InDelta(t, 75.0, st.TimeInMarketPercent, 1e-9)
+	assert.Nil(t, st.ProfitFactor)
+	assert.False(t, st.NetProfit.IsSet())
+}
+
+func TestPerformanceAPI(t *testing.T) {
+	println("TestPerformanceAPI started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	get := func() (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetPath("/api/rest/:page/stats")
+		c.SetParamNames("page")
+		c.SetParamValues("test")
+		require.NoError(t, mt.PerformanceAPIHandler(c))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := get()
+	assert.Equal(t, http.StatusNotFound, code)
+
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+	acc.update(&Message{Orders: map[OrderTicket]Order{"1": {Symbol: "EURUSD", Type: "1", Profit: "-5"}}})
+	acc.update(&Message{})
+
+	code, body := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"trades":1`)
+	assert.Contains(t, body, `"profitFactor":0`)
+	assert.Contains(t, body, `"symbols":{"EURUSD":1}`)
+
+	st := mt.exportState()
+	if assert.Len(t, st.Accounts, 1) {
+		assert.Equal(t, 1, st.Accounts[0].Performance.Trades)
+	}
+}
@@ -0,0 +1,187 @@
+package metatrader
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PushSecretHeader keeps page secret for HTTP push requests
+const PushSecretHeader = "X-Page-Secret"
+
+// pushSession keeps the account fed by HTTP push requests
+// There is no connection to watch, so the account is removed when pushes stop
+type pushSession struct {
+	acc        *Account
+	features   featureSet
+	secretHash [sha256.Size]byte
+	timeout    time.Duration
+	timer      *time.Timer
+	expired    bool
+	sync.Mutex
+}
+
+// verify the secret of subsequent push, bcrypt is too slow to run on every update
+func (s *pushSession) verify(secret string) bool {
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], s.secretHash[:]) == 1
+}
+
+// PushAPIHandler updates the account with a message sent over HTTP
+// The first push registers the account just like the first message on MetaTrader listener
+// @Summary Push account data from terminals unable to reach MetaTrader listener
+// @Accept json
+// @Produce json
+// @Param X-Page-Secret header string true "Page secret key"
+// @Param page path string true "Account Page name"
+// @Param message body Message true "Account data, the first push should declare updatefreq"
+// @Success 200 {object} ResponseMsg
+// @failure 400 {object} ResponseMsg
+// @failure 403 {object} ResponseMsg
+// @failure 410 {object} ResponseMsg
+// @failure 429 {object} ResponseMsg
+// @Router /push/{page} [post]
+func (f *Factory) PushAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+	secret := c.Request().Header.Get(PushSecretHeader)
+	logaddr := c.RealIP()
+
+	msg := new(Message)
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, int64(MaxJSONMsgSize))
+	if err := json.NewDecoder(body).Decode(msg); err != nil {
+		return f.pushError(c, logaddr, page, errors.New("Failed to decode a message: "+err.Error()))
+	}
+	if msg.Page == "" {
+		msg.Page = page
+	}
+	if msg.Page != page {
+		return f.pushError(c, logaddr, page, errors.New("Page address "+msg.Page+" does not match the URL"))
+	}
+	msg.Secret = secret
+	if err := msg.Validate(); err != nil {
+		return f.pushError(c, logaddr, page, err)
+	}
+
+	// Anyone could push to anonymous page, there is no connection to own it
+	if secret == "" {
+		return f.pushError(c, logaddr, page, &PageError{Code: ErrCodeSecretRequired, Text: "Secret key is required for HTTP push"})
+	}
+
+	f.pushMu.Lock()
+	s, ok := f.pushes[page]
+	f.pushMu.Unlock()
+	if !ok {
+		resp, err := f.registerPush(msg)
+		if err != nil {
+			return f.pushError(c, logaddr, page, err)
+		}
+		f.log.Info("New account registered: " + page + " (HTTP push)")
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	if !s.verify(secret) {
+		return f.pushError(c, logaddr, page, &PageError{Code: ErrCodeWrongSecret, Text: "Secret key for page " + page + " is not valid"})
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.expired {
+		return f.pushError(c, logaddr, page, errPushExpired(s.timeout))
+	}
+	if err := f.applyMessage(s.acc, s.features, msg); err != nil {
+		f.closePush(s)
+		return f.pushError(c, logaddr, page, err)
+	}
+	s.timer.Reset(s.timeout)
+	return c.JSON(http.StatusOK, ResponseMsg{})
+}
+
+// registerPush creates push session with the first message
+// The secret is checked before pushMu is taken, so slow bcrypt of one page does not stall pushes to others
+func (f *Factory) registerPush(msg *Message) (ResponseMsg, error) {
+	if err := f.firstMessageCheck(msg); err != nil {
+		return ResponseMsg{}, err
+	}
+	features, err := f.negotiate(msg, false)
+	if err != nil {
+		return ResponseMsg{}, err
+	}
+	if err := f.pages.Authenticate(msg.Page, msg.Secret); err != nil {
+		return ResponseMsg{}, err
+	}
+
+	f.pushMu.Lock()
+	defer f.pushMu.Unlock()
+	// Another push or MetaTrader connection may register the page meanwhile
+	if _, ok := f.pushes[msg.Page]; ok {
+		return ResponseMsg{}, errors.New("Page address " + msg.Page + " is already in use")
+	}
+	if err := f.firstMessageCheck(msg); err != nil {
+		return ResponseMsg{}, err
+	}
+	acc, resp, err := f.openAuthenticated(msg, features)
+	if err != nil {
+		return ResponseMsg{}, err
+	}
+
+	s := &pushSession{
+		acc:        acc,
+		features:   features,
+		secretHash: sha256.Sum256([]byte(msg.Secret)),
+		timeout:    f.cfg.readTimeout(msg.UpdateFreq),
+	}
+	// The timer may fire before AfterFunc returns
+	s.Lock()
+	s.timer = time.AfterFunc(s.timeout, func() {
+		s.Lock()
+		defer s.Unlock()
+		if !s.expired {
+			f.log.Error(errPushExpired(s.timeout).Error(), ". (", acc.Page, ")")
+			f.closePush(s)
+		}
+	})
+	s.Unlock()
+	f.pushes[msg.Page] = s
+	return resp, nil
+}
+
+// closePush removes the account fed by push session, should be called under session lock
+func (f *Factory) closePush(s *pushSession) {
+	page := s.acc.Page
+	s.expired = true
+	s.timer.Stop()
+	f.disconnectAccount(s.acc)
+
+	f.pushMu.Lock()
+	if f.pushes[page] == s {
+		delete(f.pushes, page)
+	}
+	f.pushMu.Unlock()
+	f.log.Info("Account disconnected: " + page + " (HTTP push)")
+}
+
+func errPushExpired(timeout time.Duration) error {
+	return &PageError{Code: ErrCodeEvicted, Text: "Account evicted: no pushes within " + timeout.String()}
+}
+
+// pushError responds with ResponseMsg, HTTP status depends on error code
+func (f *Factory) pushError(c echo.Context, addr, page string, err error) error {
+	resp := errorResponse(err)
+	status := http.StatusForbidden
+	switch resp.Code {
+	case "", ErrCodeInvalidMessage:
+		status = http.StatusBadRequest
+	case ErrCodeRateExceeded:
+		status = http.StatusTooManyRequests
+	case ErrCodeEvicted:
+		status = http.StatusGone
+	}
+	f.log.Error(resp.Error, ". (", addr, ", ", page, ")")
+	return c.JSON(status, resp)
+}
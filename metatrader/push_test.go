@@ -0,0 +1,174 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newPushFactory(t *testing.T, cfg Config) *Factory {
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return mt
+}
+
+// push the message body to the page with the secret
+func push(t *testing.T, mt *Factory, page, secret, body string) (int, ResponseMsg) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if secret != "" {
+		req.Header.Set(PushSecretHeader, secret)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetPath("/api/push/:page")
+	c.SetParamNames("page")
+	c.SetParamValues(page)
+
+	require.NoError(t, mt.PushAPIHandler(c))
+	var resp ResponseMsg
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return rec.Code, resp
+}
+
+func TestPushRegisterUpdate(t *testing.T) {
+	println("TestPushRegisterUpdate started")
+	mt := newPushFactory(t, DefaultConfig())
+
+	code, resp := push(t, mt, "test", "secret", `{"updatefreq":"minute","balance":"10"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Error)
+	assert.True(t, mt.pages.Claimed("test"))
+
+	code, resp = push(t, mt, "test", "secret", `{"balance":"100","orders":{"123":{"symbol":"EURUSD"}}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Error)
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "100", acc.Balance.String())
+		assert.Equal(t, "EURUSD", acc.Orders["123"].Symbol)
+	}
+
+	code, resp = push(t, mt, "test", "another", `{"balance":"0"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, ErrCodeWrongSecret, resp.Code)
+
+	code, resp = push(t, mt, "test", "", `{"balance":"0"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, ErrCodeSecretRequired, resp.Code)
+
+	code, resp = push(t, mt, "test", "secret", `{"page":"test2","balance":"0"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Error, "does not match the URL")
+
+	code, resp = push(t, mt, "test", "secret", `{"balance":"ten"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Error, "Message is not valid")
+
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "100", acc.Balance.String())
+	}
+}
+
+func TestPushSlowRegistration(t *testing.T) {
+	println("TestPushSlowRegistration started")
+	mt := newPushFactory(t, DefaultConfig())
+	code, _ := push(t, mt, "test", "secret", `{"updatefreq":"minute","balance":"10"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	// Registration of another page waits for the registry, as it does for bcrypt
+	mt.pages.Lock()
+	registered := make(chan int)
+	go func() {
+		code, _ := push(t, mt, "test2", "secret", `{"updatefreq":"minute"}`)
+		registered <- code
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	updated := make(chan int)
+	go func() {
+		code, _ := push(t, mt, "test", "secret", `{"balance":"20"}`)
+		updated <- code
+	}()
+	select {
+	case code := <-updated:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(TestTimeoutSeconds):
+		assert.Fail(t, "Push is stalled by registration of another page")
+	}
+	mt.pages.Unlock()
+	assert.Equal(t, http.StatusOK, <-registered)
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "20", acc.Balance.String())
+	}
+}
+
+func TestPushPageInUse(t *testing.T) {
+	println("TestPushPageInUse started")
+	mt := newPushFactory(t, DefaultConfig())
+	mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+
+	code, resp := push(t, mt, "test", "secret", `{"updatefreq":"second"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Error, "already in use")
+	assert.False(t, mt.pages.Claimed("test"))
+}
+
+func TestPushExpire(t *testing.T) {
+	println("TestPushExpire started")
+	cfg := DefaultConfig()
+	cfg.SecondTimeout = Duration(100 * time.Millisecond)
+	mt := newPushFactory(t, cfg)
+
+	code, _ := push(t, mt, "test", "secret", `{"updatefreq":"second"}`)
+	require.Equal(t, http.StatusOK, code)
+	acc := mt.PageExist("test")
+	require.NotNil(t, acc)
+
+	// Pushes keep the account alive
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		code, _ = push(t, mt, "test", "secret", `{"heartbeat":true}`)
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	assert.Eventually(t, func() bool {
+		mt.RLock()
+		defer mt.RUnlock()
+		return !acc.Online()
+	}, TestTimeoutSeconds, 10*time.Millisecond)
+	assert.True(t, mt.PageExist("test") == acc)
+
+	// The offline account is resumed with the next push
+	code, _ = push(t, mt, "test", "secret", `{"updatefreq":"second"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, mt.PageExist("test") == acc)
+	assert.True(t, acc.Online())
+}
+
+func TestPushThrottleDisconnect(t *testing.T) {
+	println("TestPushThrottleDisconnect started")
+	cfg := DefaultConfig()
+	cfg.UpdateRate = 1
+	cfg.ThrottlePolicy = ThrottleDisconnect
+	mt := newPushFactory(t, cfg)
+
+	code, _ := push(t, mt, "test", "secret", `{"updatefreq":"minute"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = push(t, mt, "test", "secret", `{"balance":"1"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, resp := push(t, mt, "test", "secret", `{"balance":"2"}`)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, ErrCodeRateExceeded, resp.Code)
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.False(t, acc.Online())
+	}
+}
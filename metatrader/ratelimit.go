@@ -0,0 +1,166 @@
+package metatrader
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottlePolicy defines what to do with updates exceeding the rate limit
+type ThrottlePolicy string
+
+// Throttle policies
+const (
+	// ThrottleDrop ignores excess updates. Order fields are sent only if changed,
+	// so viewers may miss some values until they change again. Updates of deltaorders
+	// connections are applied to the account anyway, only their broadcast is dropped
+	ThrottleDrop ThrottlePolicy = "drop"
+	// ThrottleCoalesce applies excess updates to the account, but broadcasts
+	// the latest state only when the rate allows
+	ThrottleCoalesce ThrottlePolicy = "coalesce"
+	// ThrottleDisconnect drops the connection with an error
+	ThrottleDisconnect ThrottlePolicy = "disconnect"
+)
+
+// ThrottleStats counts updates exceeded the rate limit
+type ThrottleStats struct {
+	Throttled int `json:"throttled" example:"0"`
+	Dropped   int `json:"dropped" example:"0"`
+	Coalesced int `json:"coalesced" example:"0"`
+}
+
+// tokenBucket allows bursts up to capacity, refilled at constant rate
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newTokenBucket(capacity int, interval time.Duration, now time.Time) tokenBucket {
+	return tokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		rate:     float64(capacity) / interval.Seconds(),
+		last:     now,
+	}
+}
+
+// take a token if available
+func (t *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 {
+		t.tokens += elapsed * t.rate
+		if t.tokens > t.capacity {
+			t.tokens = t.capacity
+		}
+	}
+	t.last = now
+
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// wait returns the time until the next token, as of the last take
+func (t *tokenBucket) wait() time.Duration {
+	if t.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+}
+
+// updateLimiter keeps the account broadcasting rate within declared update frequency
+// Counters are read by API handlers, so access is synchronized
+// Coalesced update is broadcasted by onFlush when the next token is available, even if the client goes quiet
+type updateLimiter struct {
+	bucket  tokenBucket
+	policy  ThrottlePolicy
+	pending bool // coalesced update is awaiting broadcast
+	counter ThrottleStats
+	onFlush func()
+	timer   *time.Timer // armed while update is pending
+	stopped bool
+	sync.Mutex
+}
+
+func newUpdateLimiter(rate int, interval time.Duration, policy ThrottlePolicy, onFlush func()) *updateLimiter {
+	return &updateLimiter{
+		bucket:  newTokenBucket(rate, interval, time.Now()),
+		policy:  policy,
+		onFlush: onFlush,
+	}
+}
+
+// allow reports whether an update may be broadcasted now
+// If not, the update is accounted according to the policy
+func (l *updateLimiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.bucket.take(time.Now()) {
+		l.pending = false
+		return true
+	}
+
+	l.counter.Throttled++
+	switch l.policy {
+	case ThrottleDrop:
+		l.counter.Dropped++
+	case ThrottleCoalesce:
+		l.counter.Coalesced++
+		l.pending = true
+		if l.timer == nil && !l.stopped && l.onFlush != nil {
+			l.timer = time.AfterFunc(l.bucket.wait(), l.flushPending)
+		}
+	}
+	return false
+}
+
+// flushPending broadcasts coalesced update if it was not sent meanwhile
+// The timer may fire just short of the token, then it's armed again
+func (l *updateLimiter) flushPending() {
+	l.Lock()
+	l.timer = nil
+	l.Unlock()
+	if l.flush() {
+		l.onFlush()
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.pending && !l.stopped && l.timer == nil {
+		l.timer = time.AfterFunc(l.bucket.wait(), l.flushPending)
+	}
+}
+
+// stop the pending flush, the account is gone
+func (l *updateLimiter) stop() {
+	l.Lock()
+	defer l.Unlock()
+	l.stopped = true
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
+
+// flush reports whether coalesced update should be broadcasted now
+func (l *updateLimiter) flush() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.stopped || !l.pending || !l.bucket.take(time.Now()) {
+		return false
+	}
+	l.pending = false
+	return true
+}
+
+// stats returns a copy of throttle counters
+func (l *updateLimiter) stats() ThrottleStats {
+	l.Lock()
+	defer l.Unlock()
+	return l.counter
+}
@@ -0,0 +1,27 @@
+package metatrader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlushPendingShortOfToken(t *testing.T) {
+	println("TestFlushPendingShortOfToken started")
+	flushed := make(chan struct{}, 1)
+	l := newUpdateLimiter(1, time.Second, ThrottleCoalesce, func() { flushed <- struct{}{} })
+	defer l.stop()
+
+	// The timer fired a bit early, the bucket is just under one token
+	l.Lock()
+	l.pending = true
+	l.bucket.tokens = 0.99
+	l.bucket.last = time.Now()
+	l.Unlock()
+	l.flushPending()
+
+	select {
+	case <-flushed:
+	case <-time.After(TestTimeoutSeconds):
+		t.Fatal("Coalesced update is not flushed")
+	}
+}
@@ -0,0 +1,262 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RedactionProfile hides account details from viewers, the page owner gets them as is
+type RedactionProfile struct {
+	// Name, login, server and company are not shown
+	HideIdentity bool `json:"hideIdentity" example:"true"`
+	// Balance, equity, margin and profits are shown as percent of the starting balance
+	RelativeBalances bool `json:"relativeBalances" example:"true"`
+	// Order volumes are not shown
+	HideLots bool `json:"hideLots" example:"false"`
+}
+
+// IsSet reports whether anything is hidden
+func (p RedactionProfile) IsSet() bool {
+	return p.HideIdentity || p.RelativeBalances || p.HideLots
+}
+
+// Redaction profile of the page, nothing is hidden on unclaimed pages
+func (r *PageRegistry) Redaction(page string) RedactionProfile {
+	r.RLock()
+	defer r.RUnlock()
+	if rec, ok := r.pages[page]; ok {
+		return rec.Redaction
+	}
+	return RedactionProfile{}
+}
+
+// SetRedaction profile of the claimed page and store the registry
+func (r *PageRegistry) SetRedaction(page string, p RedactionProfile) error {
+	r.Lock()
+	defer r.Unlock()
+	rec, ok := r.pages[page]
+	if !ok {
+		return &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+	prev := rec.Redaction
+	rec.Redaction = p
+	if err := r.save(); err != nil {
+		rec.Redaction = prev
+		return err
+	}
+	return nil
+}
+
+// RedactionHandler sets what is hidden from viewers, connected viewers get redacted data at once
+// @Summary Set the redaction profile of the page
+// @Accept json
+// @Param X-Page-Secret header string true "Page secret"
+// @Param page path string true "Account Page name"
+// @Param profile body RedactionProfile true "Redaction profile"
+// @Success 204
+// @failure 400 {string} Invalid profile
+// @failure 403 {string} Access denied
+// @failure 500 {string} Server internal error
+// @Router /pages/{page}/redaction [put]
+func (f *Factory) RedactionHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	var req RedactionProfile
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err := f.pages.SetRedaction(page, req); err != nil {
+		if _, ok := err.(*PageError); ok {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		return err
+	}
+
+	acc := f.Account(page)
+	if acc != nil {
+		acc.setRedaction(req)
+	}
+	f.log.Info("Page redaction set: ", page)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// redactor applies the profile to viewer data, zero value leaves it as is
+type redactor struct {
+	profile RedactionProfile
+	base    Decimal // starting balance
+}
+
+// percentOf returns d as percent of base with two decimals, absent if base is not positive
+func (d Decimal) percentOf(base Decimal) Decimal {
+	if !d.IsSet() || base.Sign() <= 0 {
+		return Decimal{}
+	}
+	return NewDecimal(int64(math.Round(d.Float64()/base.Float64()*1e4)), 2)
+}
+
+func (r redactor) money(d Decimal) Decimal {
+	if !r.profile.RelativeBalances {
+		return d
+	}
+	return d.percentOf(r.base)
+}
+
+// moneyString converts money value in wire form, values that can not be parsed are hidden
+func (r redactor) moneyString(s string) string {
+	if !r.profile.RelativeBalances || s == "" {
+		return s
+	}
+	d, err := ParseDecimal(s)
+	if err != nil {
+		return ""
+	}
+	return r.money(d).String()
+}
+
+func (r redactor) moneyFloat(v float64) float64 {
+	if !r.profile.RelativeBalances {
+		return v
+	}
+	if r.base.Sign() <= 0 {
+		return 0
+	}
+	return math.Round(v/r.base.Float64()*1e4) / 100
+}
+
+// message redacts the account snapshot in place
+func (r redactor) message(msg *Message) *Message {
+	if r.profile.HideIdentity {
+		msg.Name, msg.Login, msg.Server, msg.Company = "", "", "", ""
+	}
+	msg.Balance = r.moneyString(msg.Balance)
+	msg.Equity = r.moneyString(msg.Equity)
+	msg.Margin = r.moneyString(msg.Margin)
+	msg.FreeMargin = r.moneyString(msg.FreeMargin)
+	msg.ProfitTotal = r.moneyString(msg.ProfitTotal)
+	for tick, ord := range msg.Orders {
+		msg.Orders[tick] = r.order(ord)
+	}
+	return msg
+}
+
+func (r redactor) order(ord Order) Order {
+	if r.profile.HideLots {
+		ord.InitVolume, ord.CurVolume = "", ""
+	}
+	ord.Profit = r.moneyString(ord.Profit)
+	ord.Swap = r.moneyString(ord.Swap)
+	return ord
+}
+
+func (r redactor) closedOrders(orders []ClosedOrder) []ClosedOrder {
+	ret := make([]ClosedOrder, len(orders))
+	for i, ord := range orders {
+		ret[i] = ord
+		ret[i].Order = r.order(ord.Order)
+	}
+	return ret
+}
+
+func (r redactor) events(events []OrderEvent) []OrderEvent {
+	ret := make([]OrderEvent, len(events))
+	for i, ev := range events {
+		ret[i] = ev
+		ret[i].Order = r.order(ev.Order)
+		if ev.Previous != nil {
+			prev := r.order(*ev.Previous)
+			ret[i].Previous = &prev
+		}
+	}
+	return ret
+}
+
+func (r redactor) series(points []SeriesPoint) []SeriesPoint {
+	ret := make([]SeriesPoint, len(points))
+	for i, p := range points {
+		ret[i] = p
+		ret[i].Balance = r.money(p.Balance)
+		ret[i].Equity = r.money(p.Equity)
+		ret[i].EquityMin = r.money(p.EquityMin)
+		ret[i].EquityMax = r.money(p.EquityMax)
+		ret[i].ProfitTotal = r.money(p.ProfitTotal)
+	}
+	return ret
+}
+
+func (r redactor) performance(st PerformanceStats) PerformanceStats {
+	st.GrossProfit = r.money(st.GrossProfit)
+	st.GrossLoss = r.money(st.GrossLoss)
+	st.NetProfit = r.money(st.NetProfit)
+	st.LargestWin = r.money(st.LargestWin)
+	st.LargestLoss = r.money(st.LargestLoss)
+	st.MaxDrawdown = r.money(st.MaxDrawdown)
+	st.AverageWin = r.moneyFloat(st.AverageWin)
+	st.AverageLoss = r.moneyFloat(st.AverageLoss)
+	return st
+}
+
+// redactor of the account viewers
+func (a *Account) redactor() redactor {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return redactor{profile: a.redaction, base: a.startBalance}
+}
+
+// viewRedactor leaves data as is for the owner
+func (a *Account) viewRedactor(raw bool) redactor {
+	if raw {
+		return redactor{}
+	}
+	return a.redactor()
+}
+
+// Redaction returns the profile applied to viewers
+func (a *Account) Redaction() RedactionProfile {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.redaction
+}
+
+// setRedaction applies the profile to viewers
+// Delta viewers get new snapshots, as their documents do not match the new form
+func (a *Account) setRedaction(p RedactionProfile) {
+	a.broadcastMu.Lock()
+	defer a.broadcastMu.Unlock()
+
+	a.mu.Lock()
+	a.redaction = p
+	a.mu.Unlock()
+
+	data, raw := a.encode(a.accountData)
+	snapshot := a.delta.rebase(data)
+	var rawSnapshot []byte
+	if raw != nil {
+		rawSnapshot = a.rawDelta.rebase(raw)
+	}
+	a.broker.publish(ChannelDelta, snapshot, rawSnapshot)
+	a.broker.publish(ChannelAccount, data, raw)
+}
+
+// encode marshals the view for viewers, and for the owner if the page is redacted
+// raw is nil if the owner gets the same data as viewers
+func (a *Account) encode(view func(r redactor) interface{}) (data, raw []byte) {
+	r := a.redactor()
+	data, _ = json.Marshal(view(r))
+	if r.profile.IsSet() {
+		raw, _ = json.Marshal(view(redactor{}))
+	}
+	return data, raw
+}
+
+// accountData is the account snapshot with its status redacted for viewers
+func (a *Account) accountData(r redactor) interface{} {
+	data := AccountData{Message: r.message(a.Snapshot()), AccountStatus: a.Status()}
+	if r.profile.IsSet() {
+		profile := r.profile
+		data.Redaction = &profile
+	}
+	return data
+}
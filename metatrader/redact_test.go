@@ -0,0 +1,133 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRedactor(t *testing.T) {
+	println("TestRedactor started")
+	msg := &Message{Name: "Alexandre Dumas", Login: "010203", Server: "server", Company: "company",
+		Balance: "1100.00", Equity: "990", ProfitTotal: "-10",
+		Orders: map[OrderTicket]Order{"1": {Symbol: "EURUSD", InitVolume: "0.1", CurVolume: "0.1", Profit: "25", Swap: "bad"}}}
+
+	// Zero redactor leaves data as is
+	assert.Equal(t, "1100.00", redactor{}.message(&Message{Balance: "1100.00"}).Balance)
+
+	r := redactor{profile: RedactionProfile{HideIdentity: true, RelativeBalances: true, HideLots: true}, base: NewDecimal(1000, 0)}
+	r.message(msg)
+	assert.Empty(t, msg.Name+msg.Login+msg.Server+msg.Company)
+	assert.Equal(t, "110.00", msg.Balance)
+	assert.Equal(t, "99.00", msg.Equity)
+	assert.Equal(t, "-1.00", msg.ProfitTotal)
+	assert.Empty(t, msg.Margin)
+	assert.Equal(t, Order{Symbol: "EURUSD", Profit: "2.50"}, msg.Orders["1"])
+
+	// Nothing is shown without the starting balance
+	assert.Empty(t, redactor{profile: RedactionProfile{RelativeBalances: true}}.moneyString("100"))
+	assert.Equal(t, 0.0, redactor{profile: RedactionProfile{RelativeBalances: true}}.moneyFloat(100))
+
+	lots := redactor{profile: RedactionProfile{HideLots: true}}
+	assert.Equal(t, []SeriesPoint{{Balance: NewDecimal(5, 0)}}, lots.series([]SeriesPoint{{Balance: NewDecimal(5, 0)}}))
+	st := r.performance(PerformanceStats{NetProfit: NewDecimal(-50, 0), AverageWin: 25})
+	assert.Equal(t, "-5.00", st.NetProfit.String())
+	assert.Equal(t, 2.5, st.AverageWin)
+}
+
+func TestRegistryRedaction(t *testing.T) {
+	println("TestRegistryRedaction started")
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+
+	profile := RedactionProfile{HideIdentity: true}
+	assertPageError(t, ErrCodeUnknownPage, r.SetRedaction("test", profile))
+	assert.Equal(t, RedactionProfile{}, r.Redaction("test"))
+
+	require.NoError(t, r.Authenticate("test", "secret"))
+	require.NoError(t, r.SetRedaction("test", profile))
+	assert.Equal(t, profile, r.Redaction("test"))
+
+	// Transfer keeps the profile
+	require.NoError(t, r.Transfer("test", "new-secret"))
+	assert.Equal(t, profile, r.Redaction("test"))
+}
+
+func TestRedactedPage(t *testing.T) {
+	println("TestRedactedPage started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	s := httptest.NewServer(mt.newAPIServer())
+	defer s.Close()
+	require.NoError(t, mt.pages.Authenticate("test", "secret"))
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second", Name: "Alexandre Dumas", Balance: "200", Equity: "250"})
+
+	wsURL := strings.Replace(s.URL, "http", "ws", 1)
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss/test", nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"name":"Alexandre Dumas"`)
+
+	// Only the owner sets the profile, connected viewers get redacted data at once
+	profile := `{"hideIdentity":true,"relativeBalances":true}`
+	code, _ := apiCall(t, http.MethodPut, s.URL+"/api/pages/test/redaction", profile, "X-Page-Secret", "wrong")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = apiCall(t, http.MethodPut, s.URL+"/api/pages/test/redaction", profile, "X-Page-Secret", "secret")
+	require.Equal(t, http.StatusNoContent, code)
+	assert.True(t, mt.pages.Redaction("test").RelativeBalances)
+	assert.True(t, acc.Redaction().HideIdentity)
+
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err = ws.ReadMessage()
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Alexandre Dumas")
+	assert.Contains(t, string(data), `"equity":"125.00"`)
+	assert.Contains(t, string(data), `"redaction":{"hideIdentity":true`)
+
+	code, body := apiCall(t, http.MethodGet, s.URL+"/api/rest/test", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "Alexandre Dumas")
+	assert.Contains(t, body, `"balance":"100.00"`)
+
+	// Owner token gets data as is
+	code, body = apiCall(t, http.MethodPost, s.URL+"/api/pages/test/tokens", `{"owner":true}`, "X-Page-Secret", "secret")
+	require.Equal(t, http.StatusOK, code)
+	var token ViewerToken
+	require.NoError(t, json.Unmarshal([]byte(body), &token))
+
+	_, body = apiCall(t, http.MethodGet, s.URL+"/api/rest/test?token="+token.Token, "")
+	assert.Contains(t, body, `"name":"Alexandre Dumas"`)
+	assert.Contains(t, body, `"balance":"200"`)
+	assert.NotContains(t, body, `"redaction"`)
+
+	owner, _, err := websocket.DefaultDialer.Dial(wsURL+"/api/wss/test?token="+token.Token, nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	owner.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err = owner.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"name":"Alexandre Dumas"`)
+
+	// Updates are sent to both in their own form
+	acc.update(&Message{Page: "test", Name: "Alexandre Dumas", Balance: "200", Equity: "300"})
+	acc.SendUpdateToAllViewers()
+	ws.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err = ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"equity":"150.00"`)
+	owner.SetReadDeadline(time.Now().Add(TestTimeoutSeconds))
+	_, data, err = owner.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"equity":"300"`)
+}
@@ -0,0 +1,230 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Error codes sent in ResponseMsg.Code
+const (
+	ErrCodeUnknownPage        = "unknown_page"        // page is not registered and can not be claimed
+	ErrCodeWrongSecret        = "wrong_secret"        // page is claimed with another secret
+	ErrCodeSecretRequired     = "secret_required"     // anonymous pages are not allowed
+	ErrCodeVersionUnsupported = "version_unsupported" // client version is below the minimum
+	ErrCodeRateExceeded       = "rate_exceeded"       // client is disconnected for exceeding update rate
+	ErrCodeEvicted            = "account_evicted"     // account is removed for missing updates
+	ErrCodeInvalidMessage     = "invalid_message"     // message failed validation, see ResponseMsg.Validation
+)
+
+// RegistryConfig keeps page ownership settings
+type RegistryConfig struct {
+	// Claimed pages are stored here, in-memory only if empty
+	File string `json:"file"`
+	// Unregistered page is claimed by the first client presenting a secret
+	// Otherwise pages are created by administrator only
+	OpenRegistration bool `json:"openRegistration"`
+	// Reject clients without a secret. Otherwise unclaimed pages may be used anonymously
+	RequireSecret bool `json:"requireSecret"`
+	// Token for /api/admin routes, admin API is disabled if empty
+	AdminToken string `json:"adminToken"`
+	// Viewer tokens of private pages are signed with this key
+	// Random key is used if empty, so tokens are valid until restart
+	TokenKey string `json:"tokenKey"`
+	// Viewer tokens are issued for this long at most
+	MaxTokenTTL Duration `json:"maxTokenTTL"`
+}
+
+// PageError tells the client why the page can not be used
+type PageError struct {
+	Code string
+	Text string
+}
+
+func (e *PageError) Error() string {
+	return e.Text
+}
+
+// PageRecord keeps page owner credentials
+type PageRecord struct {
+	SecretHash string           `json:"secretHash"` // bcrypt hash, plain secret is never stored
+	Claimed    time.Time        `json:"claimed"`
+	Visibility PageVisibility   `json:"visibility,omitempty"` // public if empty
+	Redaction  RedactionProfile `json:"redaction"`
+}
+
+// PageRegistry keeps claimed pages
+type PageRegistry struct {
+	cfg   RegistryConfig
+	pages map[string]*PageRecord
+	key   []byte // viewer tokens signing key
+	sync.RWMutex
+}
+
+// NewPageRegistry loads claimed pages from file if configured
+func NewPageRegistry(cfg RegistryConfig) (*PageRegistry, error) {
+	key, err := tokenKey(cfg.TokenKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &PageRegistry{
+		cfg:   cfg,
+		pages: make(map[string]*PageRecord),
+		key:   key,
+	}
+	if cfg.File == "" {
+		return r, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.File)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.pages); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Authenticate the client willing to use the page
+// Unclaimed page is claimed with the secret if registration is open
+func (r *PageRegistry) Authenticate(page, secret string) error {
+	// Hash comparison is slow, so do not block other pages meanwhile
+	r.RLock()
+	rec, ok := r.pages[page]
+	r.RUnlock()
+
+	if ok {
+		if bcrypt.CompareHashAndPassword([]byte(rec.SecretHash), []byte(secret)) != nil {
+			return &PageError{Code: ErrCodeWrongSecret, Text: "Secret key for page " + page + " is not valid"}
+		}
+		return nil
+	}
+
+	if secret == "" && r.cfg.RequireSecret {
+		return &PageError{Code: ErrCodeSecretRequired, Text: "Secret key is required to use page " + page}
+	}
+	if !r.cfg.OpenRegistration {
+		return &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+	if secret == "" {
+		return nil
+	}
+
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.pages[page]; ok {
+		return &PageError{Code: ErrCodeWrongSecret, Text: "Page " + page + " has just been claimed by another client"}
+	}
+	return r.set(page, hash)
+}
+
+// Claimed reports whether the page has an owner
+func (r *PageRegistry) Claimed(page string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.pages[page]
+	return ok
+}
+
+// Pages returns sorted list of claimed pages
+func (r *PageRegistry) Pages() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	pages := make([]string, 0, len(r.pages))
+	for page := range r.pages {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+	return pages
+}
+
+// Reset releases the page, so it may be claimed again
+func (r *PageRegistry) Reset(page string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	rec, ok := r.pages[page]
+	if !ok {
+		return &PageError{Code: ErrCodeUnknownPage, Text: "Page " + page + " is not registered"}
+	}
+	delete(r.pages, page)
+	if err := r.save(); err != nil {
+		r.pages[page] = rec
+		return err
+	}
+	return nil
+}
+
+// Transfer the page to the owner of new secret, unregistered page is created
+func (r *PageRegistry) Transfer(page, secret string) error {
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.set(page, hash)
+}
+
+// hashSecret is slow, so it's called before the registry is locked
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// set page secret hash and store the registry, should be called under lock
+func (r *PageRegistry) set(page, hash string) error {
+	prev, existed := r.pages[page]
+	r.pages[page] = &PageRecord{
+		SecretHash: hash,
+		Claimed:    time.Now(),
+	}
+	if existed {
+		// The new owner has the same audience until changed
+		r.pages[page].Visibility = prev.Visibility
+		r.pages[page].Redaction = prev.Redaction
+	}
+	if err := r.save(); err != nil {
+		// Keep memory consistent with the file
+		if existed {
+			r.pages[page] = prev
+		} else {
+			delete(r.pages, page)
+		}
+		return err
+	}
+	return nil
+}
+
+// save registry to file, should be called under lock
+func (r *PageRegistry) save() error {
+	if r.cfg.File == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.pages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so the file is never left half-written
+	tmp := r.cfg.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.cfg.File)
+}
@@ -0,0 +1,98 @@
+package metatrader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryClaim(t *testing.T) {
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+
+	// Anonymous usage does not claim the page
+	assert.NoError(t, r.Authenticate("test", ""))
+	assert.False(t, r.Claimed("test"))
+
+	// The first secret claims the page
+	assert.NoError(t, r.Authenticate("test", "secret"))
+	assert.True(t, r.Claimed("test"))
+	assert.NotEqual(t, "secret", r.pages["test"].SecretHash)
+
+	assert.NoError(t, r.Authenticate("test", "secret"))
+	assertPageError(t, ErrCodeWrongSecret, r.Authenticate("test", "another"))
+	assertPageError(t, ErrCodeWrongSecret, r.Authenticate("test", ""))
+}
+
+func TestRegistryClosed(t *testing.T) {
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: false})
+	require.NoError(t, err)
+
+	assertPageError(t, ErrCodeUnknownPage, r.Authenticate("test", ""))
+	assertPageError(t, ErrCodeUnknownPage, r.Authenticate("test", "secret"))
+
+	require.NoError(t, r.Transfer("test", "secret"))
+	assert.NoError(t, r.Authenticate("test", "secret"))
+}
+
+func TestRegistryRequireSecret(t *testing.T) {
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true, RequireSecret: true})
+	require.NoError(t, err)
+
+	assertPageError(t, ErrCodeSecretRequired, r.Authenticate("test", ""))
+	assert.NoError(t, r.Authenticate("test", "secret"))
+}
+
+func TestRegistryResetTransfer(t *testing.T) {
+	r, err := NewPageRegistry(RegistryConfig{OpenRegistration: true})
+	require.NoError(t, err)
+
+	require.NoError(t, r.Authenticate("test", "secret"))
+	require.NoError(t, r.Transfer("test", "new-secret"))
+	assertPageError(t, ErrCodeWrongSecret, r.Authenticate("test", "secret"))
+	assert.NoError(t, r.Authenticate("test", "new-secret"))
+
+	require.NoError(t, r.Reset("test"))
+	assert.False(t, r.Claimed("test"))
+	assertPageError(t, ErrCodeUnknownPage, r.Reset("test"))
+
+	// Anyone may claim it again
+	assert.NoError(t, r.Authenticate("test", "another"))
+}
+
+func TestRegistryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine-registry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := RegistryConfig{
+		File:             filepath.Join(dir, "pages.json"),
+		OpenRegistration: true,
+	}
+
+	r, err := NewPageRegistry(cfg)
+	require.NoError(t, err)
+	require.NoError(t, r.Authenticate("test", "secret"))
+	require.NoError(t, r.Authenticate("test2", "secret2"))
+	require.NoError(t, r.Reset("test2"))
+
+	data, err := ioutil.ReadFile(cfg.File)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret\"")
+
+	// Claims survive restart
+	r, err = NewPageRegistry(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test"}, r.Pages())
+	assert.NoError(t, r.Authenticate("test", "secret"))
+	assertPageError(t, ErrCodeWrongSecret, r.Authenticate("test", "secret2"))
+}
+
+func assertPageError(t *testing.T, code string, err error) {
+	if pe, ok := err.(*PageError); assert.True(t, ok, "PageError expected, got %v", err) {
+		assert.Equal(t, code, pe.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package metatrader
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Series resolutions and the number of points kept for each
+const (
+	ResolutionSecond = "second"
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+
+	SeriesSeconds = 900  // 15 minutes
+	SeriesMinutes = 1440 // 1 day
+	SeriesHours   = 720  // 30 days
+)
+
+// SeriesPoint keeps the account values at the end of the period
+// Equity minimum and maximum are kept for the whole period
+type SeriesPoint struct {
+	Time        time.Time `json:"time" example:"2021-01-06T09:12:00+03:00"`
+	Balance     Decimal   `json:"balance" swaggertype:"string" example:"1000.00"`
+	Equity      Decimal   `json:"equity" swaggertype:"string" example:"1010.50"`
+	EquityMin   Decimal   `json:"equitymin" swaggertype:"string" example:"990.10"`
+	EquityMax   Decimal   `json:"equitymax" swaggertype:"string" example:"1020.00"`
+	MarginLevel Decimal   `json:"marginlevel" swaggertype:"string" example:"1500.0"`
+	ProfitTotal Decimal   `json:"profittotal" swaggertype:"string" example:"10.50"`
+}
+
+// merge values received later in the same period
+func (p *SeriesPoint) merge(upd SeriesPoint) {
+	if upd.Equity.IsSet() {
+		if !p.EquityMin.IsSet() || upd.Equity.Cmp(p.EquityMin) < 0 {
+			p.EquityMin = upd.Equity
+		}
+		if !p.EquityMax.IsSet() || upd.Equity.Cmp(p.EquityMax) > 0 {
+			p.EquityMax = upd.Equity
+		}
+	}
+	p.Balance = upd.Balance
+	p.Equity = upd.Equity
+	p.MarginLevel = upd.MarginLevel
+	p.ProfitTotal = upd.ProfitTotal
+}
+
+// seriesRing keeps the last points of one resolution
+type seriesRing struct {
+	step   time.Duration
+	size   int
+	points []SeriesPoint
+	first  int // the oldest point when the ring is full
+}
+
+func newSeriesRing(step time.Duration, size int) *seriesRing {
+	return &seriesRing{step: step, size: size}
+}
+
+// last returns the newest point
+func (r *seriesRing) last() *SeriesPoint {
+	if len(r.points) == 0 {
+		return nil
+	}
+	return &r.points[(r.first+len(r.points)-1)%len(r.points)]
+}
+
+// add the values, they are merged into the last point if it's the same period
+func (r *seriesRing) add(p SeriesPoint) {
+	p.Time = p.Time.Truncate(r.step)
+	if last := r.last(); last != nil && !p.Time.After(last.Time) {
+		last.merge(p)
+		return
+	}
+
+	p.EquityMin, p.EquityMax = p.Equity, p.Equity
+	if len(r.points) < r.size {
+		r.points = append(r.points, p)
+		return
+	}
+	r.points[r.first] = p
+	r.first = (r.first + 1) % r.size
+}
+
+// restore points from the snapshot, the oldest first
+func (r *seriesRing) restore(points []SeriesPoint) {
+	if len(points) > r.size {
+		points = points[len(points)-r.size:]
+	}
+	r.points = append([]SeriesPoint(nil), points...)
+	r.first = 0
+}
+
+// between returns points of the periods from..to, the oldest first
+func (r *seriesRing) between(from, to time.Time) []SeriesPoint {
+	from = from.Truncate(r.step)
+	ret := []SeriesPoint{}
+	for i := range r.points {
+		p := r.points[(r.first+i)%len(r.points)]
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// accountSeries keeps account values in all resolutions
+type accountSeries struct {
+	rings map[string]*seriesRing
+}
+
+func newAccountSeries() *accountSeries {
+	return &accountSeries{rings: map[string]*seriesRing{
+		ResolutionSecond: newSeriesRing(time.Second, SeriesSeconds),
+		ResolutionMinute: newSeriesRing(time.Minute, SeriesMinutes),
+		ResolutionHour:   newSeriesRing(time.Hour, SeriesHours),
+	}}
+}
+
+func (s *accountSeries) add(p SeriesPoint) {
+	for _, r := range s.rings {
+		r.add(p)
+	}
+}
+
+// recordSeries adds the current values, should be called under account lock
+// Nothing is recorded until MetaTrader sends any of the values
+func (a *Account) recordSeries(now time.Time) {
+	if !a.Balance.IsSet() && !a.Equity.IsSet() && !a.MarginLevel.IsSet() && !a.ProfitTotal.IsSet() {
+		return
+	}
+	a.series.add(SeriesPoint{
+		Time:        now,
+		Balance:     a.Balance,
+		Equity:      a.Equity,
+		MarginLevel: a.MarginLevel,
+		ProfitTotal: a.ProfitTotal,
+	})
+}
+
+// Series returns points of the resolution recorded from..to
+func (a *Account) Series(resolution string, from, to time.Time) ([]SeriesPoint, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	r, ok := a.series.rings[resolution]
+	if !ok {
+		return nil, errors.New("Resolution " + resolution + " is unknown")
+	}
+	return r.between(from, to), nil
+}
+
+// parseSeriesTime accepts both RFC 3339 and Unix time in seconds, empty string is def
+func parseSeriesTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errors.New("Time " + s + " is not valid")
+	}
+	return t, nil
+}
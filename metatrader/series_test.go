@@ -0,0 +1,103 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func seriesPoint(t time.Time, equity string) SeriesPoint {
+	eq, _ := ParseDecimal(equity)
+	return SeriesPoint{Time: t, Balance: NewDecimal(1000, 0), Equity: eq}
+}
+
+func TestSeriesRing(t *testing.T) {
+	println("TestSeriesRing started")
+	start := time.Date(2021, 1, 6, 9, 0, 0, 0, time.UTC)
+	r := newSeriesRing(time.Minute, 3)
+
+	// Points of the same minute are merged
+	r.add(seriesPoint(start.Add(10*time.Second), "100"))
+	r.add(seriesPoint(start.Add(20*time.Second), "90"))
+	r.add(seriesPoint(start.Add(30*time.Second), "120"))
+	r.add(seriesPoint(start.Add(40*time.Second), "110"))
+
+	points := r.between(time.Time{}, start.Add(time.Hour))
+	require.Len(t, points, 1)
+	assert.Equal(t, start, points[0].Time)
+	assert.Equal(t, "110", points[0].Equity.String())
+	assert.Equal(t, "90", points[0].EquityMin.String())
+	assert.Equal(t, "120", points[0].EquityMax.String())
+	assert.Equal(t, "1000", points[0].Balance.String())
+
+	// The oldest points are overwritten
+	for i := 1; i <= 4; i++ {
+		r.add(seriesPoint(start.Add(time.Duration(i)*time.Minute), "100"))
+	}
+	points = r.between(time.Time{}, start.Add(time.Hour))
+	if assert.Len(t, points, 3) {
+		assert.Equal(t, start.Add(2*time.Minute), points[0].Time)
+		assert.Equal(t, start.Add(4*time.Minute), points[2].Time)
+	}
+
+	// Start time is rounded down to the period
+	points = r.between(start.Add(3*time.Minute+30*time.Second), start.Add(3*time.Minute))
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, start.Add(3*time.Minute), points[0].Time)
+	}
+}
+
+func TestSeriesAPI(t *testing.T) {
+	println("TestSeriesAPI started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	get := func(query string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetPath("/api/rest/:page/series")
+		c.SetParamNames("page")
+		c.SetParamValues("test")
+		require.NoError(t, mt.SeriesAPIHandler(c))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := get("")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+	code, body := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+
+	acc.update(&Message{Balance: "1000.00", Equity: "990.5", ProfitTotal: "-9.5"})
+	for _, res := range []string{"resolution=second", "resolution=minute", "resolution=hour&from=0"} {
+		code, body = get(res)
+		assert.Equal(t, http.StatusOK, code, res)
+		var points []map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(body), &points))
+		if assert.Len(t, points, 1, res) {
+			assert.Equal(t, "1000.00", points[0]["balance"])
+			assert.Equal(t, "990.5", points[0]["equity"])
+			assert.Equal(t, "-9.5", points[0]["profittotal"])
+			assert.Nil(t, points[0]["marginlevel"])
+		}
+	}
+
+	code, body = get("to=2021-01-06T09:00:00Z")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+
+	code, _ = get("resolution=day")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,162 @@
+package metatrader
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SSEHeartbeat is the default interval of heartbeat comments keeping proxies from closing idle streams
+const SSEHeartbeat = 15 * time.Second
+
+// Slow clients fail to take the event in time, as WebSocket viewers do
+const sseWriteTimeout = 500 * time.Millisecond
+
+// sseViewer is Server-Sent Events stream, the broker sees it as a viewer
+// The stream owns hijacked connection, so each write is bounded by its deadline
+type sseViewer struct {
+	conn      net.Conn
+	addr      string
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+func newSSEViewer(conn net.Conn, r *http.Request) *sseViewer {
+	return &sseViewer{conn: conn, addr: r.RemoteAddr, done: make(chan struct{})}
+}
+
+// Send the message with its ID, client sends it back as Last-Event-ID after reconnect
+func (v *sseViewer) Send(msg ViewerMessage) error {
+	var buf bytes.Buffer
+	buf.WriteString("id: " + msg.ID + "\n")
+	for _, line := range bytes.Split(msg.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return v.write(buf.Bytes())
+}
+
+// comment is ignored by clients but keeps the connection busy
+func (v *sseViewer) comment(text string) error {
+	return v.write([]byte(": " + text + "\n\n"))
+}
+
+func (v *sseViewer) write(data []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	select {
+	case <-v.done:
+		return ErrViewerClosed
+	default:
+	}
+	v.conn.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	_, err := v.conn.Write(data)
+	return err
+}
+
+// Close ends the stream, the handler returns
+// Pending write is not waited for, it fails as the connection is closed
+func (v *sseViewer) Close() error {
+	var err error
+	v.closeOnce.Do(func() {
+		close(v.done)
+		err = v.conn.Close()
+	})
+	return err
+}
+
+// watch the client closing the stream, it sends nothing after the request
+func (v *sseViewer) watch(r io.Reader) {
+	io.Copy(ioutil.Discard, r)
+	v.Close()
+}
+
+// ID is the remote address of the client
+func (v *sseViewer) ID() string {
+	return v.addr
+}
+
+// SseAPIHandler streams account updates as Server-Sent Events
+// Messages are the same as WebSocket ones, each has an ID
+// Client reconnecting with Last-Event-ID gets missed messages, or the current state if they are not kept
+// @Summary Provide actual data on connected account via Server-Sent Events
+// @Produce text/event-stream
+// @Param page path string true "Account Page name"
+// @Param token query string false "Viewer token, required for private page, owner token gets data without redaction. Bearer authorization header may be used instead"
+// @Param channels query string false "Comma separated channels: account, history, events, delta, status" default(account)
+// @Param Last-Event-ID header string false "ID of the last received event"
+// @Success 200 {object} AccountData
+// @failure 400 {string} Unknown channel
+// @failure 403 {string} Access token is required or not valid
+// @failure 404 {string} Page not found
+// @Router /sse/{page} [get]
+func (f *Factory) SseAPIHandler(c echo.Context) error {
+	page := c.Param("page")
+
+	channels, err := parseChannels(c.QueryParam("channels"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	acc := f.Account(page)
+	if acc == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	// Response is written to hijacked connection, net/http would block slow client writes with no deadline
+	res := c.Response()
+	h := res.Header()
+	h.Set(echo.HeaderContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "close")     // the stream ends with the connection
+	h.Set("X-Accel-Buffering", "no") // nginx
+	conn, rw, err := res.Hijack()
+	if err != nil {
+		return err
+	}
+	v := newSSEViewer(conn, c.Request())
+	defer v.Close()
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 200 OK\r\n")
+	h.Write(&head)
+	head.WriteString("\r\n")
+	if v.write(head.Bytes()) != nil {
+		return nil
+	}
+	go v.watch(rw.Reader)
+
+	claims := viewerClaims(c)
+	resumed, err := acc.broker.addViewerSince(v, c.Request().Header.Get("Last-Event-ID"), claims.Owner, channels...)
+	if err != nil {
+		return nil
+	}
+	defer acc.RemoveViewer(v)
+	if t := acc.expireViewer(v, claims.Expires); t != nil {
+		defer t.Stop()
+	}
+	if !resumed {
+		acc.sendChannels(v, channels)
+	}
+
+	heartbeat := time.NewTicker(time.Duration(f.cfg.SSEHeartbeat))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-v.done:
+			return nil
+		case <-heartbeat.C:
+			if v.comment("heartbeat") != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package metatrader
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// sseEvent is one event or comment of the stream
+type sseEvent struct {
+	id, data, comment string
+}
+
+type sseClient struct {
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+func newSSEClient(t *testing.T, url, lastID string) *sseClient {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return &sseClient{resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+func (c *sseClient) next(t *testing.T) sseEvent {
+	var ev sseEvent
+	for {
+		line, err := c.r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return ev
+		case strings.HasPrefix(line, ": "):
+			ev.comment = line[2:]
+		case strings.HasPrefix(line, "id: "):
+			ev.id = line[4:]
+		case strings.HasPrefix(line, "data: "):
+			ev.data += line[6:]
+		}
+	}
+}
+
+func (c *sseClient) close() {
+	c.resp.Body.Close()
+}
+
+func newSSEServer(t *testing.T, cfg Config) (*Factory, *httptest.Server) {
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	e := echo.New()
+	e.GET("/api/sse/:page", mt.SseAPIHandler)
+	return mt, httptest.NewServer(e)
+}
+
+func TestSSE(t *testing.T) {
+	println("TestSSE started")
+	mt, s := newSSEServer(t, DefaultConfig())
+	defer s.Close()
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second", Balance: "100"})
+
+	resp, err := http.Get(s.URL + "/api/sse/unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	c := newSSEClient(t, s.URL+"/api/sse/test?channels=account,history", "")
+	ev := c.next(t)
+	assert.Contains(t, ev.data, `"balance":"100"`)
+	assert.NotEmpty(t, ev.id)
+	assert.Contains(t, c.next(t).data, `"channel":"history","data":[]`)
+	assert.Equal(t, 1, acc.broker.Stats().Viewers)
+
+	acc.update(&Message{Balance: "110", Orders: map[OrderTicket]Order{"1": {Symbol: "EURUSD"}}})
+	acc.SendUpdateToAllViewers()
+	ev = c.next(t)
+	assert.Contains(t, ev.data, `"balance":"110"`)
+	lastID := ev.id
+
+	// Missed messages are sent after reconnect
+	c.close()
+	assert.Eventually(t, func() bool { return acc.broker.Stats().Viewers == 0 }, TestTimeoutSeconds, time.Millisecond)
+	acc.update(&Message{Balance: "120"})
+	acc.SendUpdateToAllViewers()
+	acc.update(&Message{Balance: "130"})
+	acc.SendUpdateToAllViewers()
+
+	c = newSSEClient(t, s.URL+"/api/sse/test?channels=account,history", lastID)
+	defer c.close()
+	ev = c.next(t)
+	assert.Contains(t, ev.data, `"channel":"history","data":[{"ticket":1`)
+	assert.NotEqual(t, lastID, ev.id)
+	// The older snapshot is conflated by default viewer policy
+	assert.Contains(t, c.next(t).data, `"balance":"130"`)
+
+	// Unknown ID gets the current state
+	c2 := newSSEClient(t, s.URL+"/api/sse/test", "other-1")
+	defer c2.close()
+	ev = c2.next(t)
+	assert.Contains(t, ev.data, `"balance":"130"`)
+	assert.Equal(t, 2, acc.broker.Stats().Viewers)
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	println("TestSSEHeartbeat started")
+	cfg := DefaultConfig()
+	cfg.SSEHeartbeat = Duration(20 * time.Millisecond)
+	mt, s := newSSEServer(t, cfg)
+	defer s.Close()
+	acc := mt.createAccount(&Message{Page: "test", UpdateFreq: "second"})
+
+	c := newSSEClient(t, s.URL+"/api/sse/test?channels=status", "")
+	defer c.close()
+	assert.Contains(t, c.next(t).data, `"channel":"status"`)
+	assert.Equal(t, "heartbeat", c.next(t).comment)
+
+	// Stream ends with the account
+	mt.removeAccount(acc)
+	_, err := c.r.ReadString('\n')
+	for err == nil {
+		_, err = c.r.ReadString('\n')
+	}
+}
+
+func TestSSEStalledClient(t *testing.T) {
+	println("TestSSEStalledClient started")
+	conn, client := net.Pipe()
+	defer client.Close()
+	v := newSSEViewer(conn, httptest.NewRequest(http.MethodGet, "/api/sse/test", nil))
+
+	// Client reads nothing, the write fails in time
+	start := time.Now()
+	assert.Error(t, v.Send(ViewerMessage{ID: "test-1", Data: []byte("{}")}))
+	assert.True(t, time.Since(start) < TestTimeoutSeconds)
+
+	// Close does not wait for the pending write
+	sent := make(chan error)
+	go func() { sent <- v.Send(ViewerMessage{ID: "test-2", Data: []byte("{}")}) }()
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		v.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(sseWriteTimeout / 2):
+		t.Fatal("Close waits for the write")
+	}
+	assert.Error(t, <-sent)
+}
@@ -0,0 +1,111 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AccountStatus tells whether MetaTrader is connected
+type AccountStatus struct {
+	Online bool `json:"online" example:"true"`
+	// The last update or heartbeat
+	LastSeen time.Time `json:"lastSeen" example:"2021-01-06T09:12:54.031357064+03:00"`
+	// The current connection start, absent if offline
+	ConnectedSince *time.Time `json:"connectedSince,omitempty" example:"2021-01-06T09:00:00.000000000+03:00"`
+}
+
+// AccountData is the account as REST and WebSocket viewers get it
+// Redaction is set if some data is hidden from the viewer
+type AccountData struct {
+	*Message
+	AccountStatus
+	Redaction *RedactionProfile `json:"redaction,omitempty"`
+}
+
+// Status returns the connection state of the account
+func (a *Account) Status() AccountStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	st := AccountStatus{Online: a.online, LastSeen: a.lastSeen}
+	if a.online {
+		since := a.connectedSince
+		st.ConnectedSince = &since
+	}
+	return st
+}
+
+// touch the account on heartbeat
+func (a *Account) touch(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastSeen = now
+}
+
+// setOffline marks the account disconnected, it's removed when grace timer fires
+func (a *Account) setOffline(grace *time.Timer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.online = false
+	a.graceTimer = grace
+}
+
+// stopGrace cancels removal of the offline account
+func (a *Account) stopGrace() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.graceTimer != nil {
+		a.graceTimer.Stop()
+		a.graceTimer = nil
+	}
+}
+
+// SendStatusToViewer sends the connection state as status channel message
+func (a *Account) SendStatusToViewer(viewer Viewer) {
+	msg, _ := json.Marshal(Event{Channel: ChannelStatus, Data: a.Status()})
+	a.broker.sendToViewer(viewer, ChannelStatus, msg, nil)
+}
+
+// SendStatusToAllViewers tells viewers MetaTrader is connected or disconnected
+// Account channel viewers get the whole account with the new status
+func (a *Account) SendStatusToAllViewers() {
+	msg, _ := json.Marshal(Event{Channel: ChannelStatus, Data: a.Status()})
+	a.broker.Publish(ChannelStatus, msg)
+	a.SendUpdateToAllViewers()
+}
+
+// disconnectAccount keeps the account offline for the grace period, so MetaTrader may resume it
+// Viewers stay connected meanwhile
+func (f *Factory) disconnectAccount(acc *Account) {
+	grace := time.Duration(f.cfg.OfflineGrace)
+	if grace <= 0 {
+		f.removeAccount(acc)
+		return
+	}
+	f.startGrace(acc, grace)
+	acc.SendStatusToAllViewers()
+}
+
+// startGrace marks the account offline and removes it after grace period unless resumed
+func (f *Factory) startGrace(acc *Account, grace time.Duration) {
+	acc.setOffline(time.AfterFunc(grace, func() {
+		if f.expireAccount(acc) {
+			f.log.Info("Offline account removed: ", acc.Page)
+		}
+	}))
+}
+
+// expireAccount removes the account if it's still offline
+func (f *Factory) expireAccount(acc *Account) bool {
+	f.store.begin()
+	defer f.store.end()
+	f.Lock()
+	defer f.Unlock()
+
+	// Resumed accounts are marked online under factory lock
+	if f.accounts[acc.Page] != acc || acc.Online() {
+		return false
+	}
+	f.deleteAccount(acc)
+	return true
+}
@@ -0,0 +1,107 @@
+package metatrader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOfflineGrace(t *testing.T) {
+	println("TestOfflineGrace started")
+	cfg := DefaultConfig()
+	cfg.OfflineGrace = Duration(50 * time.Millisecond)
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	acc, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second"}, false)
+	require.NoError(t, err)
+	mt.disconnectAccount(acc)
+	assert.False(t, acc.Online())
+	assert.True(t, mt.PageExist("test") == acc)
+
+	assert.Eventually(t, func() bool {
+		mt.RLock()
+		defer mt.RUnlock()
+		return mt.PageExist("test") == nil
+	}, TestTimeoutSeconds, 10*time.Millisecond)
+}
+
+func TestOfflineResume(t *testing.T) {
+	println("TestOfflineResume started")
+	cfg := DefaultConfig()
+	cfg.OfflineGrace = Duration(50 * time.Millisecond)
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, mt.pages.Authenticate("test", "secret"))
+
+	acc, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second"}, false)
+	require.NoError(t, err)
+	mt.disconnectAccount(acc)
+	started := acc.Status().LastSeen
+
+	// Resumed account is not removed when the grace period ends
+	resumed, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second"}, false)
+	require.NoError(t, err)
+	assert.True(t, resumed == acc)
+	st := acc.Status()
+	assert.True(t, st.Online)
+	if assert.NotNil(t, st.ConnectedSince) {
+		assert.False(t, st.ConnectedSince.Before(started))
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, mt.PageExist("test") == acc)
+
+	// Removal of another account with the same page does nothing
+	other := NewAccount(&Message{Page: "test", UpdateFreq: "second"}, zap.NewNop().Sugar())
+	mt.removeAccount(other)
+	assert.True(t, mt.PageExist("test") == acc)
+	mt.removeAccount(acc)
+	assert.Nil(t, mt.PageExist("test"))
+}
+
+func TestOfflineReplace(t *testing.T) {
+	println("TestOfflineReplace started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	acc, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Login: "111", Balance: "100"}, false)
+	require.NoError(t, err)
+	viewer := NewChannelViewer("viewer", 1)
+	require.NoError(t, acc.AddViewer(viewer))
+	mt.disconnectAccount(acc)
+
+	// Anyone may use unclaimed page, even with the same login its data is not inherited
+	require.NoError(t, mt.firstMessageCheck(&Message{Page: "test", UpdateFreq: "second", Login: "111"}))
+	replaced, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Login: "111"}, false)
+	require.NoError(t, err)
+	assert.False(t, replaced == acc)
+	assert.False(t, replaced.Balance.IsSet())
+	assert.True(t, mt.PageExist("test") == replaced)
+	assert.Eventually(t, func() bool { return isClosed(viewer) }, TestTimeoutSeconds, time.Millisecond)
+
+	// The owner of claimed page resumes its account
+	require.NoError(t, mt.pages.Authenticate("test", "secret"))
+	mt.disconnectAccount(replaced)
+	resumed, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Login: "222"}, false)
+	require.NoError(t, err)
+	assert.True(t, resumed == replaced)
+}
+
+func TestPageTaken(t *testing.T) {
+	println("TestPageTaken started")
+	mt, err := NewFactoryWithConfig("", DefaultConfig(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	// Both clients passed firstMessageCheck, the second one loses
+	acc, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second"}, false)
+	require.NoError(t, err)
+	_, err = mt.openAccount(&Message{Page: "test", UpdateFreq: "second"}, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "already in use")
+	}
+	assert.Nil(t, mt.createAccount(&Message{Page: "test", UpdateFreq: "second"}))
+	assert.True(t, mt.PageExist("test") == acc)
+}
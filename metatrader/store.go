@@ -0,0 +1,455 @@
+package metatrader
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StoreConfig keeps account state on disk across restarts
+type StoreConfig struct {
+	// Snapshot and write-ahead log are kept here, accounts are in-memory only if empty
+	Dir string `json:"dir"`
+	// Snapshot is written this often, the write-ahead log is truncated then
+	SnapshotInterval Duration `json:"snapshotInterval"`
+}
+
+// Enabled reports whether accounts are stored
+func (c StoreConfig) Enabled() bool {
+	return c.Dir != ""
+}
+
+// Files in StoreConfig.Dir
+const (
+	snapshotFile = "accounts.json"
+	walFile      = "accounts.wal"
+)
+
+// Write-ahead log operations
+const (
+	walRegister = "register"
+	walUpdate   = "update"
+	walRemove   = "remove"
+)
+
+// walRecord is one line of the write-ahead log
+type walRecord struct {
+	Op          string    `json:"op"`
+	Page        string    `json:"page"`
+	Time        time.Time `json:"time"`
+	Msg         *Message  `json:"msg,omitempty"`
+	DeltaOrders bool      `json:"deltaOrders,omitempty"`
+}
+
+// accountStore appends account changes to the write-ahead log between snapshots
+// Nil store keeps nothing
+type accountStore struct {
+	cfg   StoreConfig
+	wal   *os.File
+	walMu sync.Mutex
+	log   *zap.SugaredLogger
+	// Changes are applied and logged under read lock, snapshot is taken under write lock,
+	// so the truncated log never loses a change missing in the snapshot
+	sync.RWMutex
+}
+
+// begin the account change
+func (s *accountStore) begin() {
+	if s != nil {
+		s.RLock()
+	}
+}
+
+// end the account change
+func (s *accountStore) end() {
+	if s != nil {
+		s.RUnlock()
+	}
+}
+
+// append the record to the write-ahead log, should be called between begin and end
+// The file is not buffered, so the record survives the process crash
+func (s *accountStore) append(rec walRecord) {
+	if s == nil {
+		return
+	}
+	if rec.Msg != nil && rec.Msg.Secret != "" {
+		// Page secrets belong to the registry only
+		m := *rec.Msg
+		m.Secret = ""
+		rec.Msg = &m
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		s.log.Error("Failed to encode write-ahead log record: ", err)
+		return
+	}
+
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	if _, err := s.wal.Write(append(data, '\n')); err != nil {
+		s.log.Error("Failed to write write-ahead log: ", err)
+	}
+}
+
+// openStore restores accounts from the snapshot and write-ahead log
+// Restored accounts are offline until MetaTrader reconnects
+func (f *Factory) openStore() error {
+	cfg := f.cfg.Store
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.Dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var recs []accountRecord
+		if err := json.Unmarshal(data, &recs); err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			f.accounts[rec.Page] = f.restoreAccount(rec)
+		}
+	}
+
+	if err := f.replayLog(filepath.Join(cfg.Dir, walFile)); err != nil {
+		return err
+	}
+	grace := time.Duration(f.cfg.OfflineGrace)
+	for _, acc := range f.accounts {
+		// Offline accounts are not kept without grace period, the snapshot below drops them
+		if grace <= 0 {
+			delete(f.accounts, acc.Page)
+			acc.close()
+			continue
+		}
+		acc.online = false
+		// Replayed closes and events were sent before restart, viewers get them with the current state
+		acc.unsentHistory = nil
+		acc.unsentEvents = nil
+		acc.limiter = newUpdateLimiter(f.cfg.UpdateRate, updateInterval(acc.UpdateFreq), f.cfg.ThrottlePolicy, acc.SendUpdateToAllViewers)
+		acc.broker.setViewerQueue(f.cfg.ViewerQueueSize, f.cfg.ViewerPolicy)
+		acc.redaction = f.pages.Redaction(acc.Page)
+		f.startGrace(acc, grace)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(cfg.Dir, walFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	f.store = &accountStore{cfg: cfg, wal: wal, log: f.log}
+	if len(f.accounts) > 0 {
+		f.log.Info("Accounts restored: ", len(f.accounts))
+	}
+
+	// Replayed changes go to the snapshot, so the log starts empty
+	return f.saveSnapshot()
+}
+
+// replayLog applies write-ahead log records to restored accounts
+// The last record may be incomplete if the process crashed while writing it
+func (f *Factory) replayLog(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, MaxJSONMsgSize), 2*MaxJSONMsgSize)
+	for sc.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			f.log.Error("Write-ahead log replay is stopped at malformed record: ", err)
+			return nil
+		}
+		f.replay(rec)
+	}
+	if err := sc.Err(); err != nil {
+		f.log.Error("Write-ahead log replay is stopped: ", err)
+	}
+	return nil
+}
+
+// replay one write-ahead log record
+func (f *Factory) replay(rec walRecord) {
+	acc := f.accounts[rec.Page]
+	switch rec.Op {
+	case walRegister:
+		if rec.Msg == nil {
+			return
+		}
+		if acc != nil {
+			acc.resume(rec.Msg, rec.DeltaOrders, rec.Time)
+			return
+		}
+		acc = newAccountAt(rec.Msg, f.log, rec.Time)
+		acc.deltaOrders = rec.DeltaOrders
+		acc.historySize = f.cfg.HistorySize
+		acc.eventsSize = f.cfg.EventsSize
+		f.accounts[rec.Page] = acc
+	case walUpdate:
+		if acc != nil && rec.Msg != nil {
+			acc.updateAt(rec.Msg, rec.Time)
+		}
+	case walRemove:
+		if acc != nil {
+			delete(f.accounts, rec.Page)
+			acc.close()
+		}
+	}
+}
+
+// saveSnapshot writes all accounts and truncates the write-ahead log
+func (f *Factory) saveSnapshot() error {
+	s := f.store
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	f.RLock()
+	recs := make([]accountRecord, 0, len(f.accounts))
+	for _, acc := range f.accounts {
+		recs = append(recs, acc.record())
+	}
+	f.RUnlock()
+
+	data, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so the file is never left half-written
+	path := filepath.Join(s.cfg.Dir, snapshotFile)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	return s.wal.Truncate(0)
+}
+
+// snapshotLoop writes snapshots until the process exits
+func (f *Factory) snapshotLoop() {
+	if f.store == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(f.cfg.Store.SnapshotInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := f.saveSnapshot(); err != nil {
+			f.log.Error("Failed to save accounts snapshot: ", err)
+		}
+	}
+}
+
+// accountRecord is the account in the snapshot
+type accountRecord struct {
+	Page          string                     `json:"page"`
+	ClientVersion string                     `json:"clientVersion"`
+	UpdateFreq    string                     `json:"updateFreq"`
+	Started       time.Time                  `json:"started"`
+	Updated       time.Time                  `json:"updated"`
+	LastSeen      time.Time                  `json:"lastSeen"`
+	Name          string                     `json:"name"`
+	Login         string                     `json:"login"`
+	Server        string                     `json:"server"`
+	Company       string                     `json:"company"`
+	Balance       Decimal                    `json:"balance"`
+	Equity        Decimal                    `json:"equity"`
+	Margin        Decimal                    `json:"margin"`
+	FreeMargin    Decimal                    `json:"freeMargin"`
+	MarginLevel   Decimal                    `json:"marginLevel"`
+	ProfitTotal   Decimal                    `json:"profitTotal"`
+	StartBalance  Decimal                    `json:"startBalance"`
+	Orders        map[OrderTicket]OrderState `json:"orders"`
+	DeltaOrders   bool                       `json:"deltaOrders"`
+	History       []ClosedOrder              `json:"history"`
+	Events        []OrderEvent               `json:"events"`
+	EventSeq      uint64                     `json:"eventSeq"`
+	Series        map[string][]SeriesPoint   `json:"series"`
+	Performance   performanceRecord          `json:"performance"`
+}
+
+// performanceRecord is performance in the snapshot
+type performanceRecord struct {
+	Trades             int            `json:"trades"`
+	Wins               int            `json:"wins"`
+	Losses             int            `json:"losses"`
+	GrossProfit        Decimal        `json:"grossProfit"`
+	GrossLoss          Decimal        `json:"grossLoss"`
+	LargestWin         Decimal        `json:"largestWin"`
+	LargestLoss        Decimal        `json:"largestLoss"`
+	Symbols            map[string]int `json:"symbols"`
+	EquityPeak         Decimal        `json:"equityPeak"`
+	MaxDrawdown        Decimal        `json:"maxDrawdown"`
+	MaxDrawdownPercent float64        `json:"maxDrawdownPercent"`
+	InMarket           time.Duration  `json:"inMarket"`
+	MarketSince        time.Time      `json:"marketSince"`
+}
+
+// record returns the account state for the snapshot
+func (a *Account) record() accountRecord {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	rec := accountRecord{
+		Page:          a.Page,
+		ClientVersion: a.ClientVersion,
+		UpdateFreq:    a.UpdateFreq,
+		Started:       a.Started,
+		Updated:       a.Updated,
+		LastSeen:      a.lastSeen,
+		Name:          a.Name,
+		Login:         a.Login,
+		Server:        a.Server,
+		Company:       a.Company,
+		Balance:       a.Balance,
+		Equity:        a.Equity,
+		Margin:        a.Margin,
+		FreeMargin:    a.FreeMargin,
+		MarginLevel:   a.MarginLevel,
+		ProfitTotal:   a.ProfitTotal,
+		StartBalance:  a.startBalance,
+		Orders:        make(map[OrderTicket]OrderState, len(a.Orders)),
+		DeltaOrders:   a.deltaOrders,
+		History:       append([]ClosedOrder(nil), a.history...),
+		Events:        append([]OrderEvent(nil), a.events...),
+		EventSeq:      a.eventSeq,
+		Series:        make(map[string][]SeriesPoint),
+		Performance: performanceRecord{
+			Trades:             a.perf.trades,
+			Wins:               a.perf.wins,
+			Losses:             a.perf.losses,
+			GrossProfit:        a.perf.grossProfit,
+			GrossLoss:          a.perf.grossLoss,
+			LargestWin:         a.perf.largestWin,
+			LargestLoss:        a.perf.largestLoss,
+			Symbols:            make(map[string]int, len(a.perf.symbols)),
+			EquityPeak:         a.perf.equityPeak,
+			MaxDrawdown:        a.perf.maxDrawdown,
+			MaxDrawdownPercent: a.perf.maxDrawdownPercent,
+			InMarket:           a.perf.inMarket,
+			MarketSince:        a.perf.marketSince,
+		},
+	}
+	for tick, ord := range a.Orders {
+		rec.Orders[tick] = ord
+	}
+	for res, r := range a.series.rings {
+		rec.Series[res] = r.between(time.Time{}, maxTime)
+	}
+	for sym, cnt := range a.perf.symbols {
+		rec.Performance.Symbols[sym] = cnt
+	}
+	return rec
+}
+
+// restoreAccount creates offline account from the snapshot record
+func (f *Factory) restoreAccount(rec accountRecord) *Account {
+	acc := new(Account)
+	acc.broker = NewBroker(f.log)
+	acc.Page = rec.Page
+	acc.ClientVersion = rec.ClientVersion
+	acc.UpdateFreq = rec.UpdateFreq
+	acc.Started = rec.Started
+	acc.Updated = rec.Updated
+	acc.lastSeen = rec.LastSeen
+	if acc.lastSeen.IsZero() {
+		acc.lastSeen = rec.Updated
+	}
+	acc.Name = rec.Name
+	acc.Login = rec.Login
+	acc.Server = rec.Server
+	acc.Company = rec.Company
+	acc.Balance = rec.Balance
+	acc.Equity = rec.Equity
+	acc.Margin = rec.Margin
+	acc.FreeMargin = rec.FreeMargin
+	acc.MarginLevel = rec.MarginLevel
+	acc.ProfitTotal = rec.ProfitTotal
+	acc.startBalance = rec.StartBalance
+	if !acc.startBalance.IsSet() && acc.Balance.Sign() > 0 {
+		// Snapshot of the previous version
+		acc.startBalance = acc.Balance
+	}
+	acc.Orders = rec.Orders
+	if acc.Orders == nil {
+		acc.Orders = make(map[OrderTicket]OrderState)
+	}
+	acc.OrdersCount = len(acc.Orders)
+	acc.deltaOrders = rec.DeltaOrders
+	acc.historySize = f.cfg.HistorySize
+	acc.history = lastClosedOrders(rec.History, acc.historySize)
+	acc.eventsSize = f.cfg.EventsSize
+	acc.events = lastOrderEvents(rec.Events, acc.eventsSize)
+	acc.eventSeq = rec.EventSeq
+	acc.series = newAccountSeries()
+	for res, points := range rec.Series {
+		if r, ok := acc.series.rings[res]; ok {
+			r.restore(points)
+		}
+	}
+	p := rec.Performance
+	acc.perf = performance{
+		trades:             p.Trades,
+		wins:               p.Wins,
+		losses:             p.Losses,
+		grossProfit:        p.GrossProfit,
+		grossLoss:          p.GrossLoss,
+		largestWin:         p.LargestWin,
+		largestLoss:        p.LargestLoss,
+		symbols:            p.Symbols,
+		equityPeak:         p.EquityPeak,
+		maxDrawdown:        p.MaxDrawdown,
+		maxDrawdownPercent: p.MaxDrawdownPercent,
+		inMarket:           p.InMarket,
+		marketSince:        p.MarketSince,
+	}
+	return acc
+}
+
+func lastClosedOrders(list []ClosedOrder, size int) []ClosedOrder {
+	if len(list) > size {
+		list = list[len(list)-size:]
+	}
+	return append([]ClosedOrder(nil), list...)
+}
+
+func lastOrderEvents(list []OrderEvent, size int) []OrderEvent {
+	if len(list) > size {
+		list = list[len(list)-size:]
+	}
+	return append([]OrderEvent(nil), list...)
+}
+
+// maxTime is later than any series point
+var maxTime = time.Unix(1<<62, 0)
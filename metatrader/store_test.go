@@ -0,0 +1,181 @@
+package metatrader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newStoreFactory(t *testing.T, dir string) *Factory {
+	cfg := DefaultConfig()
+	cfg.Store.Dir = dir
+	cfg.Registry.File = filepath.Join(dir, "pages.json")
+	mt, err := NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return mt
+}
+
+func TestStoreRestore(t *testing.T) {
+	println("TestStoreRestore started")
+	dir, err := ioutil.TempDir("", "engine-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mt := newStoreFactory(t, dir)
+	// Only claimed page is resumed by reconnected MetaTrader
+	require.NoError(t, mt.pages.Authenticate("test", "my-secret-key"))
+	acc, err := mt.openAccount(&Message{
+		Page:       "test",
+		UpdateFreq: "second",
+		Secret:     "my-secret-key",
+		Balance:    "1000.00",
+		Equity:     "1000.00",
+		Orders:     map[OrderTicket]Order{"1": {Symbol: "EURUSD", Type: "0", Profit: "10"}},
+	}, false)
+	require.NoError(t, err)
+	mt.updateAccount(acc, &Message{Equity: "990", Orders: map[OrderTicket]Order{"2": {Symbol: "GBPUSD", Type: "1", SL: "1.2"}}})
+	require.NoError(t, mt.saveSnapshot())
+
+	// Changes after the snapshot are in the log only
+	mt.updateAccount(acc, &Message{Balance: "1010.50", Orders: map[OrderTicket]Order{"2": {SL: "1.3"}}})
+	_, err = mt.openAccount(&Message{Page: "gone", UpdateFreq: "minute"}, true)
+	require.NoError(t, err)
+	mt.removeAccount(mt.PageExist("gone"))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "my-secret-key")
+
+	mt = newStoreFactory(t, dir)
+	assert.Nil(t, mt.PageExist("gone"))
+	restored := mt.PageExist("test")
+	require.NotNil(t, restored)
+	assert.False(t, restored.Online())
+	assert.Equal(t, acc.Started.UnixNano(), restored.Started.UnixNano())
+	assert.Equal(t, acc.Updated.UnixNano(), restored.Updated.UnixNano())
+	assert.Equal(t, "1010.50", restored.Balance.String())
+	assert.Equal(t, "990", restored.Equity.String())
+	assert.Equal(t, "1000.00", restored.startBalance.String())
+	assert.Equal(t, acc.Snapshot().Orders, restored.Snapshot().Orders)
+	assert.Equal(t, OrderSell, restored.Orders["2"].Type)
+
+	if hist := restored.History(); assert.Len(t, hist, 1) {
+		assert.Equal(t, OrderTicket("1"), hist[0].Ticket)
+	}
+	assert.JSONEq(t, string(mustMarshal(t, acc.EventsSince(0))), string(mustMarshal(t, restored.EventsSince(0))))
+	assert.Equal(t, acc.Performance().MaxDrawdown, restored.Performance().MaxDrawdown)
+	assert.Equal(t, 1, restored.Performance().Trades)
+	points, err := restored.Series(ResolutionSecond, acc.Started, acc.Updated)
+	require.NoError(t, err)
+	if assert.NotEmpty(t, points) {
+		assert.Equal(t, "1010.50", points[len(points)-1].Balance.String())
+	}
+
+	st := mt.exportState()
+	assert.Equal(t, 0, st.Online)
+	if assert.Len(t, st.Accounts, 1) {
+		assert.False(t, st.Accounts[0].Online)
+	}
+
+	// Reconnected MetaTrader resumes the account
+	viewer := NewChannelViewer("viewer", 16)
+	require.NoError(t, restored.AddViewer(viewer, ChannelHistory, ChannelEvents))
+	lastSeq := restored.EventsSince(0).Seq
+	require.NoError(t, mt.firstMessageCheck(&Message{Page: "test", UpdateFreq: "second"}))
+	resumed, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Orders: map[OrderTicket]Order{"2": {}}}, false)
+	require.NoError(t, err)
+	assert.True(t, resumed == restored)
+	assert.True(t, resumed.Online())
+	assert.Error(t, mt.firstMessageCheck(&Message{Page: "test", UpdateFreq: "second"}))
+	assert.Equal(t, "1.3", resumed.Orders["2"].SL.String())
+
+	// Changes made before restart are not broadcasted again
+	mt.updateAccount(resumed, &Message{Orders: map[OrderTicket]Order{"2": {SL: "1.4"}}})
+	resumed.SendUpdateToAllViewers()
+	for {
+		select {
+		case msg := <-viewer.Messages():
+			var ev struct {
+				Channel string
+				Data    []struct {
+					Seq uint64 `json:"seq"`
+				}
+			}
+			require.NoError(t, json.Unmarshal(msg.Data, &ev))
+			assert.NotEqual(t, ChannelHistory, ev.Channel, "Closed order was sent before restart")
+			if ev.Channel != ChannelEvents {
+				continue
+			}
+			for _, e := range ev.Data {
+				assert.Greater(t, e.Seq, lastSeq)
+			}
+			return
+		case <-time.After(TestTimeoutSeconds):
+			t.Fatal("Events are not received")
+		}
+	}
+}
+
+func TestStoreBrokenLog(t *testing.T) {
+	println("TestStoreBrokenLog started")
+	dir, err := ioutil.TempDir("", "engine-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mt := newStoreFactory(t, dir)
+	acc, err := mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Balance: "1"}, false)
+	require.NoError(t, err)
+	mt.updateAccount(acc, &Message{Balance: "2"})
+
+	// The process crashed while writing the record
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`{"op":"update","page":"test","msg":{"bala`)
+	require.NoError(t, err)
+	wal.Close()
+
+	mt = newStoreFactory(t, dir)
+	if acc := mt.PageExist("test"); assert.NotNil(t, acc) {
+		assert.Equal(t, "2", acc.Balance.String())
+	}
+
+	// The log is compacted into the snapshot
+	data, err := ioutil.ReadFile(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestStoreNoGrace(t *testing.T) {
+	println("TestStoreNoGrace started")
+	dir, err := ioutil.TempDir("", "engine-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mt := newStoreFactory(t, dir)
+	_, err = mt.openAccount(&Message{Page: "test", UpdateFreq: "second", Balance: "1"}, false)
+	require.NoError(t, err)
+
+	// Restored accounts are removed at once without grace period
+	cfg := DefaultConfig()
+	cfg.Store.Dir = dir
+	cfg.OfflineGrace = 0
+	mt, err = NewFactoryWithConfig("", cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	assert.Nil(t, mt.PageExist("test"))
+
+	mt = newStoreFactory(t, dir)
+	assert.Nil(t, mt.PageExist("test"))
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
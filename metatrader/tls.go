@@ -0,0 +1,151 @@
+package metatrader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TLSConfig keeps MetaTrader listener TLS settings
+// Files are reloaded on change, so certificates may be renewed without dropping accounts
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Client certificates are verified against this CA bundle. Certificate CommonName
+	// pins the terminal to the page with the same name
+	ClientCAFile string `json:"clientCAFile"`
+	// Reject terminals without valid client certificate
+	RequireClientCert bool `json:"requireClientCert"`
+}
+
+// Enabled reports whether MetaTrader listener should use TLS
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// validate TLS settings, client certificates can not be required without CA to verify them
+func (c *TLSConfig) validate() error {
+	if c.Enabled() && c.KeyFile == "" {
+		return errors.New("TLS key file is not set")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		return errors.New("Client CA file is required to verify client certificates")
+	}
+	if !c.Enabled() && (c.ClientCAFile != "" || c.RequireClientCert) {
+		return errors.New("Client certificates need TLS certificate file to be set")
+	}
+	return nil
+}
+
+// certReloader keeps actual TLS config, rebuilding it when files are modified
+type certReloader struct {
+	cfg     TLSConfig
+	modTime time.Time
+	config  *tls.Config
+	log     *zap.SugaredLogger
+	sync.Mutex
+}
+
+func newCertReloader(cfg TLSConfig, log *zap.SugaredLogger) (*certReloader, error) {
+	r := &certReloader{cfg: cfg, log: log}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// serverConfig for tls.Listener, actual config is resolved on each handshake
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.lastModified().After(r.modTime) {
+		// Keep serving with previous certificates if new ones are broken
+		if err := r.reload(); err != nil {
+			r.log.Error("Failed to reload TLS certificates: ", err)
+		} else {
+			r.log.Info("TLS certificates reloaded")
+		}
+	}
+	return r.config, nil
+}
+
+// reload certificates from files
+func (r *certReloader) reload() error {
+	modTime := r.lastModified()
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in " + r.cfg.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+// lastModified returns the latest modification time of configured files
+func (r *certReloader) lastModified() time.Time {
+	var last time.Time
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		if st, err := os.Stat(name); err == nil && st.ModTime().After(last) {
+			last = st.ModTime()
+		}
+	}
+	return last
+}
+
+// verifyPagePin checks that client certificate, if any, is issued for the page
+func verifyPagePin(conn net.Conn, page string) error {
+	if stream, ok := conn.(*flateConn); ok {
+		conn = stream.Conn
+	}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	if cn := certs[0].Subject.CommonName; cn != page {
+		return errors.New("Client certificate is issued for page " + cn + ", not " + page)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package metatrader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type tlsTestSuite struct {
+	suite.Suite
+	dir         string
+	ca          *x509.Certificate
+	caKey       *ecdsa.PrivateKey
+	cfg         TLSConfig
+	mt          *Factory
+	ln          net.Listener
+	zapRecorder *observer.ObservedLogs
+	codecs      map[net.Conn]*gobCodec
+}
+
+type gobCodec struct {
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func TestTLS(t *testing.T) {
+	suite.Run(t, new(tlsTestSuite))
+}
+
+func (s *tlsTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "engine-tls")
+	s.Require().NoError(err)
+
+	// Self-signed CA issues both server and client certificates
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	tmpl := s.template("Test CA")
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &s.caKey.PublicKey, s.caKey)
+	s.Require().NoError(err)
+	s.ca, err = x509.ParseCertificate(der)
+	s.Require().NoError(err)
+
+	s.cfg = TLSConfig{
+		CertFile:     filepath.Join(s.dir, "server.crt"),
+		KeyFile:      filepath.Join(s.dir, "server.key"),
+		ClientCAFile: filepath.Join(s.dir, "ca.crt"),
+	}
+	s.writePEM(s.cfg.ClientCAFile, "CERTIFICATE", der)
+	s.writeServerCert("server")
+}
+
+func (s *tlsTestSuite) TearDownTest() {
+	if s.ln != nil {
+		s.ln.Close()
+		s.ln = nil
+	}
+	s.codecs = nil
+	os.RemoveAll(s.dir)
+}
+
+// start TLS listener on random port
+func (s *tlsTestSuite) start() {
+	core, recorder := observer.New(zapcore.DebugLevel)
+	s.zapRecorder = recorder
+
+	cfg := DefaultConfig()
+	cfg.TLS = s.cfg
+	var err error
+	s.mt, err = NewFactoryWithConfig("127.0.0.1:0", cfg, zap.New(core).Sugar())
+	s.Require().NoError(err)
+	s.ln, err = s.mt.listen(s.mt.addr)
+	s.Require().NoError(err)
+	go s.mt.serve(s.ln, s.mt.Handle)
+}
+
+func (s *tlsTestSuite) TestPlainTCP() {
+	s.cfg = TLSConfig{}
+	s.start()
+
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	if s.NoError(err) {
+		defer conn.Close()
+		resp, err := s.push(conn, &Message{Page: "test", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Empty(resp.Error)
+		}
+	}
+}
+
+func (s *tlsTestSuite) TestServerOnly() {
+	s.cfg.ClientCAFile = ""
+	s.start()
+
+	conn, err := s.dial(nil)
+	if s.NoError(err) {
+		defer conn.Close()
+		resp, err := s.push(conn, &Message{Page: "test", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Empty(resp.Error)
+		}
+		s.NotNil(s.mt.PageExist("test"))
+	}
+}
+
+func (s *tlsTestSuite) TestClientCertPinned() {
+	s.start()
+
+	// Certificate issued for the page
+	conn, err := s.dial(s.clientCert("test"))
+	if s.NoError(err) {
+		defer conn.Close()
+		resp, err := s.push(conn, &Message{Page: "test", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Empty(resp.Error)
+		}
+	}
+
+	// Certificate issued for another page
+	conn2, err := s.dial(s.clientCert("test"))
+	if s.NoError(err) {
+		defer conn2.Close()
+		resp, err := s.push(conn2, &Message{Page: "test2", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Contains(resp.Error, "Client certificate is issued for page test")
+		}
+		s.Nil(s.mt.PageExist("test2"))
+	}
+}
+
+func (s *tlsTestSuite) TestClientCertRequired() {
+	s.cfg.RequireClientCert = true
+	s.start()
+
+	conn, err := s.dial(nil)
+	if s.NoError(err) {
+		defer conn.Close()
+		_, err = s.push(conn, &Message{Page: "test", UpdateFreq: "second"})
+		s.Error(err)
+	}
+	s.Nil(s.mt.PageExist("test"))
+
+	conn2, err := s.dial(s.clientCert("test"))
+	if s.NoError(err) {
+		defer conn2.Close()
+		resp, err := s.push(conn2, &Message{Page: "test", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Empty(resp.Error)
+		}
+	}
+}
+
+func (s *tlsTestSuite) TestValidate() {
+	s.NoError(s.cfg.validate())
+	s.NoError((&TLSConfig{}).validate())
+
+	cfg := s.cfg
+	cfg.RequireClientCert = true
+	cfg.ClientCAFile = ""
+	s.Error(cfg.validate(), "Client certificates would not be verified")
+	s.Error((&TLSConfig{CertFile: s.cfg.CertFile}).validate())
+	s.Error((&TLSConfig{ClientCAFile: s.cfg.ClientCAFile}).validate())
+}
+
+func (s *tlsTestSuite) TestBrokenCertificate() {
+	cfg := DefaultConfig()
+	cfg.TLS = s.cfg
+	cfg.TLS.KeyFile = filepath.Join(s.dir, "missing.key")
+	_, err := NewFactoryWithConfig("127.0.0.1:0", cfg, zap.NewNop().Sugar())
+	s.Error(err, "Factory should not start without its certificate")
+}
+
+func (s *tlsTestSuite) TestListenerClosed() {
+	s.start()
+	s.ln.Close()
+	s.Eventually(func() bool {
+		return s.zapRecorder.FilterMessageSnippet("MetaTrader listener is closed").Len() == 1
+	}, TestTimeoutSeconds, time.Millisecond)
+	s.ln = nil
+}
+
+func (s *tlsTestSuite) TestReload() {
+	s.start()
+
+	conn, err := s.dial(nil)
+	if !s.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	resp, err := s.push(conn, &Message{Page: "test", UpdateFreq: "second"})
+	if s.NoError(err) {
+		s.Empty(resp.Error)
+	}
+	s.Equal("server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// Renew certificate, future modification time guarantees the change is noticed
+	s.writeServerCert("renewed")
+	future := time.Now().Add(time.Minute)
+	s.NoError(os.Chtimes(s.cfg.CertFile, future, future))
+
+	conn2, err := s.dial(nil)
+	if s.NoError(err) {
+		defer conn2.Close()
+		resp, err := s.push(conn2, &Message{Page: "test2", UpdateFreq: "second"})
+		if s.NoError(err) {
+			s.Empty(resp.Error)
+		}
+		s.Equal("renewed", conn2.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	}
+
+	// Live account is not affected
+	resp, err = s.push(conn, &Message{Balance: "100"})
+	if s.NoError(err) {
+		s.Empty(resp.Error)
+	}
+	if acc := s.mt.PageExist("test"); s.NotNil(acc) {
+		s.Equal("100", acc.Balance.String())
+	}
+}
+
+func (s *tlsTestSuite) dial(cert *tls.Certificate) (*tls.Conn, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca)
+	cfg := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return tls.Dial("tcp", s.ln.Addr().String(), cfg)
+}
+
+func (s *tlsTestSuite) push(conn net.Conn, msg *Message) (*ResponseMsg, error) {
+	// Gob streams are stateful, so keep codecs for the connection
+	if s.codecs == nil {
+		s.codecs = make(map[net.Conn]*gobCodec)
+	}
+	c, ok := s.codecs[conn]
+	if !ok {
+		c = &gobCodec{enc: gob.NewEncoder(conn), dec: gob.NewDecoder(conn)}
+		s.codecs[conn] = c
+	}
+
+	conn.SetDeadline(time.Now().Add(TestTimeoutSeconds))
+	if err := c.enc.Encode(msg); err != nil {
+		return nil, err
+	}
+	resp := new(ResponseMsg)
+	err := c.dec.Decode(resp)
+	return resp, err
+}
+
+func (s *tlsTestSuite) template(cn string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	s.Require().NoError(err)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+// issue certificate signed by test CA
+func (s *tlsTestSuite) issue(tmpl *x509.Certificate) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, &key.PublicKey, s.caKey)
+	s.Require().NoError(err)
+	return der, key
+}
+
+func (s *tlsTestSuite) writeServerCert(cn string) {
+	tmpl := s.template(cn)
+	tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	der, key := s.issue(tmpl)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	s.Require().NoError(err)
+	s.writePEM(s.cfg.KeyFile, "EC PRIVATE KEY", keyDer)
+	s.writePEM(s.cfg.CertFile, "CERTIFICATE", der)
+}
+
+func (s *tlsTestSuite) clientCert(page string) *tls.Certificate {
+	tmpl := s.template(page)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, key := s.issue(tmpl)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (s *tlsTestSuite) writePEM(name, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	s.Require().NoError(ioutil.WriteFile(name, data, 0600))
+}
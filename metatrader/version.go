@@ -0,0 +1,136 @@
+package metatrader
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the latest client version supported by the server
+const ProtocolVersion = "1.2"
+
+// Feature is a protocol capability negotiated on the first message
+type Feature string
+
+// Supported features
+const (
+	// FeatureHeartbeat allows Message.Heartbeat instead of empty updates
+	FeatureHeartbeat Feature = "heartbeat"
+	// FeatureDeltaOrders allows to omit unchanged orders, closed tickets are listed in Message.Closed
+	FeatureDeltaOrders Feature = "deltaorders"
+	// FeatureCompression compresses the stream with DEFLATE after the response to the first message
+	FeatureCompression Feature = "compression"
+)
+
+// featureSpec describes when the feature is enabled
+// Default features are enabled unless the client requests another set,
+// the features changing message semantics must be requested explicitly
+type featureSpec struct {
+	name         Feature
+	since        string
+	enabledByDef bool
+	streamOnly   bool // not available for JSON connections and HTTP push
+}
+
+var supportedFeatures = []featureSpec{
+	{name: FeatureHeartbeat, since: "0.0", enabledByDef: true},
+	{name: FeatureDeltaOrders, since: "1.2"},
+	{name: FeatureCompression, since: "1.2", streamOnly: true},
+}
+
+// featureSet keeps features enabled for the connection
+type featureSet map[Feature]bool
+
+// list of enabled features in the order of supportedFeatures
+func (fs featureSet) list() []string {
+	var ret []string
+	for _, spec := range supportedFeatures {
+		if fs[spec.name] {
+			ret = append(ret, string(spec.name))
+		}
+	}
+	return ret
+}
+
+// negotiate protocol features with the client
+// Unknown requested features are silently ignored, so clients may ask for more than server knows
+// Stream features are negotiated only for connections able to switch the stream
+func (f *Factory) negotiate(msg *Message, stream bool) (featureSet, error) {
+	if f.cfg.MinClientVersion != "" && compareVersions(msg.ClientVersion, f.cfg.MinClientVersion) < 0 {
+		return nil, &PageError{
+			Code: ErrCodeVersionUnsupported,
+			Text: "Client version " + msg.ClientVersion + " is not supported, please upgrade to " + f.cfg.LatestClientVersion,
+		}
+	}
+
+	requested := make(map[Feature]bool)
+	for _, name := range msg.Features {
+		requested[Feature(strings.ToLower(name))] = true
+	}
+
+	fs := make(featureSet)
+	for _, spec := range supportedFeatures {
+		if compareVersions(msg.ClientVersion, spec.since) < 0 || (spec.streamOnly && !stream) {
+			continue
+		}
+		if requested[spec.name] || (len(requested) == 0 && spec.enabledByDef) {
+			fs[spec.name] = true
+		}
+	}
+	return fs, nil
+}
+
+// upgradeNotice returns a message for outdated clients
+func (f *Factory) upgradeNotice(version string) string {
+	if version == "" || f.cfg.LatestClientVersion == "" {
+		return ""
+	}
+	if compareVersions(version, f.cfg.LatestClientVersion) >= 0 {
+		return ""
+	}
+	return "New API version " + f.cfg.LatestClientVersion + " is available"
+}
+
+// compareVersions of dotted form like "1.2.3"
+// Returns -1 if a < b, 0 if equal, +1 if a > b. Missing or malformed parts are zeros
+func compareVersions(a, b string) int {
+	va, vb := parseVersion(a), parseVersion(b)
+	for len(va) < len(vb) {
+		va = append(va, 0)
+	}
+	for len(vb) < len(va) {
+		vb = append(vb, 0)
+	}
+
+	for i := range va {
+		if va[i] < vb[i] {
+			return -1
+		}
+		if va[i] > vb[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) []int {
+	var ret []int
+	for _, part := range strings.Split(strings.TrimSpace(v), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			n = 0
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// validVersion checks configured version format
+func validVersion(v string) error {
+	for _, part := range strings.Split(v, ".") {
+		if _, err := strconv.Atoi(part); err != nil {
+			return errors.New("Version " + v + " should be in form of 1.2.3")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package metatrader
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrViewerClosed is returned by Send when the viewer is closed
+var ErrViewerClosed = errors.New("Viewer is closed")
+
+// ViewerMessage is the message broker sends to the viewer
+// ID lets the viewer resume the stream after reconnect, see SSE Last-Event-ID
+type ViewerMessage struct {
+	ID      string
+	Channel string
+	Data    []byte
+}
+
+// Viewer receives account messages from the broker
+// Send may block, the broker calls it from the viewer own goroutine and closes the viewer to stop it
+// Close must be safe to call more than once
+type Viewer interface {
+	Send(msg ViewerMessage) error
+	Close() error
+	ID() string
+}
+
+// ChannelViewer is the in-memory viewer, for Go code embedding the engine
+// Messages are delivered to the Go channel, the broker queue policy applies when it is not read
+// Add it to the account got by Factory.Account, PageExist is not safe out of the factory
+type ChannelViewer struct {
+	id        string
+	messages  chan ViewerMessage
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewChannelViewer makes the viewer with buffer of size messages
+func NewChannelViewer(id string, size int) *ChannelViewer {
+	return &ChannelViewer{
+		id:       id,
+		messages: make(chan ViewerMessage, size),
+		done:     make(chan struct{}),
+	}
+}
+
+// Send the message to the channel, waits for the reader while the viewer is open
+func (v *ChannelViewer) Send(msg ViewerMessage) error {
+	select {
+	case <-v.done:
+		return ErrViewerClosed
+	default:
+	}
+	select {
+	case v.messages <- msg:
+		return nil
+	case <-v.done:
+		return ErrViewerClosed
+	}
+}
+
+// Close the viewer, Messages channel is left open to read the buffered messages
+func (v *ChannelViewer) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.done)
+	})
+	return nil
+}
+
+// ID of the viewer
+func (v *ChannelViewer) ID() string {
+	return v.id
+}
+
+// Messages returns the channel messages are delivered to
+func (v *ChannelViewer) Messages() <-chan ViewerMessage {
+	return v.messages
+}
+
+// Done is closed when the viewer is closed, either by the broker or by the owner
+func (v *ChannelViewer) Done() <-chan struct{} {
+	return v.done
+}
@@ -0,0 +1,106 @@
+package metatrader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Viewer connection defaults
+const (
+	ViewerPingInterval = 30 * time.Second
+	ViewerPongTimeout  = 60 * time.Second
+	ViewerMaxMsgSize   = 4096 // bytes, viewers send short commands only
+)
+
+// WebSocketViewer sends broker messages to WebSocket connection
+// The connection is read by its owner, as gorilla allows one reader and one writer
+type WebSocketViewer struct {
+	ws        *websocket.Conn
+	closeOnce sync.Once
+}
+
+// NewWebSocketViewer makes the viewer writing to the connection
+func NewWebSocketViewer(ws *websocket.Conn) *WebSocketViewer {
+	return &WebSocketViewer{ws: ws}
+}
+
+// Send the message data as text message, slow connections fail to write in time
+func (v *WebSocketViewer) Send(msg ViewerMessage) error {
+	v.ws.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	return v.ws.WriteMessage(websocket.TextMessage, msg.Data)
+}
+
+// Close the connection
+func (v *WebSocketViewer) Close() error {
+	var err error
+	v.closeOnce.Do(func() {
+		err = v.ws.Close()
+	})
+	return err
+}
+
+// ID is the remote address of the connection
+func (v *WebSocketViewer) ID() string {
+	return v.ws.RemoteAddr().String()
+}
+
+// serveViewer reads the viewer connection until it's closed, silent for too long or the token expires
+// The viewer is removed from the broker when done
+func (f *Factory) serveViewer(acc *Account, viewer *WebSocketViewer, expires time.Time) {
+	defer acc.RemoveViewer(viewer)
+	if t := acc.expireViewer(viewer, expires); t != nil {
+		defer t.Stop()
+	}
+	f.readViewer(viewer.ws, func(data []byte) {
+		acc.handleCommand(viewer, data)
+	})
+}
+
+// readViewer passes viewer messages to handle until the connection is closed or silent for too long
+// Control frames are handled while reading, the connection is closed when done
+func (f *Factory) readViewer(ws *websocket.Conn, handle func(data []byte)) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		ws.Close()
+	}()
+
+	pongTimeout := time.Duration(f.cfg.ViewerPongTimeout)
+	ws.SetReadLimit(int64(f.cfg.ViewerMaxMsgSize))
+	ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	go f.pingViewer(ws, done)
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				f.log.Debug("Viewer read failed ", ws.RemoteAddr(), ": ", err)
+			}
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(pongTimeout))
+		handle(data)
+	}
+}
+
+// pingViewer sends pings until done, the viewer is expected to answer within pong timeout
+func (f *Factory) pingViewer(ws *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(time.Duration(f.cfg.ViewerPingInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// Control frames may be written concurrently with the broker writes
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(500*time.Millisecond)); err != nil {
+				return
+			}
+		}
+	}
+}